@@ -2,8 +2,11 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
@@ -13,66 +16,87 @@ import (
 	"time"
 
 	"github.com/miekg/dns"
+	"gopkg.in/yaml.v2"
 
+	"github.com/charlieegan3/tool-tsnet-proxy/pkg/admin"
+	"github.com/charlieegan3/tool-tsnet-proxy/pkg/metrics"
 	"github.com/charlieegan3/tool-tsnet-proxy/pkg/proxy"
+	"github.com/charlieegan3/tool-tsnet-proxy/pkg/requestid"
 )
 
 func main() {
-	configFilePath := "config.yaml"
-	if len(os.Args) > 1 {
-		configFilePath = os.Args[1]
-	}
-
-	configFile, err := os.Open(configFilePath)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to open config file: %v\n", err)
+	slog.SetDefault(slog.New(requestid.NewLogHandler(slog.NewTextHandler(os.Stderr, nil))))
 
-		return
-	}
+	if len(os.Args) > 2 && os.Args[1] == "config" && os.Args[2] == "dump" {
+		configFilePath := "config.yaml"
+		if len(os.Args) > 3 {
+			configFilePath = os.Args[3]
+		}
 
-	cfg, err := proxy.LoadConfig(configFile)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to load config: %v\n", err)
+		if err := dumpConfig(os.Stdout, configFilePath); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to dump config: %v\n", err)
+			os.Exit(1)
+		}
 
 		return
 	}
 
-	cfgCtx, cfgCtxCancel := context.WithTimeout(context.Background(), 2*time.Second)
-	defer cfgCtxCancel()
-
-	proxyHandler, dnsServers, err := proxy.NewHandlerFromConfig(cfgCtx, cfg)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to create proxy: %v\n", err)
-
-		return
+	configFilePath := "config.yaml"
+	if len(os.Args) > 1 {
+		configFilePath = os.Args[1]
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	for _, dnsServer := range dnsServers {
-		go func(dnsServer *dns.Server) {
-			select {
-			case <-ctx.Done():
-				shutdownContext, shutdownContextCancel := context.WithTimeout(ctx, 2*time.Second)
-				defer shutdownContextCancel()
+	m := metrics.New()
 
-				if err := dnsServer.ShutdownContext(shutdownContext); err != nil {
-					log.Fatalf("Failed to shutdown DNS server: %s\n", err.Error())
-				}
-			default:
+	// set once the admin server is running, before reloads can happen
+	var rebindAdmin func(prev, h *proxy.Handler)
+
+	// handlers aren't built under a deadline, OPA middlewares which wait
+	// for their bundle have their own timeout
+	reloader, err := proxy.NewReloader(ctx, proxy.ReloaderOptions{
+		Path:    configFilePath,
+		Metrics: m,
+		StartDNSServer: func(dnsServer *dns.Server) {
+			go func() {
 				if err := dnsServer.ListenAndServe(); err != nil {
 					log.Fatalf("Failed to start DNS server: %s\n", err.Error())
 				}
+			}()
+		},
+		OnReload: func(prev, h *proxy.Handler) {
+			if rebindAdmin != nil {
+				rebindAdmin(prev, h)
 			}
-		}(dnsServer)
+		},
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load config: %v\n", err)
+
+		return
+	}
+	defer reloader.Close()
+
+	// server settings are only read at startup, changes to them need a
+	// restart
+	cfg := reloader.Handler().Config()
+
+	readHeaderTimeout := cfg.ReadHeaderTimeout
+	if readHeaderTimeout == 0 {
+		readHeaderTimeout = 10 * time.Second
 	}
 
 	srv := &http.Server{
 		Addr:    net.JoinHostPort(cfg.Addr, strconv.Itoa(cfg.Port)),
-		Handler: proxyHandler,
+		Handler: reloader,
 
-		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       cfg.ReadTimeout,
+		ReadHeaderTimeout: readHeaderTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
 	}
 
 	go func() {
@@ -91,16 +115,110 @@ func main() {
 		}
 	}()
 
+	adminListener, err := admin.Listen(cfg.Admin, reloader.Handler())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create admin listener: %v\n", err)
+
+		return
+	}
+
+	if adminListener != nil {
+		adminSrv := &http.Server{
+			Handler: admin.NewHandler(admin.Options{
+				Handler:     reloader.Handler,
+				Metrics:     m.Handler(),
+				MetricsOnly: admin.MetricsOnly(cfg.Admin),
+			}),
+			ReadHeaderTimeout: readHeaderTimeout,
+		}
+
+		serveAdmin := func(l net.Listener) {
+			// tailnet listeners are closed when a reload replaces the tailnet
+			if err := adminSrv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) && !errors.Is(err, net.ErrClosed) {
+				log.Fatalf("Failed to start admin server: %s\n", err.Error())
+			}
+		}
+
+		go serveAdmin(adminListener)
+
+		rebindAdmin = func(prev, h *proxy.Handler) {
+			l, err := admin.Relisten(cfg.Admin, prev, h)
+			if err != nil {
+				slog.Error("failed to listen on the replaced admin tailnet", "error", err)
+
+				return
+			}
+
+			if l != nil {
+				go serveAdmin(l)
+			}
+		}
+
+		defer adminSrv.Close()
+	}
+
+	if cfg.WatchConfig {
+		go func() {
+			if err := reloader.Watch(ctx); err != nil {
+				slog.Error("failed to watch config", "error", err)
+			}
+		}()
+	}
+
 	fmt.Fprintln(os.Stderr, "Proxy started")
 
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case sig := <-sigChan:
+			if sig == syscall.SIGHUP {
+				reload(ctx, reloader)
+
+				continue
+			}
+
+			fmt.Fprintln(os.Stderr, "\nShutting down...")
+			cancel()
+		}
+	}
+}
+
+func reload(ctx context.Context, reloader *proxy.Reloader) {
+	if err := reloader.Reload(ctx); err != nil {
+		slog.Error("failed to reload config, keeping the current config", "error", err)
 
-	select {
-	case <-ctx.Done():
 		return
-	case <-sigChan:
-		fmt.Fprintln(os.Stderr, "\nShutting down...")
-		cancel()
 	}
+
+	slog.Info("reloaded config")
+}
+
+// dumpConfig prints the config as the proxy sees it, with references
+// resolved and secrets redacted.
+func dumpConfig(w io.Writer, path string) error {
+	cfg, err := proxy.LoadConfigFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	cfg, err = cfg.Redacted()
+	if err != nil {
+		return fmt.Errorf("failed to redact config: %w", err)
+	}
+
+	b, err := yaml.Marshal(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to encode config: %w", err)
+	}
+
+	_, err = w.Write(b)
+	if err != nil {
+		return fmt.Errorf("failed to write config: %w", err)
+	}
+
+	return nil
 }
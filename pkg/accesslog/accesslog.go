@@ -0,0 +1,265 @@
+package accesslog
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/charlieegan3/tool-tsnet-proxy/pkg/requestid"
+)
+
+// Entry is a single line in the access log.
+type Entry struct {
+	Time       time.Time
+	RequestID  string
+	RemoteAddr string
+	Method     string
+	Host       string
+	URI        string
+	Proto      string
+	Referer    string
+	UserAgent  string
+	Status     int
+	BytesIn    int64
+	BytesOut   int64
+	Duration   time.Duration
+
+	// Upstream is the name of the matched upstream, Endpoint is where the
+	// request was sent and Tailnet is set when the upstream is dialed over
+	// a tailnet.
+	Upstream        string
+	Endpoint        string
+	Tailnet         string
+	UpstreamLatency time.Duration
+
+	// Decision is the result of the OPA policy, if any
+	Decision string
+	Identity string
+}
+
+type Options struct {
+	Format Format
+	Writer io.Writer
+
+	// SampleRate is the fraction of requests which are logged, responses
+	// with a 5xx status are always logged. Values outside (0, 1) log
+	// every request.
+	SampleRate float64
+
+	// ExcludePaths are path.Match patterns for paths which are not
+	// logged.
+	ExcludePaths []string
+
+	// Identity returns the authenticated user for the request.
+	Identity func(*http.Request) string
+
+	// Now returns the current time, it defaults to time.Now.
+	Now func() time.Time
+}
+
+type contextKey struct{}
+
+// recorder collects the details set by handlers further down the chain,
+// it's locked since handlers such as the cache can still be running in the
+// background after the response is sent.
+type recorder struct {
+	mu    sync.Mutex
+	entry Entry
+}
+
+func fromContext(ctx context.Context) *recorder {
+	rec, _ := ctx.Value(contextKey{}).(*recorder)
+
+	return rec
+}
+
+// SetUpstream records where the request was sent.
+func SetUpstream(ctx context.Context, upstream, endpoint, tailnet string) {
+	if rec := fromContext(ctx); rec != nil {
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+
+		rec.entry.Upstream = upstream
+		rec.entry.Endpoint = endpoint
+		rec.entry.Tailnet = tailnet
+	}
+}
+
+// SetUpstreamLatency records how long the upstream took to respond.
+func SetUpstreamLatency(ctx context.Context, d time.Duration) {
+	if rec := fromContext(ctx); rec != nil {
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+
+		rec.entry.UpstreamLatency = d
+	}
+}
+
+// SetDecision records the result of the authorization policy.
+func SetDecision(ctx context.Context, decision string) {
+	if rec := fromContext(ctx); rec != nil {
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+
+		rec.entry.Decision = decision
+	}
+}
+
+// NewMiddleware returns a middleware which writes an entry to the access
+// log once each response has been sent.
+func NewMiddleware(opts Options) func(http.Handler) http.Handler {
+	if opts.Format == nil {
+		opts.Format = CombinedFormat
+	}
+
+	if opts.Now == nil {
+		opts.Now = time.Now
+	}
+
+	var mu sync.Mutex
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if excluded(opts.ExcludePaths, r.URL.Path) {
+				next.ServeHTTP(w, r)
+
+				return
+			}
+
+			start := opts.Now()
+
+			rec := &recorder{}
+			body := &countingReader{ReadCloser: r.Body}
+			cw := &countingWriter{ResponseWriter: w}
+
+			r = r.WithContext(context.WithValue(r.Context(), contextKey{}, rec))
+			if r.Body != nil && r.Body != http.NoBody {
+				r.Body = body
+			}
+
+			next.ServeHTTP(cw, r)
+
+			status := cw.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+
+			if !sampled(opts.SampleRate, status) {
+				return
+			}
+
+			rec.mu.Lock()
+			entry := rec.entry
+			rec.mu.Unlock()
+
+			entry.Time = start
+			entry.RequestID = requestid.FromContext(r.Context())
+			entry.RemoteAddr = r.RemoteAddr
+			entry.Method = r.Method
+			entry.Host = r.Host
+			entry.URI = r.RequestURI
+			entry.Proto = r.Proto
+			entry.Referer = r.Referer()
+			entry.UserAgent = r.UserAgent()
+			entry.Status = status
+			entry.BytesIn = body.count
+			entry.BytesOut = cw.count
+			entry.Duration = opts.Now().Sub(start)
+
+			if entry.URI == "" {
+				entry.URI = r.URL.RequestURI()
+			}
+
+			if opts.Identity != nil {
+				entry.Identity = opts.Identity(r)
+			}
+
+			var buf bytes.Buffer
+
+			err := opts.Format(&buf, &entry)
+			if err != nil {
+				slog.ErrorContext(r.Context(), "failed to format access log entry", "error", err)
+
+				return
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			_, err = opts.Writer.Write(buf.Bytes())
+			if err != nil {
+				slog.ErrorContext(r.Context(), "failed to write access log entry", "error", err)
+			}
+		})
+	}
+}
+
+func excluded(patterns []string, p string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, p); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func sampled(rate float64, status int) bool {
+	if rate <= 0 || rate >= 1 || status >= http.StatusInternalServerError {
+		return true
+	}
+
+	//nolint:gosec
+	return rand.Float64() < rate
+}
+
+type countingReader struct {
+	io.ReadCloser
+
+	count int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.count += int64(n)
+
+	//nolint:wrapcheck
+	return n, err
+}
+
+type countingWriter struct {
+	http.ResponseWriter
+
+	status int
+	count  int64
+}
+
+func (w *countingWriter) WriteHeader(statusCode int) {
+	if w.status == 0 {
+		w.status = statusCode
+	}
+
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	n, err := w.ResponseWriter.Write(b)
+	w.count += int64(n)
+
+	//nolint:wrapcheck
+	return n, err
+}
+
+func (w *countingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
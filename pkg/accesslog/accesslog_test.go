@@ -0,0 +1,164 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/charlieegan3/tool-tsnet-proxy/pkg/requestid"
+)
+
+var fixedTime = time.Date(2024, 9, 1, 12, 0, 0, 0, time.UTC)
+
+// upstreamHandler reads the body and sets the details normally set by the
+// proxy.
+var upstreamHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	//nolint:errcheck
+	io.Copy(io.Discard, r.Body)
+
+	SetUpstream(r.Context(), "internal", "http://internal.example.com", "tsnet")
+	SetUpstreamLatency(r.Context(), 2*time.Second)
+	SetDecision(r.Context(), "allow")
+
+	w.WriteHeader(http.StatusCreated)
+
+	//nolint:errcheck
+	w.Write([]byte("hello"))
+})
+
+func serve(t *testing.T, opts Options, req *http.Request) string {
+	t.Helper()
+
+	var buf bytes.Buffer
+
+	opts.Writer = &buf
+	opts.Now = func() time.Time { return fixedTime }
+	opts.Identity = func(*http.Request) string { return "user@example.com" }
+
+	h := requestid.NewMiddleware(requestid.Options{TrustIncoming: true})(NewMiddleware(opts)(upstreamHandler))
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	return buf.String()
+}
+
+func newRequest() *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/foo?bar=baz", strings.NewReader("body"))
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("User-Agent", "test")
+	req.Header.Set("X-Request-ID", "abc")
+
+	return req
+}
+
+func TestMiddlewareFormats(t *testing.T) {
+	t.Parallel()
+
+	tmpl, err := TemplateFormat("{{.Upstream}} {{.Tailnet}} {{.Status}} {{.UpstreamLatency}} {{.Decision}}")
+	if err != nil {
+		t.Fatalf("failed to parse template: %v", err)
+	}
+
+	tests := map[string]struct {
+		format Format
+		exp    string
+	}{
+		"common": {
+			format: CommonFormat,
+			exp:    `192.0.2.1 - user@example.com [01/Sep/2024:12:00:00 +0000] "POST /foo?bar=baz HTTP/1.1" 201 5` + "\n",
+		},
+		"combined": {
+			format: CombinedFormat,
+			exp:    `192.0.2.1 - user@example.com [01/Sep/2024:12:00:00 +0000] "POST /foo?bar=baz HTTP/1.1" 201 5 "-" "test"` + "\n",
+		},
+		"template": {
+			format: tmpl,
+			exp:    "internal tsnet 201 2s allow\n",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			if exp, got := test.exp, serve(t, Options{Format: test.format}, newRequest()); exp != got {
+				t.Fatalf("expected %q, got %q", exp, got)
+			}
+		})
+	}
+}
+
+func TestMiddlewareJSON(t *testing.T) {
+	t.Parallel()
+
+	var entry map[string]any
+
+	err := json.Unmarshal([]byte(serve(t, Options{Format: JSONFormat}, newRequest())), &entry)
+	if err != nil {
+		t.Fatalf("failed to decode entry: %v", err)
+	}
+
+	exp := map[string]any{
+		"msg":              "access",
+		"request_id":       "abc",
+		"upstream":         "internal",
+		"endpoint":         "http://internal.example.com",
+		"tailnet":          "tsnet",
+		"decision":         "allow",
+		"identity":         "user@example.com",
+		"status":           float64(http.StatusCreated),
+		"bytes_in":         float64(4),
+		"bytes_out":        float64(5),
+		"upstream_latency": float64(2 * time.Second),
+	}
+
+	for k, v := range exp {
+		if entry[k] != v {
+			t.Errorf("expected %s to be %v, got %v", k, v, entry[k])
+		}
+	}
+}
+
+func TestMiddlewareExcludePaths(t *testing.T) {
+	t.Parallel()
+
+	opts := Options{ExcludePaths: []string{"/healthz", "/static/*"}}
+
+	for _, p := range []string{"/healthz", "/static/app.js"} {
+		if got := serve(t, opts, httptest.NewRequest(http.MethodGet, p, nil)); got != "" {
+			t.Fatalf("expected %s to be excluded, got %q", p, got)
+		}
+	}
+
+	if got := serve(t, opts, httptest.NewRequest(http.MethodGet, "/static/js/app.js", nil)); got == "" {
+		t.Fatal("expected nested path to be logged")
+	}
+}
+
+func TestSampled(t *testing.T) {
+	t.Parallel()
+
+	if !sampled(0, http.StatusOK) || !sampled(1, http.StatusOK) {
+		t.Fatal("expected all requests to be logged without sampling")
+	}
+
+	if !sampled(0.0000001, http.StatusBadGateway) {
+		t.Fatal("expected errors to always be logged")
+	}
+
+	count := 0
+
+	for range 1000 {
+		if sampled(0.1, http.StatusOK) {
+			count++
+		}
+	}
+
+	if count == 0 || count > 300 {
+		t.Fatalf("expected roughly 100 of 1000 requests to be sampled, got %d", count)
+	}
+}
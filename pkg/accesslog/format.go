@@ -0,0 +1,143 @@
+package accesslog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"text/template"
+)
+
+// Format writes an entry as a single line.
+type Format func(w io.Writer, e *Entry) error
+
+const clfTime = "02/Jan/2006:15:04:05 -0700"
+
+// CommonFormat writes entries in the Common Log Format.
+func CommonFormat(w io.Writer, e *Entry) error {
+	_, err := fmt.Fprintf(w, "%s\n", common(e))
+
+	//nolint:wrapcheck
+	return err
+}
+
+// CombinedFormat writes entries in the Combined Log Format, which adds the
+// referer and user agent to the Common Log Format.
+func CombinedFormat(w io.Writer, e *Entry) error {
+	_, err := fmt.Fprintf(w, "%s %s %s\n", common(e), quote(e.Referer), quote(e.UserAgent))
+
+	//nolint:wrapcheck
+	return err
+}
+
+func common(e *Entry) string {
+	host, _, err := net.SplitHostPort(e.RemoteAddr)
+	if err != nil {
+		host = e.RemoteAddr
+	}
+
+	bytesOut := "-"
+	if e.BytesOut > 0 {
+		bytesOut = strconv.FormatInt(e.BytesOut, 10)
+	}
+
+	return fmt.Sprintf("%s - %s [%s] %s %d %s",
+		dash(host),
+		dash(e.Identity),
+		e.Time.Format(clfTime),
+		quote(e.Method+" "+e.URI+" "+e.Proto),
+		e.Status,
+		bytesOut,
+	)
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+
+	return s
+}
+
+func quote(s string) string {
+	if s == "" {
+		return `"-"`
+	}
+
+	return strconv.Quote(s)
+}
+
+// JSONFormat writes entries as JSON objects using log/slog.
+func JSONFormat(w io.Writer, e *Entry) error {
+	h := slog.NewJSONHandler(w, nil)
+
+	rec := slog.NewRecord(e.Time, slog.LevelInfo, "access", 0)
+	rec.AddAttrs(
+		slog.String("request_id", e.RequestID),
+		slog.String("remote_addr", e.RemoteAddr),
+		slog.String("method", e.Method),
+		slog.String("host", e.Host),
+		slog.String("uri", e.URI),
+		slog.String("proto", e.Proto),
+		slog.Int("status", e.Status),
+		slog.Int64("bytes_in", e.BytesIn),
+		slog.Int64("bytes_out", e.BytesOut),
+		slog.Duration("duration", e.Duration),
+		slog.String("upstream", e.Upstream),
+		slog.String("endpoint", e.Endpoint),
+		slog.String("tailnet", e.Tailnet),
+		slog.Duration("upstream_latency", e.UpstreamLatency),
+		slog.String("decision", e.Decision),
+		slog.String("identity", e.Identity),
+		slog.String("referer", e.Referer),
+		slog.String("user_agent", e.UserAgent),
+	)
+
+	//nolint:wrapcheck
+	return h.Handle(context.Background(), rec)
+}
+
+// TemplateFormat writes entries using a text/template which is executed
+// with the Entry, a newline is added after each entry.
+func TemplateFormat(text string) (Format, error) {
+	tmpl, err := template.New("access-log").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse access log template: %w", err)
+	}
+
+	return func(w io.Writer, e *Entry) error {
+		err := tmpl.Execute(w, e)
+		if err != nil {
+			return fmt.Errorf("failed to execute access log template: %w", err)
+		}
+
+		_, err = io.WriteString(w, "\n")
+
+		//nolint:wrapcheck
+		return err
+	}, nil
+}
+
+// NewFormat returns the named format, one of common, combined (the
+// default), json or template.
+func NewFormat(name, tmpl string) (Format, error) {
+	switch name {
+	case "common":
+		return CommonFormat, nil
+	case "", "combined":
+		return CombinedFormat, nil
+	case "json":
+		return JSONFormat, nil
+	case "template":
+		if tmpl == "" {
+			return nil, errors.New("template is required for template format")
+		}
+
+		return TemplateFormat(tmpl)
+	}
+
+	return nil, fmt.Errorf("unknown access log format %q", name)
+}
@@ -0,0 +1,162 @@
+package accesslog
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// RotatingFile is a log file which is moved aside once it reaches MaxSize.
+// Old files are named path.1, path.2 and so on with path.1 the most recent.
+type RotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// NewRotatingFile opens the file at path for appending. A maxSize of zero
+// disables rotation, maxBackups is the number of old files to keep.
+func NewRotatingFile(path string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	f := &RotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+
+	err := f.open()
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open access log file: %w", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+
+		return fmt.Errorf("failed to stat access log file: %w", err)
+	}
+
+	f.file = file
+	f.size = info.Size()
+
+	return nil
+}
+
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		err := f.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+
+	//nolint:wrapcheck
+	return n, err
+}
+
+func (f *RotatingFile) rotate() error {
+	err := f.file.Close()
+	if err != nil {
+		return fmt.Errorf("failed to close access log file: %w", err)
+	}
+
+	if f.maxBackups <= 0 {
+		err = os.Remove(f.path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove access log file: %w", err)
+		}
+
+		return f.open()
+	}
+
+	for i := f.maxBackups - 1; i > 0; i-- {
+		err = os.Rename(backupName(f.path, i), backupName(f.path, i+1))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to rotate access log file: %w", err)
+		}
+	}
+
+	err = os.Rename(f.path, backupName(f.path, 1))
+	if err != nil {
+		return fmt.Errorf("failed to rotate access log file: %w", err)
+	}
+
+	return f.open()
+}
+
+func backupName(path string, i int) string {
+	return fmt.Sprintf("%s.%d", path, i)
+}
+
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	//nolint:wrapcheck
+	return f.file.Close()
+}
+
+// nopCloser is used for stdout and stderr which must not be closed.
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+type OutputOptions struct {
+	// Output is one of stdout (the default), stderr, file or syslog
+	Output string
+
+	Path       string
+	MaxSize    int64
+	MaxBackups int
+
+	// SyslogNetwork and SyslogAddr are passed to syslog.Dial, when empty
+	// the local syslog server is used.
+	SyslogNetwork string
+	SyslogAddr    string
+	SyslogTag     string
+}
+
+// NewOutput opens the writer for the access log, it must be closed when
+// it's no longer used.
+func NewOutput(opts OutputOptions) (io.WriteCloser, error) {
+	switch opts.Output {
+	case "", "stdout":
+		return nopCloser{os.Stdout}, nil
+	case "stderr":
+		return nopCloser{os.Stderr}, nil
+	case "file":
+		if opts.Path == "" {
+			return nil, errors.New("path is required for file output")
+		}
+
+		return NewRotatingFile(opts.Path, opts.MaxSize, opts.MaxBackups)
+	case "syslog":
+		return newSyslog(opts.SyslogNetwork, opts.SyslogAddr, opts.SyslogTag)
+	}
+
+	return nil, fmt.Errorf("unknown access log output %q", opts.Output)
+}
@@ -0,0 +1,48 @@
+package accesslog
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRotatingFile(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "access.log")
+
+	f, err := NewRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatalf("failed to open file: %v", err)
+	}
+	defer f.Close()
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		_, err := f.Write([]byte(line))
+		if err != nil {
+			t.Fatalf("failed to write: %v", err)
+		}
+	}
+
+	exp := map[string]string{
+		path:        "fourth\n",
+		path + ".1": "third\n",
+		path + ".2": "second\n",
+	}
+
+	for p, content := range exp {
+		bs, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatalf("failed to read %s: %v", p, err)
+		}
+
+		if exp, got := content, string(bs); exp != got {
+			t.Fatalf("expected %s to contain %q, got %q", p, exp, got)
+		}
+	}
+
+	_, err = os.Stat(path + ".3")
+	if !os.IsNotExist(err) {
+		t.Fatalf("expected only two backups, got %v", err)
+	}
+}
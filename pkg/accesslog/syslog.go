@@ -0,0 +1,18 @@
+//go:build !windows && !plan9
+
+package accesslog
+
+import (
+	"fmt"
+	"io"
+	"log/syslog"
+)
+
+func newSyslog(network, addr, tag string) (io.WriteCloser, error) {
+	w, err := syslog.Dial(network, addr, syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to syslog: %w", err)
+	}
+
+	return w, nil
+}
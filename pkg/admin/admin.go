@@ -0,0 +1,327 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/charlieegan3/tool-tsnet-proxy/pkg/proxy"
+)
+
+type Options struct {
+	// Handler returns the proxy handler which is currently serving
+	// requests.
+	Handler func() *proxy.Handler
+
+	// Metrics, if set, is served at /metrics.
+	Metrics http.Handler
+
+	// MetricsOnly serves only /metrics, for listeners reachable by other
+	// hosts.
+	MetricsOnly bool
+}
+
+type upstream struct {
+	Name         string   `json:"name"`
+	Endpoint     string   `json:"endpoint,omitempty"`
+	Tailnet      string   `json:"tailnet,omitempty"`
+	Hosts        []string `json:"hosts,omitempty"`
+	PathPrefixes []string `json:"path_prefixes,omitempty"`
+	Middlewares  []string `json:"middlewares"`
+	State        string   `json:"state"`
+	InFlight     int      `json:"in_flight"`
+	QueueDepth   int      `json:"queue_depth"`
+	Health       health   `json:"health"`
+}
+
+type matcher struct {
+	Upstream     string   `json:"upstream"`
+	Hosts        []string `json:"hosts"`
+	PathPrefixes []string `json:"path_prefixes"`
+}
+
+type health struct {
+	Healthy             bool       `json:"healthy"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	LastSuccess         *time.Time `json:"last_success,omitempty"`
+	LastFailure         *time.Time `json:"last_failure,omitempty"`
+	LastError           string     `json:"last_error,omitempty"`
+}
+
+type tailnet struct {
+	Name  string `json:"name"`
+	ID    string `json:"id"`
+	State string `json:"state"`
+}
+
+type policy struct {
+	Bundle string `json:"bundle"`
+	Ready  bool   `json:"ready"`
+}
+
+type readiness struct {
+	Ready    bool     `json:"ready"`
+	Policies []policy `json:"policies"`
+}
+
+type middlewares struct {
+	Global    []string            `json:"global"`
+	Upstreams map[string][]string `json:"upstreams"`
+}
+
+// NewHandler returns the admin API. Handlers which list state respond to
+// GET, those which change it respond to POST and take effect immediately.
+func NewHandler(opts Options) http.Handler {
+	a := &api{opts: opts}
+
+	mux := http.NewServeMux()
+
+	if opts.Metrics != nil {
+		mux.Handle("GET /metrics", opts.Metrics)
+	}
+
+	if opts.MetricsOnly {
+		return mux
+	}
+
+	mux.HandleFunc("GET /upstreams", a.upstreams)
+	mux.HandleFunc("GET /matchers", a.matchers)
+	mux.HandleFunc("GET /middlewares", a.middlewares)
+	mux.HandleFunc("GET /tailnets", a.tailnets)
+	mux.HandleFunc("GET /health", a.health)
+	mux.HandleFunc("GET /ready", a.ready)
+
+	// upstream names default to their endpoint, so they are passed in the
+	// query rather than the path
+	mux.HandleFunc("POST /upstreams/enable", a.setState(proxy.UpstreamActive))
+	mux.HandleFunc("POST /upstreams/drain", a.setState(proxy.UpstreamDraining))
+	mux.HandleFunc("POST /upstreams/disable", a.setState(proxy.UpstreamDisabled))
+
+	mux.HandleFunc("POST /opa/reload", a.reloadPolicies)
+	mux.HandleFunc("POST /caches/flush", a.flushCaches)
+
+	return mux
+}
+
+type api struct {
+	opts Options
+}
+
+func (a *api) upstreams(w http.ResponseWriter, _ *http.Request) {
+	h := a.opts.Handler()
+
+	configs := make(map[string]proxy.ConfigUpstream)
+
+	if cfg := h.Config(); cfg != nil {
+		for _, u := range cfg.Upstreams {
+			configs[upstreamName(u)] = u
+		}
+	}
+
+	upstreams := make([]upstream, 0)
+
+	for _, s := range h.Upstreams() {
+		u := upstream{
+			Name:        s.Name,
+			Tailnet:     s.Tailnet,
+			Middlewares: s.Middlewares,
+			State:       s.State.String(),
+			InFlight:    s.InFlight,
+			QueueDepth:  s.QueueDepth,
+			Health:      newHealth(s.Health),
+		}
+
+		if u.Middlewares == nil {
+			u.Middlewares = []string{}
+		}
+
+		if cfg, ok := configs[s.Name]; ok {
+			u.Endpoint = cfg.Endpoint
+			u.Hosts = cfg.Hosts
+			u.PathPrefixes = cfg.PathPrefixes
+		}
+
+		upstreams = append(upstreams, u)
+	}
+
+	writeJSON(w, http.StatusOK, upstreams)
+}
+
+func (a *api) matchers(w http.ResponseWriter, _ *http.Request) {
+	matchers := make([]matcher, 0)
+
+	if cfg := a.opts.Handler().Config(); cfg != nil {
+		for _, u := range cfg.Upstreams {
+			matchers = append(matchers, matcher{
+				Upstream:     upstreamName(u),
+				Hosts:        nonNil(u.Hosts),
+				PathPrefixes: nonNil(u.PathPrefixes),
+			})
+		}
+	}
+
+	writeJSON(w, http.StatusOK, matchers)
+}
+
+func (a *api) middlewares(w http.ResponseWriter, _ *http.Request) {
+	h := a.opts.Handler()
+
+	res := middlewares{
+		Global:    nonNil(h.Middlewares()),
+		Upstreams: make(map[string][]string),
+	}
+
+	for _, s := range h.Upstreams() {
+		res.Upstreams[s.Name] = nonNil(s.Middlewares)
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (a *api) tailnets(w http.ResponseWriter, _ *http.Request) {
+	h := a.opts.Handler()
+	states := h.Tailnets()
+
+	tailnets := make([]tailnet, 0)
+
+	if cfg := h.Config(); cfg != nil {
+		for name, t := range cfg.Tailnets {
+			// auth keys are never returned
+			tailnets = append(tailnets, tailnet{Name: name, ID: t.ID, State: states[name]})
+		}
+	}
+
+	sort.Slice(tailnets, func(i, j int) bool { return tailnets[i].Name < tailnets[j].Name })
+
+	writeJSON(w, http.StatusOK, tailnets)
+}
+
+// health reports the health of each upstream, see ready for OPA policies.
+func (a *api) health(w http.ResponseWriter, _ *http.Request) {
+	res := make(map[string]health)
+
+	for _, s := range a.opts.Handler().Upstreams() {
+		res[s.Name] = newHealth(s.Health)
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+// ready responds with 503 until the bundles of all OPA policies have been
+// activated, so that it can be used as a readiness probe. It's separate
+// from health, which is keyed by upstream name and always responds with
+// 200 so that it can be used as a liveness probe while bundles download.
+func (a *api) ready(w http.ResponseWriter, _ *http.Request) {
+	res := readiness{Ready: true, Policies: []policy{}}
+
+	for _, p := range a.opts.Handler().Policies() {
+		res.Policies = append(res.Policies, policy{Bundle: p.Bundle, Ready: p.Ready})
+		res.Ready = res.Ready && p.Ready
+	}
+
+	status := http.StatusOK
+	if !res.Ready {
+		status = http.StatusServiceUnavailable
+	}
+
+	writeJSON(w, status, res)
+}
+
+func (a *api) setState(state proxy.UpstreamState) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("name")
+		if name == "" {
+			writeError(w, http.StatusBadRequest, errors.New("name is required"))
+
+			return
+		}
+
+		err := a.opts.Handler().SetUpstreamState(name, state)
+		if err != nil {
+			writeError(w, statusForError(err), err)
+
+			return
+		}
+
+		writeJSON(w, http.StatusOK, map[string]string{"name": name, "state": state.String()})
+	}
+}
+
+func (a *api) reloadPolicies(w http.ResponseWriter, r *http.Request) {
+	err := a.opts.Handler().ReloadPolicies(r.Context())
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"status": "reloaded"})
+}
+
+func (a *api) flushCaches(w http.ResponseWriter, r *http.Request) {
+	err := a.opts.Handler().FlushCaches(r.URL.Query().Get("upstream"))
+	if err != nil {
+		writeError(w, statusForError(err), err)
+
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"status": "flushed"})
+}
+
+// upstreamName matches the name given to routes by NewHandlerFromConfig.
+func upstreamName(u proxy.ConfigUpstream) string {
+	if u.Name != "" {
+		return u.Name
+	}
+
+	return u.Endpoint
+}
+
+func newHealth(h proxy.Health) health {
+	res := health{
+		Healthy:             h.Healthy,
+		ConsecutiveFailures: h.ConsecutiveFailures,
+		LastError:           h.LastError,
+	}
+
+	if !h.LastSuccess.IsZero() {
+		res.LastSuccess = &h.LastSuccess
+	}
+
+	if !h.LastFailure.IsZero() {
+		res.LastFailure = &h.LastFailure
+	}
+
+	return res
+}
+
+func nonNil(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+
+	return s
+}
+
+func statusForError(err error) int {
+	if errors.Is(err, proxy.ErrUpstreamNotFound) {
+		return http.StatusNotFound
+	}
+
+	return http.StatusInternalServerError
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	//nolint:errcheck
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,249 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/charlieegan3/tool-tsnet-proxy/pkg/cache"
+	"github.com/charlieegan3/tool-tsnet-proxy/pkg/proxy"
+)
+
+func newProxy(t *testing.T, store cache.Store) *proxy.Handler {
+	t.Helper()
+
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(upstreamServer.Close)
+
+	h, err := proxy.NewHandler(&proxy.Options{
+		Routes: []proxy.Route{
+			{
+				Name: "internal",
+				Matcher: func(_ *http.Request) (*http.Client, string, bool) {
+					return upstreamServer.Client(), upstreamServer.URL, true
+				},
+				Caches: []cache.Store{store},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to create proxy handler: %v", err)
+	}
+
+	return h
+}
+
+func do(t *testing.T, h http.Handler, method, target string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(method, target, nil))
+
+	return rec
+}
+
+func TestUpstreamState(t *testing.T) {
+	t.Parallel()
+
+	p := newProxy(t, cache.NewMemoryStore(0))
+	a := NewHandler(Options{Handler: func() *proxy.Handler { return p }})
+
+	tests := []struct {
+		action string
+		status int
+	}{
+		{action: "drain", status: http.StatusServiceUnavailable},
+		{action: "disable", status: http.StatusNotFound},
+		{action: "enable", status: http.StatusOK},
+	}
+
+	for _, test := range tests {
+		if rec := do(t, a, http.MethodPost, "/upstreams/"+test.action+"?name=internal"); rec.Code != http.StatusOK {
+			t.Fatalf("failed to %s upstream: %d %s", test.action, rec.Code, rec.Body.String())
+		}
+
+		if exp, got := test.status, do(t, p, http.MethodGet, "/").Code; exp != got {
+			t.Fatalf("expected status %d after %s, got %d", exp, test.action, got)
+		}
+	}
+
+	if exp, got := http.StatusNotFound, do(t, a, http.MethodPost, "/upstreams/drain?name=missing").Code; exp != got {
+		t.Fatalf("expected status %d for unknown upstream, got %d", exp, got)
+	}
+}
+
+func TestUpstreams(t *testing.T) {
+	t.Parallel()
+
+	p := newProxy(t, cache.NewMemoryStore(0))
+	a := NewHandler(Options{Handler: func() *proxy.Handler { return p }})
+
+	do(t, p, http.MethodGet, "/")
+
+	var upstreams []upstream
+
+	err := json.NewDecoder(do(t, a, http.MethodGet, "/upstreams").Body).Decode(&upstreams)
+	if err != nil {
+		t.Fatalf("failed to decode upstreams: %v", err)
+	}
+
+	if exp, got := 1, len(upstreams); exp != got {
+		t.Fatalf("expected %d upstreams, got %d", exp, got)
+	}
+
+	u := upstreams[0]
+
+	if u.Name != "internal" || u.State != "active" || !u.Health.Healthy || u.Health.LastSuccess == nil {
+		t.Fatalf("unexpected upstream: %+v", u)
+	}
+}
+
+func TestFlushCaches(t *testing.T) {
+	t.Parallel()
+
+	store := cache.NewMemoryStore(0)
+
+	err := store.Set("key", &cache.Entry{StatusCode: http.StatusOK})
+	if err != nil {
+		t.Fatalf("failed to set entry: %v", err)
+	}
+
+	p := newProxy(t, store)
+	a := NewHandler(Options{Handler: func() *proxy.Handler { return p }})
+
+	if exp, got := http.StatusNotFound, do(t, a, http.MethodPost, "/caches/flush?upstream=missing").Code; exp != got {
+		t.Fatalf("expected status %d for unknown upstream, got %d", exp, got)
+	}
+
+	if exp, got := http.StatusOK, do(t, a, http.MethodPost, "/caches/flush?upstream=internal").Code; exp != got {
+		t.Fatalf("expected status %d, got %d", exp, got)
+	}
+
+	if _, ok := store.Get("key"); ok {
+		t.Fatal("expected cache to be flushed")
+	}
+}
+
+func TestLoopback(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]bool{
+		"localhost:9090":   true,
+		"127.0.0.1:9090":   true,
+		"[::1]:9090":       true,
+		"0.0.0.0:9090":     false,
+		":9090":            false,
+		"example.com:9090": false,
+	}
+
+	for addr, exp := range tests {
+		if got := loopback(addr); exp != got {
+			t.Errorf("expected loopback(%q) to be %t", addr, exp)
+		}
+	}
+}
+
+func TestReady(t *testing.T) {
+	t.Parallel()
+
+	cfg, err := proxy.LoadConfig(strings.NewReader(`
+middlewares:
+  - kind: opa
+    properties:
+      bundle:
+        rego: |
+          package authz
+
+          allow = true
+upstreams:
+  - endpoint: "http://localhost"
+`))
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	p, _, err := proxy.NewHandlerFromConfig(ctx, cfg, nil)
+	if err != nil {
+		t.Fatalf("failed to create proxy handler: %v", err)
+	}
+	defer p.Close()
+
+	a := NewHandler(Options{Handler: func() *proxy.Handler { return p }})
+
+	rec := do(t, a, http.MethodGet, "/ready")
+
+	if exp, got := http.StatusOK, rec.Code; exp != got {
+		t.Fatalf("expected status %d, got %d", exp, got)
+	}
+
+	var res readiness
+
+	err = json.NewDecoder(rec.Body).Decode(&res)
+	if err != nil {
+		t.Fatalf("failed to decode readiness: %v", err)
+	}
+
+	if exp, got := (readiness{Ready: true, Policies: []policy{{Bundle: "inline", Ready: true}}}), res; !reflect.DeepEqual(exp, got) {
+		t.Fatalf("readiness did not match expected: %+v != %+v", exp, got)
+	}
+}
+
+func TestMetricsOnly(t *testing.T) {
+	t.Parallel()
+
+	p := newProxy(t, cache.NewMemoryStore(0))
+	a := NewHandler(Options{
+		Handler: func() *proxy.Handler { return p },
+		Metrics: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			_, _ = w.Write([]byte("metrics"))
+		}),
+		MetricsOnly: true,
+	})
+
+	if exp, got := http.StatusOK, do(t, a, http.MethodGet, "/metrics").Code; exp != got {
+		t.Fatalf("expected status %d for metrics, got %d", exp, got)
+	}
+
+	for _, target := range []string{"/upstreams", "/upstreams/drain?name=internal"} {
+		if exp, got := http.StatusNotFound, do(t, a, http.MethodGet, target).Code; exp != got {
+			t.Errorf("%s: expected status %d, got %d", target, exp, got)
+		}
+	}
+
+	tests := map[proxy.ConfigAdmin]bool{
+		{Addr: "0.0.0.0:9090"}:                 true,
+		{Addr: "127.0.0.1:9090"}:               false,
+		{Addr: ":9090", Tailnet: "tsnet"}:      false,
+		{Addr: ":9090", Socket: "/admin.sock"}: false,
+		{}:                                     false,
+	}
+
+	for cfg, exp := range tests {
+		if got := MetricsOnly(cfg); exp != got {
+			t.Errorf("expected MetricsOnly(%+v) to be %t", cfg, exp)
+		}
+	}
+}
+
+func TestRelisten(t *testing.T) {
+	t.Parallel()
+
+	prev := newProxy(t, cache.NewMemoryStore(0))
+	h := newProxy(t, cache.NewMemoryStore(0))
+
+	// listeners which aren't on a tailnet are kept across reloads
+	l, err := Relisten(proxy.ConfigAdmin{Addr: "127.0.0.1:0"}, prev, h)
+	if err != nil || l != nil {
+		t.Fatalf("expected no new listener, got %v, %v", l, err)
+	}
+}
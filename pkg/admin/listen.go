@@ -0,0 +1,87 @@
+package admin
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/charlieegan3/tool-tsnet-proxy/pkg/proxy"
+)
+
+// Listen opens the admin listener described by the config, it returns nil
+// if the admin listener isn't configured. TCP listeners on addresses other
+// than loopback ones only serve metrics, see MetricsOnly.
+func Listen(cfg proxy.ConfigAdmin, h *proxy.Handler) (net.Listener, error) {
+	switch {
+	case cfg.Tailnet != "":
+		if cfg.Addr == "" {
+			return nil, errors.New("addr is required to listen on a tailnet")
+		}
+
+		//nolint:wrapcheck
+		return h.ListenTailnet(cfg.Tailnet, "tcp", cfg.Addr)
+	case cfg.Socket != "":
+		// remove the socket left behind by a previous run
+		err := os.Remove(cfg.Socket)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("failed to remove admin socket: %w", err)
+		}
+
+		l, err := net.Listen("unix", cfg.Socket)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen on admin socket: %w", err)
+		}
+
+		err = os.Chmod(cfg.Socket, 0o600)
+		if err != nil {
+			l.Close()
+
+			return nil, fmt.Errorf("failed to set admin socket permissions: %w", err)
+		}
+
+		return l, nil
+	case cfg.Addr != "":
+		l, err := net.Listen("tcp", cfg.Addr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen on admin addr: %w", err)
+		}
+
+		return l, nil
+	}
+
+	return nil, nil
+}
+
+// MetricsOnly returns true if the listener is a TCP address which isn't a
+// loopback address, where only metrics are served so that they can be
+// scraped without exposing the admin API.
+func MetricsOnly(cfg proxy.ConfigAdmin) bool {
+	return cfg.Tailnet == "" && cfg.Socket == "" && cfg.Addr != "" && !loopback(cfg.Addr)
+}
+
+// Relisten returns a new listener if the admin listener is on a tailnet
+// which h replaced, listeners on prev's tailnet are closed with prev. It
+// returns nil if the listener is unaffected.
+func Relisten(cfg proxy.ConfigAdmin, prev, h *proxy.Handler) (net.Listener, error) {
+	if cfg.Tailnet == "" || !h.TailnetReplaced(prev, cfg.Tailnet) {
+		return nil, nil
+	}
+
+	return Listen(cfg, h)
+}
+
+func loopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+
+	return ip != nil && ip.IsLoopback()
+}
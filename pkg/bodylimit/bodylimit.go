@@ -0,0 +1,202 @@
+package bodylimit
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/charlieegan3/tool-tsnet-proxy/pkg/requestid"
+)
+
+var (
+	ErrTooLarge = errors.New("request body too large")
+	ErrTooSlow  = errors.New("request body sent too slowly")
+)
+
+const defaultGracePeriod = 5 * time.Second
+
+type Options struct {
+	// MaxBytes is the largest request body allowed, zero means no limit.
+	MaxBytes int64
+
+	// MinRate is the lowest average rate, in bytes per second, that the
+	// body must be sent at once GracePeriod has passed. Zero disables the
+	// check.
+	MinRate     int64
+	GracePeriod time.Duration
+}
+
+// NewMiddleware returns a middleware which stops reading request bodies that
+// are too large or sent too slowly. Requests are answered with 413 Content
+// Too Large or 408 Request Timeout, replacing any error response written by
+// the next handler as a result of the failed read.
+func NewMiddleware(opts Options) func(http.Handler) http.Handler {
+	if opts.GracePeriod == 0 {
+		opts.GracePeriod = defaultGracePeriod
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if opts.MaxBytes > 0 && r.ContentLength > opts.MaxBytes {
+				requestid.Error(w, r, ErrTooLarge.Error(), http.StatusRequestEntityTooLarge)
+
+				return
+			}
+
+			if r.Body == nil || r.Body == http.NoBody {
+				next.ServeHTTP(w, r)
+
+				return
+			}
+
+			br := &reader{
+				body:  r.Body,
+				opts:  opts,
+				start: time.Now(),
+				rc:    http.NewResponseController(w),
+			}
+
+			r.Body = br
+
+			next.ServeHTTP(&writer{ResponseWriter: w, reader: br, req: r}, r)
+		})
+	}
+}
+
+type reader struct {
+	body  io.ReadCloser
+	opts  Options
+	start time.Time
+	rc    *http.ResponseController
+
+	mu    sync.Mutex
+	count int64
+	err   error
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	count, err := r.count, r.err
+	r.mu.Unlock()
+
+	if err != nil {
+		return 0, err
+	}
+
+	if r.opts.MinRate > 0 {
+		// the client must keep up the minimum rate to send the next byte,
+		// this catches clients which stop sending entirely
+		allowed := r.opts.GracePeriod + time.Duration(float64(count+1)/float64(r.opts.MinRate)*float64(time.Second))
+
+		//nolint:errcheck
+		r.rc.SetReadDeadline(r.start.Add(allowed))
+	}
+
+	n, err := r.body.Read(p)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.count += int64(n)
+
+	if r.opts.MaxBytes > 0 && r.count > r.opts.MaxBytes {
+		r.err = ErrTooLarge
+
+		return 0, r.err
+	}
+
+	if r.opts.MinRate > 0 && !errors.Is(err, io.EOF) && r.tooSlow() {
+		r.err = ErrTooSlow
+
+		return n, r.err
+	}
+
+	if errors.Is(err, io.EOF) && r.opts.MinRate > 0 {
+		//nolint:errcheck
+		r.rc.SetReadDeadline(time.Time{})
+	}
+
+	return n, err
+}
+
+func (r *reader) tooSlow() bool {
+	elapsed := time.Since(r.start)
+	if elapsed <= r.opts.GracePeriod {
+		return false
+	}
+
+	return float64(r.count)/elapsed.Seconds() < float64(r.opts.MinRate)
+}
+
+func (r *reader) Close() error {
+	return r.body.Close()
+}
+
+func (r *reader) failure() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.err
+}
+
+// writer replaces the response with the appropriate status when the body
+// could not be read.
+type writer struct {
+	http.ResponseWriter
+
+	reader      *reader
+	req         *http.Request
+	wroteHeader bool
+	replaced    bool
+}
+
+func (w *writer) WriteHeader(statusCode int) {
+	if w.wroteHeader {
+		return
+	}
+
+	w.wroteHeader = true
+
+	var status int
+
+	switch {
+	case errors.Is(w.reader.failure(), ErrTooLarge):
+		status = http.StatusRequestEntityTooLarge
+	case errors.Is(w.reader.failure(), ErrTooSlow):
+		status = http.StatusRequestTimeout
+
+		w.Header().Set("Connection", "close")
+	default:
+		w.ResponseWriter.WriteHeader(statusCode)
+
+		return
+	}
+
+	w.replaced = true
+
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.ResponseWriter.WriteHeader(status)
+
+	//nolint:errcheck
+	w.ResponseWriter.Write([]byte(requestid.Annotate(w.req.Context(), w.reader.failure().Error()) + "\n"))
+}
+
+func (w *writer) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if w.replaced {
+		return len(b), nil
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *writer) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,95 @@
+package bodylimit
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readingHandler reads the body like the proxy does, responding with 502 if
+// that fails
+var readingHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	bs, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+
+		return
+	}
+
+	_, _ = w.Write(bs)
+})
+
+func TestMaxBytes(t *testing.T) {
+	t.Parallel()
+
+	h := NewMiddleware(Options{MaxBytes: 5})(readingHandler)
+
+	tests := map[string]struct {
+		body          string
+		contentLength int64
+		status        int
+	}{
+		"within limit":           {body: "12345", contentLength: 5, status: http.StatusOK},
+		"content length":         {body: "123456", contentLength: 6, status: http.StatusRequestEntityTooLarge},
+		"unknown content length": {body: "123456", contentLength: -1, status: http.StatusRequestEntityTooLarge},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(test.body))
+			req.ContentLength = test.contentLength
+
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if exp, got := test.status, rec.Code; exp != got {
+				t.Fatalf("expected status %d, got %d: %s", exp, got, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestMinRate(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(NewMiddleware(Options{
+		MinRate:     1000,
+		GracePeriod: 50 * time.Millisecond,
+	})(readingHandler))
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+
+	// send the headers and a little of the body, then stall
+	_, err = fmt.Fprintf(conn, "POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 100\r\n\r\nab")
+	if err != nil {
+		t.Fatalf("failed to write request: %v", err)
+	}
+
+	err = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if err != nil {
+		t.Fatalf("failed to set deadline: %v", err)
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if exp, got := http.StatusRequestTimeout, resp.StatusCode; exp != got {
+		t.Fatalf("expected status %d, got %d", exp, got)
+	}
+}
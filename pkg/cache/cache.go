@@ -0,0 +1,446 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charlieegan3/tool-tsnet-proxy/pkg/identity"
+	"github.com/charlieegan3/tool-tsnet-proxy/pkg/opa"
+	"github.com/charlieegan3/tool-tsnet-proxy/pkg/whois"
+)
+
+const statusHeader = "X-Cache"
+
+type Options struct {
+	Store Store
+
+	// MaxEntrySize is the largest response body which will be stored,
+	// larger responses are passed through. Zero means no limit.
+	MaxEntrySize int64
+
+	// Now returns the current time, it defaults to time.Now.
+	Now func() time.Time
+}
+
+// NewMiddleware returns a middleware implementing a shared HTTP cache as
+// described in RFC 9111. Stale responses are served while revalidating or
+// when the upstream fails if the response allows it with
+// stale-while-revalidate or stale-if-error. Responses to requests from
+// tailnet or signed in users are stored separately for each user, as
+// upstreams may tailor them to the identity headers. The same goes for
+// headers set by OPA decisions. Unsafe requests only invalidate the
+// requesting identity's stored response.
+func NewMiddleware(opts Options) func(http.Handler) http.Handler {
+	if opts.Now == nil {
+		opts.Now = time.Now
+	}
+
+	if opts.Store == nil {
+		opts.Store = NewMemoryStore(0)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return &cache{
+			opts: opts,
+			next: next,
+		}
+	}
+}
+
+type cache struct {
+	opts Options
+	next http.Handler
+
+	revalidating sync.Map
+}
+
+func (c *cache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := cacheKey(r)
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		rw := &statusWriter{ResponseWriter: w}
+		c.next.ServeHTTP(rw, r)
+
+		// unsafe methods invalidate the stored response, see RFC 9111
+		// section 4.4
+		if !isSafe(r.Method) && rw.statusCode < http.StatusBadRequest {
+			//nolint:errcheck
+			c.opts.Store.Delete(key)
+		}
+
+		return
+	}
+
+	entry, ok := c.opts.Store.Get(key)
+	if !ok || !entry.matchesVary(r) {
+		c.fetch(w, r, key)
+
+		return
+	}
+
+	now := c.opts.Now()
+	age := entry.age(now)
+	lifetime := entry.freshnessLifetime()
+
+	reqCC := parseDirectives(r.Header)
+	respCC := parseDirectives(entry.Header)
+
+	noCache := reqCC.has("no-cache") || respCC.has("no-cache")
+	fresh := age < lifetime
+
+	if maxAge, ok := reqCC.seconds("max-age"); ok && age > maxAge {
+		fresh = false
+	}
+
+	if fresh && !noCache {
+		c.serve(w, r, entry, age, "HIT")
+
+		return
+	}
+
+	staleness := age - lifetime
+	mayServeStale := !noCache && !respCC.has("must-revalidate") && !respCC.has("proxy-revalidate")
+
+	if swr, ok := respCC.seconds("stale-while-revalidate"); ok && mayServeStale && staleness <= swr {
+		c.serve(w, r, entry, age, "STALE")
+
+		if _, running := c.revalidating.LoadOrStore(key, true); !running {
+			bgReq := r.Clone(context.WithoutCancel(r.Context()))
+
+			go func() {
+				defer c.revalidating.Delete(key)
+
+				c.revalidate(&discardWriter{header: make(http.Header)}, bgReq, key, entry, nil)
+			}()
+		}
+
+		return
+	}
+
+	// a failed revalidation isn't sent to the client if a stale response
+	// can be served instead
+	staleIfError := false
+
+	if mayServeStale {
+		sie, ok := respCC.seconds("stale-if-error")
+		if reqSIE, reqOK := reqCC.seconds("stale-if-error"); reqOK {
+			sie, ok = reqSIE, true
+		}
+
+		staleIfError = ok && staleness <= sie
+	}
+
+	statusCode, updated := c.revalidate(w, r, key, entry, func(statusCode int) bool {
+		return staleIfError && statusCode >= http.StatusInternalServerError
+	})
+	if updated != nil {
+		c.serve(w, r, updated, updated.age(c.opts.Now()), "REVALIDATED")
+
+		return
+	}
+
+	if staleIfError && statusCode >= http.StatusInternalServerError {
+		c.serve(w, r, entry, age, "STALE")
+	}
+}
+
+// fetch forwards a request which can't be answered from the cache, storing
+// the response if it's allowed.
+func (c *cache) fetch(w http.ResponseWriter, r *http.Request, key string) {
+	tw := &teeWriter{
+		ResponseWriter: w,
+		limit:          c.opts.MaxEntrySize,
+		requestTime:    c.opts.Now(),
+		now:            c.opts.Now,
+	}
+
+	c.next.ServeHTTP(tw, r)
+
+	if tw.header == nil {
+		tw.WriteHeader(http.StatusOK)
+	}
+
+	if tw.overflow || !storable(r, tw.statusCode, tw.header) {
+		return
+	}
+
+	//nolint:errcheck
+	c.opts.Store.Set(key, &Entry{
+		StatusCode:   tw.statusCode,
+		Header:       tw.header,
+		Body:         tw.body.Bytes(),
+		RequestTime:  tw.requestTime,
+		ResponseTime: tw.responseTime,
+		VaryValues:   varyValues(r, tw.header),
+	})
+}
+
+// revalidate makes a conditional request for a stored entry. If the
+// upstream confirms the entry is still valid, the updated entry is
+// returned. Otherwise the response is written to w, unless skip returns
+// true for its status, and stored if allowed.
+func (c *cache) revalidate(
+	w http.ResponseWriter,
+	r *http.Request,
+	key string,
+	entry *Entry,
+	skip func(statusCode int) bool,
+) (int, *Entry) {
+	req := r.Clone(r.Context())
+	req.Method = http.MethodGet
+	req.Header.Del("If-Modified-Since")
+	req.Header.Del("If-None-Match")
+
+	if etag := entry.Header.Get("ETag"); etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+
+	if lastModified := entry.Header.Get("Last-Modified"); lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+
+	tw := &teeWriter{
+		ResponseWriter: w,
+		limit:          c.opts.MaxEntrySize,
+		requestTime:    c.opts.Now(),
+		now:            c.opts.Now,
+		skip: func(statusCode int) bool {
+			return statusCode == http.StatusNotModified || (skip != nil && skip(statusCode))
+		},
+	}
+
+	c.next.ServeHTTP(tw, req)
+
+	if tw.header == nil {
+		tw.WriteHeader(http.StatusOK)
+	}
+
+	if tw.statusCode == http.StatusNotModified {
+		header := entry.Header.Clone()
+		for k, v := range tw.header {
+			header[k] = v
+		}
+
+		updated := &Entry{
+			StatusCode:   entry.StatusCode,
+			Header:       header,
+			Body:         entry.Body,
+			RequestTime:  tw.requestTime,
+			ResponseTime: tw.responseTime,
+			VaryValues:   entry.VaryValues,
+		}
+
+		//nolint:errcheck
+		c.opts.Store.Set(key, updated)
+
+		return tw.statusCode, updated
+	}
+
+	if tw.statusCode >= http.StatusInternalServerError {
+		return tw.statusCode, nil
+	}
+
+	if !tw.overflow && storable(req, tw.statusCode, tw.header) {
+		//nolint:errcheck
+		c.opts.Store.Set(key, &Entry{
+			StatusCode:   tw.statusCode,
+			Header:       tw.header,
+			Body:         tw.body.Bytes(),
+			RequestTime:  tw.requestTime,
+			ResponseTime: tw.responseTime,
+			VaryValues:   varyValues(req, tw.header),
+		})
+	} else {
+		//nolint:errcheck
+		c.opts.Store.Delete(key)
+	}
+
+	return tw.statusCode, nil
+}
+
+func (c *cache) serve(w http.ResponseWriter, r *http.Request, entry *Entry, age time.Duration, status string) {
+	// headers already set are for this request, such as X-Request-ID
+	for k, v := range entry.Header {
+		if _, ok := w.Header()[k]; !ok {
+			w.Header()[k] = v
+		}
+	}
+
+	w.Header().Set("Age", strconv.FormatInt(int64(age/time.Second), 10))
+	w.Header().Set(statusHeader, status)
+
+	if etag := entry.Header.Get("ETag"); etag != "" && etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+
+		return
+	}
+
+	w.WriteHeader(entry.StatusCode)
+
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	//nolint:errcheck
+	w.Write(entry.Body)
+}
+
+func cacheKey(r *http.Request) string {
+	key := r.Host + r.URL.RequestURI()
+
+	if id := whois.FromContext(r.Context()); id != nil {
+		key += "\x00" + id.Key()
+	}
+
+	if claims := identity.FromContext(r.Context()); claims != nil {
+		key += "\x00" + claims.Key()
+	}
+
+	if h := opa.UpstreamHeadersKey(r.Context()); h != "" {
+		key += "\x00" + h
+	}
+
+	return key
+}
+
+func isSafe(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+
+	return false
+}
+
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+
+	weak := func(s string) string { return strings.TrimPrefix(strings.TrimSpace(s), "W/") }
+
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		if strings.TrimSpace(candidate) == "*" || weak(candidate) == weak(etag) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// statusWriter records the status code written to a ResponseWriter.
+type statusWriter struct {
+	http.ResponseWriter
+
+	statusCode int
+}
+
+func (w *statusWriter) WriteHeader(statusCode int) {
+	if w.statusCode == 0 {
+		w.statusCode = statusCode
+	}
+
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.statusCode == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+// teeWriter writes a response to the client while keeping a copy of it, up
+// to limit bytes, so that it can be stored. The upstream writes to its own
+// headers so that headers set for the client by other middlewares aren't
+// stored. Responses with a status skip returns true for aren't written.
+type teeWriter struct {
+	http.ResponseWriter
+
+	limit       int64
+	now         func() time.Time
+	requestTime time.Time
+	skip        func(statusCode int) bool
+
+	upstreamHeader http.Header
+	statusCode     int
+	header         http.Header
+	responseTime   time.Time
+	body           bytes.Buffer
+	overflow       bool
+	skipped        bool
+}
+
+func (w *teeWriter) Header() http.Header {
+	if w.upstreamHeader == nil {
+		w.upstreamHeader = make(http.Header)
+	}
+
+	return w.upstreamHeader
+}
+
+func (w *teeWriter) WriteHeader(statusCode int) {
+	if w.header != nil {
+		return
+	}
+
+	w.statusCode = statusCode
+	w.header = w.Header().Clone()
+	w.responseTime = w.now()
+
+	if w.skip != nil && w.skip(statusCode) {
+		w.skipped = true
+
+		return
+	}
+
+	for k, v := range w.header {
+		w.ResponseWriter.Header()[k] = v
+	}
+
+	w.ResponseWriter.Header().Set(statusHeader, "MISS")
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *teeWriter) Write(b []byte) (int, error) {
+	if w.header == nil {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if !w.overflow {
+		if w.limit > 0 && int64(w.body.Len()+len(b)) > w.limit {
+			w.overflow = true
+			w.body = bytes.Buffer{}
+		} else {
+			w.body.Write(b)
+		}
+	}
+
+	if w.skipped {
+		return len(b), nil
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+// discardWriter is written to by background revalidations, which have no
+// client.
+type discardWriter struct {
+	header http.Header
+}
+
+func (w *discardWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardWriter) WriteHeader(int) {}
+
+func (w *discardWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
@@ -0,0 +1,510 @@
+package cache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/charlieegan3/tool-tsnet-proxy/pkg/identity"
+	"github.com/charlieegan3/tool-tsnet-proxy/pkg/opa"
+	"github.com/charlieegan3/tool-tsnet-proxy/pkg/whois"
+)
+
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+}
+
+func newTestCache(t *testing.T, upstream http.HandlerFunc) (http.Handler, *testClock) {
+	t.Helper()
+
+	clock := &testClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+
+	return NewMiddleware(Options{
+		Store: NewMemoryStore(0),
+		Now:   clock.Now,
+	})(upstream), clock
+}
+
+func doRequest(t *testing.T, h http.Handler, method, path string, header http.Header) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := httptest.NewRequest(method, "http://example.com"+path, nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	return rec
+}
+
+func TestCacheFreshResponse(t *testing.T) {
+	t.Parallel()
+
+	var calls atomic.Int32
+
+	h, clock := newTestCache(t, func(w http.ResponseWriter, _ *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		_, _ = w.Write([]byte("hello"))
+	})
+
+	for _, exp := range []string{"MISS", "HIT"} {
+		rec := doRequest(t, h, http.MethodGet, "/", nil)
+
+		if got := rec.Header().Get(statusHeader); got != exp {
+			t.Fatalf("expected %s, got %s", exp, got)
+		}
+
+		if got := rec.Body.String(); got != "hello" {
+			t.Fatalf("unexpected body %q", got)
+		}
+	}
+
+	clock.Advance(61 * time.Second)
+
+	rec := doRequest(t, h, http.MethodGet, "/", nil)
+	if got := rec.Header().Get(statusHeader); got != "MISS" {
+		t.Fatalf("expected stale entry to be fetched again, got %s", got)
+	}
+
+	if exp, got := int32(2), calls.Load(); exp != got {
+		t.Fatalf("expected %d upstream calls, got %d", exp, got)
+	}
+}
+
+func TestCacheRevalidation(t *testing.T) {
+	t.Parallel()
+
+	var calls atomic.Int32
+
+	h, clock := newTestCache(t, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Cache-Control", "max-age=10")
+		w.Header().Set("ETag", `"v1"`)
+
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+
+			return
+		}
+
+		_, _ = w.Write([]byte("body"))
+	})
+
+	doRequest(t, h, http.MethodGet, "/", nil)
+	clock.Advance(11 * time.Second)
+
+	rec := doRequest(t, h, http.MethodGet, "/", nil)
+
+	if got := rec.Header().Get(statusHeader); got != "REVALIDATED" {
+		t.Fatalf("expected REVALIDATED, got %s", got)
+	}
+
+	if exp, got := http.StatusOK, rec.Code; exp != got {
+		t.Fatalf("expected status %d, got %d", exp, got)
+	}
+
+	if got := rec.Body.String(); got != "body" {
+		t.Fatalf("unexpected body %q", got)
+	}
+
+	rec = doRequest(t, h, http.MethodGet, "/", http.Header{"If-None-Match": {`"v1"`}})
+	if exp, got := http.StatusNotModified, rec.Code; exp != got {
+		t.Fatalf("expected status %d, got %d", exp, got)
+	}
+
+	if exp, got := int32(2), calls.Load(); exp != got {
+		t.Fatalf("expected %d upstream calls, got %d", exp, got)
+	}
+}
+
+func TestCacheStaleIfError(t *testing.T) {
+	t.Parallel()
+
+	var failing atomic.Bool
+
+	h, clock := newTestCache(t, func(w http.ResponseWriter, _ *http.Request) {
+		if failing.Load() {
+			http.Error(w, "offline", http.StatusBadGateway)
+
+			return
+		}
+
+		w.Header().Set("Cache-Control", "max-age=10, stale-if-error=60")
+		_, _ = w.Write([]byte("cached"))
+	})
+
+	doRequest(t, h, http.MethodGet, "/", nil)
+	failing.Store(true)
+	clock.Advance(30 * time.Second)
+
+	rec := doRequest(t, h, http.MethodGet, "/", nil)
+	if exp, got := http.StatusOK, rec.Code; exp != got {
+		t.Fatalf("expected status %d, got %d", exp, got)
+	}
+
+	if got := rec.Body.String(); got != "cached" {
+		t.Fatalf("unexpected body %q", got)
+	}
+
+	clock.Advance(60 * time.Second)
+
+	rec = doRequest(t, h, http.MethodGet, "/", nil)
+	if exp, got := http.StatusBadGateway, rec.Code; exp != got {
+		t.Fatalf("expected status %d, got %d", exp, got)
+	}
+}
+
+func TestCacheStaleWhileRevalidate(t *testing.T) {
+	t.Parallel()
+
+	var version atomic.Int32
+
+	revalidated := make(chan struct{}, 1)
+
+	h, clock := newTestCache(t, func(w http.ResponseWriter, _ *http.Request) {
+		v := version.Add(1)
+		w.Header().Set("Cache-Control", "max-age=10, stale-while-revalidate=30")
+		_, _ = w.Write([]byte{byte('0' + v)})
+
+		if v > 1 {
+			select {
+			case revalidated <- struct{}{}:
+			default:
+			}
+		}
+	})
+
+	doRequest(t, h, http.MethodGet, "/", nil)
+	clock.Advance(20 * time.Second)
+
+	rec := doRequest(t, h, http.MethodGet, "/", nil)
+	if got := rec.Header().Get(statusHeader); got != "STALE" {
+		t.Fatalf("expected STALE, got %s", got)
+	}
+
+	if got := rec.Body.String(); got != "1" {
+		t.Fatalf("expected stale body, got %q", got)
+	}
+
+	select {
+	case <-revalidated:
+	case <-time.After(time.Second):
+		t.Fatal("background revalidation did not happen")
+	}
+
+	// the revalidated response is stored after the upstream returns
+	deadline := time.Now().Add(time.Second)
+	for {
+		rec = doRequest(t, h, http.MethodGet, "/", nil)
+		if rec.Body.String() == "2" {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("expected revalidated body, got %q", rec.Body.String())
+		}
+
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestCacheNotStored(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		cacheControl string
+		reqHeader    http.Header
+	}{
+		"no-store":                 {cacheControl: "no-store, max-age=60"},
+		"private":                  {cacheControl: "private, max-age=60"},
+		"authorization":            {cacheControl: "max-age=60", reqHeader: http.Header{"Authorization": {"Bearer x"}}},
+		"request no-store":         {cacheControl: "max-age=60", reqHeader: http.Header{"Cache-Control": {"no-store"}}},
+		"not heuristically stored": {cacheControl: ""},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			var calls atomic.Int32
+
+			h, _ := newTestCache(t, func(w http.ResponseWriter, _ *http.Request) {
+				calls.Add(1)
+
+				if test.cacheControl != "" {
+					w.Header().Set("Cache-Control", test.cacheControl)
+				}
+
+				w.WriteHeader(http.StatusAccepted)
+			})
+
+			doRequest(t, h, http.MethodGet, "/", test.reqHeader)
+			doRequest(t, h, http.MethodGet, "/", test.reqHeader)
+
+			if exp, got := int32(2), calls.Load(); exp != got {
+				t.Fatalf("expected %d upstream calls, got %d", exp, got)
+			}
+		})
+	}
+}
+
+func TestCacheVaryAndInvalidation(t *testing.T) {
+	t.Parallel()
+
+	var calls atomic.Int32
+
+	h, _ := newTestCache(t, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept-Language")
+		_, _ = w.Write([]byte(r.Header.Get("Accept-Language")))
+	})
+
+	en := http.Header{"Accept-Language": {"en"}}
+	fr := http.Header{"Accept-Language": {"fr"}}
+
+	doRequest(t, h, http.MethodGet, "/", en)
+
+	rec := doRequest(t, h, http.MethodGet, "/", fr)
+	if got := rec.Body.String(); got != "fr" {
+		t.Fatalf("expected vary to select new response, got %q", got)
+	}
+
+	rec = doRequest(t, h, http.MethodGet, "/", fr)
+	if got := rec.Header().Get(statusHeader); got != "HIT" {
+		t.Fatalf("expected HIT, got %s", got)
+	}
+
+	doRequest(t, h, http.MethodPost, "/", nil)
+
+	rec = doRequest(t, h, http.MethodGet, "/", fr)
+	if got := rec.Header().Get(statusHeader); got != "MISS" {
+		t.Fatalf("expected POST to invalidate entry, got %s", got)
+	}
+
+	if exp, got := int32(4), calls.Load(); exp != got {
+		t.Fatalf("expected %d upstream calls, got %d", exp, got)
+	}
+}
+
+func TestCachePerRequestHeaders(t *testing.T) {
+	t.Parallel()
+
+	cache, _ := newTestCache(t, func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		_, _ = w.Write([]byte("hello"))
+	})
+
+	// headers set for each request before the cache, as requestid does
+	var id atomic.Int32
+
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Request-Id", strconv.Itoa(int(id.Add(1))))
+		cache.ServeHTTP(w, r)
+	})
+
+	for _, exp := range []string{"1", "2"} {
+		rec := doRequest(t, h, http.MethodGet, "/", nil)
+
+		if got := rec.Header().Get("X-Request-Id"); exp != got {
+			t.Fatalf("expected request ID %s, got %s", exp, got)
+		}
+
+		if exp, got := "max-age=60", rec.Header().Get("Cache-Control"); exp != got {
+			t.Fatalf("expected upstream headers to be sent, got %q", got)
+		}
+	}
+}
+
+func TestCacheRevalidationTooLarge(t *testing.T) {
+	t.Parallel()
+
+	var calls atomic.Int32
+
+	h := NewMiddleware(Options{
+		Store:        NewMemoryStore(0),
+		MaxEntrySize: 5,
+	})(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("ETag", `"v`+strconv.Itoa(int(calls.Add(1)))+`"`)
+
+		if calls.Load() == 1 {
+			_, _ = w.Write([]byte("hello"))
+
+			return
+		}
+
+		_, _ = w.Write([]byte("hello, "))
+		_, _ = w.Write([]byte("world"))
+	}))
+
+	doRequest(t, h, http.MethodGet, "/", nil)
+
+	// the larger response is streamed to the client rather than stored
+	for _, exp := range []string{"hello, world", "hello, world"} {
+		rec := doRequest(t, h, http.MethodGet, "/", nil)
+
+		if got := rec.Body.String(); exp != got {
+			t.Fatalf("expected body %q, got %q", exp, got)
+		}
+
+		if exp, got := "MISS", rec.Header().Get(statusHeader); exp != got {
+			t.Fatalf("expected %s, got %s", exp, got)
+		}
+	}
+
+	if exp, got := int32(3), calls.Load(); exp != got {
+		t.Fatalf("expected %d upstream calls, got %d", exp, got)
+	}
+}
+
+func TestCacheTailnetIdentities(t *testing.T) {
+	t.Parallel()
+
+	var calls atomic.Int32
+
+	h, _ := newTestCache(t, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		_, _ = w.Write([]byte(whois.FromContext(r.Context()).LoginName))
+	})
+
+	requests := []struct {
+		login     string
+		expStatus string
+	}{
+		{"alice@example.com", "MISS"},
+		{"bob@example.com", "MISS"},
+		{"alice@example.com", "HIT"},
+	}
+
+	for i, request := range requests {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req = req.WithContext(whois.NewContext(req.Context(), &whois.Identity{LoginName: request.login}))
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		if exp, got := request.login, rec.Body.String(); exp != got {
+			t.Errorf("request %d: expected body %q, got %q", i, exp, got)
+		}
+
+		if exp, got := request.expStatus, rec.Header().Get(statusHeader); exp != got {
+			t.Errorf("request %d: expected %s, got %s", i, exp, got)
+		}
+	}
+
+	if exp, got := int32(2), calls.Load(); exp != got {
+		t.Fatalf("expected %d upstream calls, got %d", exp, got)
+	}
+}
+
+func TestCacheOIDCIdentities(t *testing.T) {
+	t.Parallel()
+
+	var calls atomic.Int32
+
+	// the upstream personalises responses from the identity headers
+	h, _ := newTestCache(t, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		_, _ = w.Write([]byte(identity.FromContext(r.Context())["email"].(string)))
+	})
+
+	requests := []struct {
+		email     string
+		expStatus string
+	}{
+		{"alice@example.com", "MISS"},
+		{"bob@example.com", "MISS"},
+		{"bob@example.com", "HIT"},
+		{"alice@example.com", "HIT"},
+	}
+
+	for i, request := range requests {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req = req.WithContext(identity.NewContext(req.Context(), identity.Claims{"email": request.email}))
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		if exp, got := request.email, rec.Body.String(); exp != got {
+			t.Errorf("request %d: expected body %q, got %q", i, exp, got)
+		}
+
+		if exp, got := request.expStatus, rec.Header().Get(statusHeader); exp != got {
+			t.Errorf("request %d: expected %s, got %s", i, exp, got)
+		}
+	}
+
+	if exp, got := int32(2), calls.Load(); exp != got {
+		t.Fatalf("expected %d upstream calls, got %d", exp, got)
+	}
+}
+
+func TestCacheUpstreamHeaders(t *testing.T) {
+	t.Parallel()
+
+	var calls atomic.Int32
+
+	h, _ := newTestCache(t, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		_, _ = w.Write([]byte(r.Header.Get("X-User")))
+	})
+
+	requests := []struct {
+		user      string
+		expStatus string
+	}{
+		{"alice", "MISS"},
+		{"bob", "MISS"},
+		{"alice", "HIT"},
+	}
+
+	for i, request := range requests {
+		// as set by an OPA decision
+		header := http.Header{"X-User": {request.user}}
+
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.Header.Set("X-User", request.user)
+		req = req.WithContext(opa.NewUpstreamHeadersContext(req.Context(), header))
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		if exp, got := request.user, rec.Body.String(); exp != got {
+			t.Errorf("request %d: expected body %q, got %q", i, exp, got)
+		}
+
+		if exp, got := request.expStatus, rec.Header().Get(statusHeader); exp != got {
+			t.Errorf("request %d: expected %s, got %s", i, exp, got)
+		}
+	}
+
+	if exp, got := int32(2), calls.Load(); exp != got {
+		t.Fatalf("expected %d upstream calls, got %d", exp, got)
+	}
+}
@@ -0,0 +1,240 @@
+package cache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// tmpPrefix is used for partially written entries so that they are not
+// picked up if the process exits before they are moved into place.
+const tmpPrefix = ".tmp-"
+
+// DiskStore is a Store which keeps each entry in its own file in a
+// directory. Entries already in the directory are picked up when the store
+// is opened, and the least recently used are removed once maxSize bytes of
+// files are in use.
+type DiskStore struct {
+	dir     string
+	maxSize int64
+
+	mu    sync.Mutex
+	size  int64
+	lru   *list.List
+	items map[string]*list.Element
+}
+
+type diskItem struct {
+	name string
+	size int64
+}
+
+func NewDiskStore(dir string, maxSize int64) (*DiskStore, error) {
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cache dir: %w", err)
+	}
+
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cache dir: %w", err)
+	}
+
+	infos := make([]fs.FileInfo, 0, len(dirEntries))
+
+	for _, de := range dirEntries {
+		if de.IsDir() || strings.HasPrefix(de.Name(), tmpPrefix) {
+			continue
+		}
+
+		info, err := de.Info()
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat cache file: %w", err)
+		}
+
+		infos = append(infos, info)
+	}
+
+	// the oldest files are at the back of the list so are evicted first
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ModTime().After(infos[j].ModTime())
+	})
+
+	s := &DiskStore{
+		dir:     dir,
+		maxSize: maxSize,
+		lru:     list.New(),
+		items:   make(map[string]*list.Element),
+	}
+
+	for _, info := range infos {
+		s.items[info.Name()] = s.lru.PushBack(&diskItem{name: info.Name(), size: info.Size()})
+		s.size += info.Size()
+	}
+
+	err = s.evict()
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+type diskRecord struct {
+	Key   string
+	Entry *Entry
+}
+
+func (s *DiskStore) Get(key string) (*Entry, bool) {
+	name := diskName(key)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	el, ok := s.items[name]
+	if !ok {
+		return nil, false
+	}
+
+	f, err := os.Open(filepath.Join(s.dir, name))
+	if err != nil {
+		return nil, false
+	}
+	defer f.Close()
+
+	var rec diskRecord
+
+	err = gob.NewDecoder(f).Decode(&rec)
+	if err != nil || rec.Key != key {
+		return nil, false
+	}
+
+	s.lru.MoveToFront(el)
+
+	return rec.Entry, true
+}
+
+func (s *DiskStore) Set(key string, entry *Entry) error {
+	name := diskName(key)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.maxSize > 0 && entry.size() > s.maxSize {
+		return s.remove(name)
+	}
+
+	tmp, err := os.CreateTemp(s.dir, tmpPrefix+"*")
+	if err != nil {
+		return fmt.Errorf("failed to create cache file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	err = gob.NewEncoder(tmp).Encode(diskRecord{Key: key, Entry: entry})
+	if err != nil {
+		tmp.Close()
+
+		return fmt.Errorf("failed to encode cache entry: %w", err)
+	}
+
+	info, err := tmp.Stat()
+	if err != nil {
+		tmp.Close()
+
+		return fmt.Errorf("failed to stat cache file: %w", err)
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return fmt.Errorf("failed to close cache file: %w", err)
+	}
+
+	err = s.remove(name)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp.Name(), filepath.Join(s.dir, name))
+	if err != nil {
+		return fmt.Errorf("failed to move cache file: %w", err)
+	}
+
+	s.items[name] = s.lru.PushFront(&diskItem{name: name, size: info.Size()})
+	s.size += info.Size()
+
+	return s.evict()
+}
+
+func (s *DiskStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.remove(diskName(key))
+}
+
+func (s *DiskStore) Purge() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for name := range s.items {
+		err := s.remove(name)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *DiskStore) evict() error {
+	for s.maxSize > 0 && s.size > s.maxSize {
+		oldest := s.lru.Back()
+		if oldest == nil {
+			break
+		}
+
+		item, _ := oldest.Value.(*diskItem)
+
+		err := s.remove(item.name)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *DiskStore) remove(name string) error {
+	el, ok := s.items[name]
+	if !ok {
+		return nil
+	}
+
+	item, _ := el.Value.(*diskItem)
+
+	s.lru.Remove(el)
+	delete(s.items, name)
+	s.size -= item.size
+
+	err := os.Remove(filepath.Join(s.dir, name))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to remove cache file: %w", err)
+	}
+
+	return nil
+}
+
+func diskName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,203 @@
+package cache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// heuristicallyCacheable are the status codes which may be stored without
+// explicit freshness information, see RFC 9110 section 15.1.
+var heuristicallyCacheable = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+// directives are the parsed values of a Cache-Control header. Directives
+// without an argument are present with an empty value.
+type directives map[string]string
+
+func parseDirectives(h http.Header) directives {
+	d := make(directives)
+
+	for _, line := range h.Values("Cache-Control") {
+		for _, part := range strings.Split(line, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+			if name == "" {
+				continue
+			}
+
+			d[strings.ToLower(name)] = strings.Trim(value, `"`)
+		}
+	}
+
+	return d
+}
+
+func (d directives) has(name string) bool {
+	_, ok := d[name]
+
+	return ok
+}
+
+func (d directives) seconds(name string) (time.Duration, bool) {
+	v, ok := d[name]
+	if !ok {
+		return 0, false
+	}
+
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+
+	return time.Duration(n) * time.Second, true
+}
+
+// storable reports if a response may be stored by a shared cache, see
+// RFC 9111 section 3.
+func storable(req *http.Request, statusCode int, header http.Header) bool {
+	if req.Method != http.MethodGet {
+		return false
+	}
+
+	if statusCode == http.StatusPartialContent || statusCode == http.StatusNotModified {
+		return false
+	}
+
+	reqCC := parseDirectives(req.Header)
+	respCC := parseDirectives(header)
+
+	if reqCC.has("no-store") || respCC.has("no-store") || respCC.has("private") {
+		return false
+	}
+
+	if header.Get("Vary") == "*" {
+		return false
+	}
+
+	if req.Header.Get("Authorization") != "" &&
+		!respCC.has("public") && !respCC.has("s-maxage") && !respCC.has("must-revalidate") {
+		return false
+	}
+
+	if respCC.has("public") || heuristicallyCacheable[statusCode] {
+		return true
+	}
+
+	return hasExplicitExpiry(respCC, header)
+}
+
+func hasExplicitExpiry(cc directives, header http.Header) bool {
+	if _, ok := cc.seconds("s-maxage"); ok {
+		return true
+	}
+
+	if _, ok := cc.seconds("max-age"); ok {
+		return true
+	}
+
+	return header.Get("Expires") != ""
+}
+
+// freshnessLifetime is calculated as described in RFC 9111 section 4.2.1
+// for a shared cache.
+func (e *Entry) freshnessLifetime() time.Duration {
+	cc := parseDirectives(e.Header)
+
+	if d, ok := cc.seconds("s-maxage"); ok {
+		return d
+	}
+
+	if d, ok := cc.seconds("max-age"); ok {
+		return d
+	}
+
+	date := e.date()
+
+	if v := e.Header.Get("Expires"); v != "" {
+		expires, err := http.ParseTime(v)
+		if err != nil {
+			// invalid Expires values represent a time in the past
+			return 0
+		}
+
+		return expires.Sub(date)
+	}
+
+	if !heuristicallyCacheable[e.StatusCode] && !cc.has("public") {
+		return 0
+	}
+
+	lastModified, err := http.ParseTime(e.Header.Get("Last-Modified"))
+	if err != nil || lastModified.After(date) {
+		return 0
+	}
+
+	return date.Sub(lastModified) / 10
+}
+
+// age is calculated as described in RFC 9111 section 4.2.3.
+func (e *Entry) age(now time.Time) time.Duration {
+	apparentAge := max(0, e.ResponseTime.Sub(e.date()))
+
+	var ageValue time.Duration
+
+	if n, err := strconv.ParseInt(e.Header.Get("Age"), 10, 64); err == nil && n > 0 {
+		ageValue = time.Duration(n) * time.Second
+	}
+
+	responseDelay := e.ResponseTime.Sub(e.RequestTime)
+	correctedInitialAge := max(apparentAge, ageValue+responseDelay)
+	residentTime := now.Sub(e.ResponseTime)
+
+	return correctedInitialAge + residentTime
+}
+
+func (e *Entry) date() time.Time {
+	date, err := http.ParseTime(e.Header.Get("Date"))
+	if err != nil {
+		return e.ResponseTime
+	}
+
+	return date
+}
+
+// matchesVary reports if the request selects the same representation as
+// the request which caused the entry to be stored.
+func (e *Entry) matchesVary(req *http.Request) bool {
+	for name, value := range e.VaryValues {
+		if value != strings.Join(req.Header.Values(name), ",") {
+			return false
+		}
+	}
+
+	return true
+}
+
+func varyValues(req *http.Request, header http.Header) map[string]string {
+	values := make(map[string]string)
+
+	for _, line := range header.Values("Vary") {
+		for _, name := range strings.Split(line, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "" {
+				continue
+			}
+
+			values[name] = strings.Join(req.Header.Values(name), ",")
+		}
+	}
+
+	return values
+}
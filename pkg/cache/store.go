@@ -0,0 +1,144 @@
+package cache
+
+import (
+	"container/list"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Entry is a stored response along with the information needed to
+// calculate its age and match it against later requests.
+type Entry struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+
+	RequestTime  time.Time
+	ResponseTime time.Time
+
+	// VaryValues holds the values of the request headers named in the
+	// response's Vary header when the entry was stored.
+	VaryValues map[string]string
+}
+
+func (e *Entry) size() int64 {
+	size := int64(len(e.Body))
+
+	for k, vs := range e.Header {
+		for _, v := range vs {
+			size += int64(len(k) + len(v))
+		}
+	}
+
+	return size
+}
+
+// Store holds cached entries by key.
+type Store interface {
+	Get(key string) (*Entry, bool)
+	Set(key string, entry *Entry) error
+	Delete(key string) error
+	Purge() error
+}
+
+// MemoryStore is an in-memory Store which evicts the least recently used
+// entries once maxSize bytes are in use.
+type MemoryStore struct {
+	maxSize int64
+
+	mu    sync.Mutex
+	size  int64
+	lru   *list.List
+	items map[string]*list.Element
+}
+
+type memoryItem struct {
+	key   string
+	entry *Entry
+	size  int64
+}
+
+func NewMemoryStore(maxSize int64) *MemoryStore {
+	return &MemoryStore{
+		maxSize: maxSize,
+		lru:     list.New(),
+		items:   make(map[string]*list.Element),
+	}
+}
+
+func (s *MemoryStore) Get(key string) (*Entry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	el, ok := s.items[key]
+	if !ok {
+		return nil, false
+	}
+
+	s.lru.MoveToFront(el)
+
+	item, _ := el.Value.(*memoryItem)
+
+	return item.entry, true
+}
+
+func (s *MemoryStore) Set(key string, entry *Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.remove(key)
+
+	size := entry.size()
+	if s.maxSize > 0 && size > s.maxSize {
+		return nil
+	}
+
+	s.items[key] = s.lru.PushFront(&memoryItem{key: key, entry: entry, size: size})
+	s.size += size
+
+	for s.maxSize > 0 && s.size > s.maxSize {
+		oldest := s.lru.Back()
+		if oldest == nil {
+			break
+		}
+
+		item, _ := oldest.Value.(*memoryItem)
+		s.remove(item.key)
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.remove(key)
+
+	return nil
+}
+
+func (s *MemoryStore) Purge() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lru.Init()
+	s.items = make(map[string]*list.Element)
+	s.size = 0
+
+	return nil
+}
+
+func (s *MemoryStore) remove(key string) {
+	el, ok := s.items[key]
+	if !ok {
+		return
+	}
+
+	item, _ := el.Value.(*memoryItem)
+
+	s.lru.Remove(el)
+	delete(s.items, key)
+	s.size -= item.size
+}
@@ -0,0 +1,104 @@
+package cache
+
+import (
+	"net/http"
+	"testing"
+)
+
+func testEntry(body string) *Entry {
+	return &Entry{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{},
+		Body:       []byte(body),
+	}
+}
+
+func TestMemoryStoreEviction(t *testing.T) {
+	t.Parallel()
+
+	s := NewMemoryStore(10)
+
+	for _, key := range []string{"a", "b", "c"} {
+		err := s.Set(key, testEntry("1234"))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		// keep a as the most recently used
+		s.Get("a")
+	}
+
+	if _, ok := s.Get("b"); ok {
+		t.Fatal("expected b to be evicted")
+	}
+
+	for _, key := range []string{"a", "c"} {
+		if _, ok := s.Get(key); !ok {
+			t.Fatalf("expected %s to be stored", key)
+		}
+	}
+
+	err := s.Set("big", testEntry("12345678901"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, ok := s.Get("big"); ok {
+		t.Fatal("expected entry larger than store to be skipped")
+	}
+}
+
+func TestDiskStore(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+
+	s, err := NewDiskStore(dir, 0)
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+
+	err = s.Set("example.com/foo", testEntry("foo"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// entries are loaded when the store is opened again
+	s, err = NewDiskStore(dir, 0)
+	if err != nil {
+		t.Fatalf("failed to reopen store: %v", err)
+	}
+
+	entry, ok := s.Get("example.com/foo")
+	if !ok {
+		t.Fatal("expected entry to be found")
+	}
+
+	if exp, got := "foo", string(entry.Body); exp != got {
+		t.Fatalf("expected body %q, got %q", exp, got)
+	}
+
+	err = s.Purge()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, ok := s.Get("example.com/foo"); ok {
+		t.Fatal("expected entry to be purged")
+	}
+
+	// opening with a size limit evicts entries over it
+	small, err := NewDiskStore(dir, 1)
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+
+	err = small.Set("example.com/bar", testEntry("bar"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, ok := small.Get("example.com/bar"); ok {
+		t.Fatal("expected entry over size limit not to be stored")
+	}
+}
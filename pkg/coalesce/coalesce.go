@@ -0,0 +1,238 @@
+package coalesce
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/charlieegan3/tool-tsnet-proxy/pkg/identity"
+	"github.com/charlieegan3/tool-tsnet-proxy/pkg/opa"
+	"github.com/charlieegan3/tool-tsnet-proxy/pkg/whois"
+)
+
+// identityHeaders are always part of the key, along with the tailnet and
+// OIDC identities and headers set by OPA decisions, so that responses are
+// never shared between different users.
+var identityHeaders = []string{"Authorization", "Cookie", "Proxy-Authorization"}
+
+type Options struct {
+	// VaryHeaders are request headers which, in addition to the method and
+	// URL, must match for requests to share a response.
+	VaryHeaders []string
+
+	// MaxBodySize is the largest response body which will be shared,
+	// waiters make their own request for larger responses. Zero means no
+	// limit.
+	MaxBodySize int64
+}
+
+// NewMiddleware returns a middleware which makes a single upstream request
+// for concurrent identical GET and HEAD requests and sends the response to
+// all of them. Responses marked private or no-store aren't shared, waiters
+// make their own request.
+func NewMiddleware(opts Options) func(http.Handler) http.Handler {
+	keyHeaders := append(append([]string{}, identityHeaders...), opts.VaryHeaders...)
+
+	return func(next http.Handler) http.Handler {
+		return &coalescer{
+			opts:       opts,
+			next:       next,
+			keyHeaders: keyHeaders,
+			calls:      make(map[string]*call),
+		}
+	}
+}
+
+type coalescer struct {
+	opts       Options
+	next       http.Handler
+	keyHeaders []string
+
+	mu    sync.Mutex
+	calls map[string]*call
+}
+
+type call struct {
+	done chan struct{}
+
+	// resp is nil when the response could not be shared
+	resp *response
+}
+
+type response struct {
+	statusCode int
+	header     http.Header
+	body       []byte
+}
+
+func (c *coalescer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if (r.Method != http.MethodGet && r.Method != http.MethodHead) || r.ContentLength > 0 {
+		c.next.ServeHTTP(w, r)
+
+		return
+	}
+
+	key := c.key(r)
+
+	c.mu.Lock()
+
+	if existing, ok := c.calls[key]; ok {
+		c.mu.Unlock()
+
+		select {
+		case <-existing.done:
+		case <-r.Context().Done():
+			return
+		}
+
+		if existing.resp == nil {
+			c.next.ServeHTTP(w, r)
+
+			return
+		}
+
+		existing.resp.writeTo(w)
+
+		return
+	}
+
+	cl := &call{done: make(chan struct{})}
+	c.calls[key] = cl
+	c.mu.Unlock()
+
+	tw := &teeWriter{ResponseWriter: w, limit: c.opts.MaxBodySize}
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.calls, key)
+		c.mu.Unlock()
+
+		// if the leader's client went away the response may be incomplete
+		if tw.header != nil && !tw.overflow && r.Context().Err() == nil && shareable(tw.header) {
+			cl.resp = &response{
+				statusCode: tw.statusCode,
+				header:     tw.header,
+				body:       tw.body.Bytes(),
+			}
+		}
+
+		close(cl.done)
+	}()
+
+	c.next.ServeHTTP(tw, r)
+
+	if tw.header == nil {
+		tw.WriteHeader(http.StatusOK)
+	}
+}
+
+func (c *coalescer) key(r *http.Request) string {
+	h := sha256.New()
+
+	parts := []string{
+		r.Method,
+		r.Host,
+		r.URL.RequestURI(),
+		whois.FromContext(r.Context()).Key(),
+		identity.FromContext(r.Context()).Key(),
+		opa.UpstreamHeadersKey(r.Context()),
+	}
+
+	for _, part := range parts {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+
+	for _, name := range c.keyHeaders {
+		h.Write([]byte(strings.Join(r.Header.Values(name), ",")))
+		h.Write([]byte{0})
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// shareable returns false for responses which are only for the client
+// which requested them.
+func shareable(h http.Header) bool {
+	for _, v := range h.Values("Cache-Control") {
+		for _, directive := range strings.Split(v, ",") {
+			name, _, _ := strings.Cut(strings.TrimSpace(directive), "=")
+
+			if strings.EqualFold(name, "private") || strings.EqualFold(name, "no-store") {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+func (r *response) writeTo(w http.ResponseWriter) {
+	for k, v := range r.header {
+		w.Header()[k] = append([]string(nil), v...)
+	}
+
+	w.WriteHeader(r.statusCode)
+
+	//nolint:errcheck
+	w.Write(r.body)
+}
+
+// teeWriter writes the leader's response to its client while keeping a
+// copy of it, up to limit bytes, for the waiters. The upstream writes to
+// its own headers so that headers set for the leader's client by other
+// middlewares, such as X-Request-ID, aren't shared.
+type teeWriter struct {
+	http.ResponseWriter
+
+	limit int64
+
+	upstreamHeader http.Header
+	statusCode     int
+	header         http.Header
+	body           bytes.Buffer
+	overflow       bool
+}
+
+func (w *teeWriter) Header() http.Header {
+	if w.upstreamHeader == nil {
+		w.upstreamHeader = make(http.Header)
+	}
+
+	return w.upstreamHeader
+}
+
+func (w *teeWriter) WriteHeader(statusCode int) {
+	if w.header != nil {
+		return
+	}
+
+	w.statusCode = statusCode
+	w.header = w.Header().Clone()
+
+	for k, v := range w.header {
+		w.ResponseWriter.Header()[k] = v
+	}
+
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *teeWriter) Write(b []byte) (int, error) {
+	if w.header == nil {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if !w.overflow {
+		if w.limit > 0 && int64(w.body.Len()+len(b)) > w.limit {
+			w.overflow = true
+			w.body = bytes.Buffer{}
+		} else {
+			w.body.Write(b)
+		}
+	}
+
+	return w.ResponseWriter.Write(b)
+}
@@ -0,0 +1,399 @@
+package coalesce
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/charlieegan3/tool-tsnet-proxy/pkg/identity"
+	"github.com/charlieegan3/tool-tsnet-proxy/pkg/opa"
+	"github.com/charlieegan3/tool-tsnet-proxy/pkg/whois"
+)
+
+func TestCoalescing(t *testing.T) {
+	t.Parallel()
+
+	var calls atomic.Int32
+
+	release := make(chan struct{})
+
+	h := NewMiddleware(Options{VaryHeaders: []string{"Accept"}})(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+			<-release
+
+			w.Header().Set("Content-Type", "text/plain")
+			_, _ = w.Write([]byte(r.Header.Get("Authorization") + r.Header.Get("Accept")))
+		}),
+	)
+
+	requests := []struct {
+		authorization string
+		accept        string
+	}{
+		{"alice", "a"},
+		{"alice", "a"},
+		{"alice", "a"},
+		{"bob", "a"},
+		{"alice", "b"},
+	}
+
+	var wg sync.WaitGroup
+
+	results := make([]*httptest.ResponseRecorder, len(requests))
+
+	for i, request := range requests {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/dashboard", nil)
+			req.Header.Set("Authorization", request.authorization)
+			req.Header.Set("Accept", request.accept)
+
+			results[i] = httptest.NewRecorder()
+			h.ServeHTTP(results[i], req)
+		}()
+	}
+
+	// wait for all requests to be waiting on the upstream
+	deadline := time.Now().Add(time.Second)
+	for calls.Load() < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 3 upstream calls, got %d", calls.Load())
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if exp, got := int32(3), calls.Load(); exp != got {
+		t.Fatalf("expected %d upstream calls, got %d", exp, got)
+	}
+
+	for i, request := range requests {
+		if exp, got := request.authorization+request.accept, results[i].Body.String(); exp != got {
+			t.Errorf("request %d: expected body %q, got %q", i, exp, got)
+		}
+
+		if exp, got := "text/plain", results[i].Header().Get("Content-Type"); exp != got {
+			t.Errorf("request %d: expected content type %q, got %q", i, exp, got)
+		}
+	}
+}
+
+func TestCoalescingSkipsLargeResponses(t *testing.T) {
+	t.Parallel()
+
+	var calls atomic.Int32
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	h := NewMiddleware(Options{MaxBodySize: 2})(
+		http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			if calls.Add(1) == 1 {
+				close(started)
+				<-release
+			}
+
+			_, _ = w.Write([]byte("large"))
+		}),
+	)
+
+	var wg sync.WaitGroup
+
+	results := make([]*httptest.ResponseRecorder, 2)
+
+	for i := range results {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			if i == 1 {
+				<-started
+			}
+
+			results[i] = httptest.NewRecorder()
+			h.ServeHTTP(results[i], httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+		}()
+	}
+
+	<-started
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if exp, got := int32(2), calls.Load(); exp != got {
+		t.Fatalf("expected %d upstream calls, got %d", exp, got)
+	}
+
+	for i, rec := range results {
+		if exp, got := "large", rec.Body.String(); exp != got {
+			t.Errorf("request %d: expected body %q, got %q", i, exp, got)
+		}
+	}
+}
+
+func TestCoalescingPerRequestResponses(t *testing.T) {
+	t.Parallel()
+
+	testCases := map[string]struct {
+		cacheControl string
+		expCalls     int32
+	}{
+		"shared":   {expCalls: 1},
+		"private":  {cacheControl: "max-age=60, private", expCalls: 2},
+		"no-store": {cacheControl: "No-Store", expCalls: 2},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			var calls atomic.Int32
+
+			release := make(chan struct{})
+
+			coalescer := NewMiddleware(Options{})(
+				http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+					calls.Add(1)
+					<-release
+
+					if tc.cacheControl != "" {
+						w.Header().Set("Cache-Control", tc.cacheControl)
+					}
+
+					_, _ = w.Write([]byte("ok"))
+				}),
+			)
+
+			// a header set for each request before coalescing, as
+			// requestid does
+			h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("X-Request-Id", r.Header.Get("X-Test-Id"))
+				coalescer.ServeHTTP(w, r)
+			})
+
+			var wg sync.WaitGroup
+
+			results := make([]*httptest.ResponseRecorder, 2)
+
+			for i := range results {
+				wg.Add(1)
+
+				go func() {
+					defer wg.Done()
+
+					req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+					req.Header.Set("X-Test-Id", strconv.Itoa(i))
+
+					results[i] = httptest.NewRecorder()
+					h.ServeHTTP(results[i], req)
+				}()
+
+				// the first request leads
+				deadline := time.Now().Add(time.Second)
+				for calls.Load() < 1 {
+					if time.Now().After(deadline) {
+						t.Fatal("expected an upstream call")
+					}
+
+					time.Sleep(time.Millisecond)
+				}
+			}
+
+			time.Sleep(10 * time.Millisecond)
+			close(release)
+			wg.Wait()
+
+			if exp, got := tc.expCalls, calls.Load(); exp != got {
+				t.Fatalf("expected %d upstream calls, got %d", exp, got)
+			}
+
+			for i, rec := range results {
+				if exp, got := strconv.Itoa(i), rec.Header().Get("X-Request-Id"); exp != got {
+					t.Errorf("request %d: expected request ID %q, got %q", i, exp, got)
+				}
+			}
+		})
+	}
+}
+
+func TestCoalescingTailnetIdentities(t *testing.T) {
+	t.Parallel()
+
+	var calls atomic.Int32
+
+	release := make(chan struct{})
+
+	h := NewMiddleware(Options{})(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+			<-release
+
+			_, _ = w.Write([]byte(whois.FromContext(r.Context()).LoginName))
+		}),
+	)
+
+	logins := []string{"alice@example.com", "bob@example.com"}
+
+	var wg sync.WaitGroup
+
+	results := make([]*httptest.ResponseRecorder, len(logins))
+
+	for i, login := range logins {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+			req = req.WithContext(whois.NewContext(req.Context(), &whois.Identity{LoginName: login, NodeName: "laptop"}))
+
+			results[i] = httptest.NewRecorder()
+			h.ServeHTTP(results[i], req)
+		}()
+	}
+
+	// each identity makes its own upstream request
+	deadline := time.Now().Add(time.Second)
+	for calls.Load() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 2 upstream calls, got %d", calls.Load())
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	close(release)
+	wg.Wait()
+
+	for i, login := range logins {
+		if exp, got := login, results[i].Body.String(); exp != got {
+			t.Errorf("request %d: expected body %q, got %q", i, exp, got)
+		}
+	}
+}
+
+func TestCoalescingOIDCIdentities(t *testing.T) {
+	t.Parallel()
+
+	var calls atomic.Int32
+
+	release := make(chan struct{})
+
+	h := NewMiddleware(Options{})(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+			<-release
+
+			_, _ = w.Write([]byte(identity.FromContext(r.Context())["sub"].(string)))
+		}),
+	)
+
+	subjects := []string{"alice", "bob"}
+
+	var wg sync.WaitGroup
+
+	results := make([]*httptest.ResponseRecorder, len(subjects))
+
+	for i, sub := range subjects {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+			req = req.WithContext(identity.NewContext(req.Context(), identity.Claims{"sub": sub}))
+
+			results[i] = httptest.NewRecorder()
+			h.ServeHTTP(results[i], req)
+		}()
+	}
+
+	// each user makes their own upstream request
+	deadline := time.Now().Add(time.Second)
+	for calls.Load() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 2 upstream calls, got %d", calls.Load())
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	close(release)
+	wg.Wait()
+
+	for i, sub := range subjects {
+		if exp, got := sub, results[i].Body.String(); exp != got {
+			t.Errorf("request %d: expected body %q, got %q", i, exp, got)
+		}
+	}
+}
+
+func TestCoalescingUpstreamHeaders(t *testing.T) {
+	t.Parallel()
+
+	var calls atomic.Int32
+
+	release := make(chan struct{})
+
+	h := NewMiddleware(Options{})(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+			<-release
+
+			_, _ = w.Write([]byte(r.Header.Get("X-User")))
+		}),
+	)
+
+	users := []string{"alice", "bob"}
+
+	var wg sync.WaitGroup
+
+	results := make([]*httptest.ResponseRecorder, len(users))
+
+	for i, user := range users {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			// as set by an OPA decision
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+			req.Header.Set("X-User", user)
+			req = req.WithContext(opa.NewUpstreamHeadersContext(req.Context(), http.Header{"X-User": {user}}))
+
+			results[i] = httptest.NewRecorder()
+			h.ServeHTTP(results[i], req)
+		}()
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for calls.Load() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 2 upstream calls, got %d", calls.Load())
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	close(release)
+	wg.Wait()
+
+	for i, user := range users {
+		if exp, got := user, results[i].Body.String(); exp != got {
+			t.Errorf("request %d: expected body %q, got %q", i, exp, got)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package concurrency
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/charlieegan3/tool-tsnet-proxy/pkg/requestid"
+)
+
+var (
+	ErrQueueFull    = errors.New("queue is full")
+	ErrQueueTimeout = errors.New("timed out waiting in queue")
+)
+
+type Options struct {
+	// MaxInFlight is the number of requests which may run at once.
+	MaxInFlight int
+
+	// MaxQueue is the number of requests which may wait for a slot, further
+	// requests are rejected.
+	MaxQueue int
+
+	// QueueTimeout is the longest a request will wait for a slot, zero
+	// means requests wait until their context is done.
+	QueueTimeout time.Duration
+}
+
+// Limiter limits the number of requests in flight, queueing the excess in
+// the order they arrive.
+type Limiter struct {
+	opts Options
+
+	mu       sync.Mutex
+	inFlight int
+	queue    *list.List
+}
+
+func NewLimiter(opts Options) *Limiter {
+	return &Limiter{
+		opts:  opts,
+		queue: list.New(),
+	}
+}
+
+// Acquire waits for a slot, release must be called once the request is
+// complete.
+func (l *Limiter) Acquire(ctx context.Context) (release func(), err error) {
+	l.mu.Lock()
+
+	if l.inFlight < l.opts.MaxInFlight && l.queue.Len() == 0 {
+		l.inFlight++
+		l.mu.Unlock()
+
+		return l.release, nil
+	}
+
+	if l.queue.Len() >= l.opts.MaxQueue {
+		l.mu.Unlock()
+
+		return nil, ErrQueueFull
+	}
+
+	ready := make(chan struct{})
+	el := l.queue.PushBack(ready)
+	l.mu.Unlock()
+
+	var timeout <-chan time.Time
+
+	if l.opts.QueueTimeout > 0 {
+		timer := time.NewTimer(l.opts.QueueTimeout)
+		defer timer.Stop()
+
+		timeout = timer.C
+	}
+
+	select {
+	case <-ready:
+		return l.release, nil
+	case <-timeout:
+		err = ErrQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	select {
+	case <-ready:
+		// the slot was handed over while giving up, pass it on
+		l.releaseLocked()
+	default:
+		l.queue.Remove(el)
+	}
+
+	return nil, err
+}
+
+func (l *Limiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.releaseLocked()
+}
+
+func (l *Limiter) releaseLocked() {
+	front := l.queue.Front()
+	if front == nil {
+		l.inFlight--
+
+		return
+	}
+
+	// the slot goes straight to the next request in the queue
+	l.queue.Remove(front)
+
+	ready, _ := front.Value.(chan struct{})
+	close(ready)
+}
+
+// InFlight returns the number of requests currently holding a slot.
+func (l *Limiter) InFlight() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.inFlight
+}
+
+// QueueDepth returns the number of requests waiting for a slot.
+func (l *Limiter) QueueDepth() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.queue.Len()
+}
+
+// Middleware responds with 503 Service Unavailable to requests which can't
+// get a slot.
+func (l *Limiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		release, err := l.Acquire(r.Context())
+		if err != nil {
+			if r.Context().Err() != nil {
+				return
+			}
+
+			w.Header().Set("Retry-After", "1")
+			requestid.Error(w, r, "service unavailable: "+err.Error(), http.StatusServiceUnavailable)
+
+			return
+		}
+		defer release()
+
+		next.ServeHTTP(w, r)
+	})
+}
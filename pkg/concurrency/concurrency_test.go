@@ -0,0 +1,127 @@
+package concurrency
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLimiterQueueOrder(t *testing.T) {
+	t.Parallel()
+
+	l := NewLimiter(Options{MaxInFlight: 1, MaxQueue: 2})
+
+	release, err := l.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var (
+		mu    sync.Mutex
+		order []int
+		wg    sync.WaitGroup
+	)
+
+	for i := range 2 {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			release, err := l.Acquire(context.Background())
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+
+				return
+			}
+
+			mu.Lock()
+			order = append(order, i)
+			mu.Unlock()
+
+			release()
+		}()
+
+		// wait for the request to be queued before starting the next
+		for l.QueueDepth() != i+1 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	_, err = l.Acquire(context.Background())
+	if !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("expected queue full error, got %v", err)
+	}
+
+	if exp, got := 1, l.InFlight(); exp != got {
+		t.Fatalf("expected %d in flight, got %d", exp, got)
+	}
+
+	release()
+	wg.Wait()
+
+	if len(order) != 2 || order[0] != 0 || order[1] != 1 {
+		t.Fatalf("expected requests to run in order, got %v", order)
+	}
+
+	if exp, got := 0, l.InFlight(); exp != got {
+		t.Fatalf("expected %d in flight, got %d", exp, got)
+	}
+}
+
+func TestLimiterQueueTimeout(t *testing.T) {
+	t.Parallel()
+
+	l := NewLimiter(Options{MaxInFlight: 1, MaxQueue: 1, QueueTimeout: 10 * time.Millisecond})
+
+	release, err := l.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer release()
+
+	_, err = l.Acquire(context.Background())
+	if !errors.Is(err, ErrQueueTimeout) {
+		t.Fatalf("expected queue timeout error, got %v", err)
+	}
+
+	if exp, got := 0, l.QueueDepth(); exp != got {
+		t.Fatalf("expected queue depth %d, got %d", exp, got)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	t.Parallel()
+
+	l := NewLimiter(Options{MaxInFlight: 1})
+
+	started := make(chan struct{})
+	finish := make(chan struct{})
+
+	h := l.Middleware(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		close(started)
+		<-finish
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	go h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	<-started
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	close(finish)
+
+	if exp, got := http.StatusServiceUnavailable, rec.Code; exp != got {
+		t.Fatalf("expected status %d, got %d", exp, got)
+	}
+
+	if rec.Header().Get("Retry-After") == "" {
+		t.Fatal("expected Retry-After header")
+	}
+}
@@ -6,12 +6,15 @@ import (
 	"time"
 
 	"github.com/miekg/dns"
+
+	"github.com/charlieegan3/tool-tsnet-proxy/pkg/metrics"
 )
 
 type WrappingDNSServerOptions struct {
 	Addr       string
 	DoHServers []string
 	Timeout    time.Duration
+	Metrics    *metrics.Metrics
 }
 
 func NewWrappingDNSServer(opts *WrappingDNSServerOptions) *dns.Server {
@@ -47,7 +50,11 @@ func NewWrappingDNSServer(opts *WrappingDNSServerOptions) *dns.Server {
 			dns.HandleFailed(w, r)
 		default:
 			for _, dohServer := range opts.DoHServers {
+				start := time.Now()
 				records, err := QueryA(ctx, dohServer, n)
+
+				opts.Metrics.ObserveDNSQuery("doh", time.Since(start), err)
+
 				if err != nil {
 					continue
 				}
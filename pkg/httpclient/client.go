@@ -8,6 +8,12 @@ import (
 	"net"
 	"net/http"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/charlieegan3/tool-tsnet-proxy/pkg/metrics"
+	"github.com/charlieegan3/tool-tsnet-proxy/pkg/tracing"
 )
 
 type UpstreamClientOptions struct {
@@ -16,6 +22,10 @@ type UpstreamClientOptions struct {
 	Host               string
 	Port               string
 	InsecureSkipVerify bool
+
+	// Name identifies the upstream in metrics, it defaults to Host
+	Name    string
+	Metrics *metrics.Metrics
 }
 
 type DNSServer struct {
@@ -68,20 +78,38 @@ func NewUpsteamClient(opts UpstreamClientOptions) *http.Client {
 		},
 	}
 
+	name := opts.Name
+	if name == "" {
+		name = upstreamServerHost
+	}
+
 	// a custom dial function can be supplied for tailscale clients
 	dialFunc := opts.DialFunc
+	dialMethod := "tsnet"
 
 	if opts.DialFunc == nil {
 		dialer := &net.Dialer{}
 		dialFunc = dialer.DialContext
+		dialMethod = "direct"
 	}
 
 	return &http.Client{
 		Transport: &http.Transport{
 			TLSClientConfig: &tls.Config{InsecureSkipVerify: opts.InsecureSkipVerify},
 			DialContext: func(ctx context.Context, network string, _ string) (net.Conn, error) {
-				ips, err := customResolver.LookupIP(ctx, "ip", upstreamServerHost)
+				lookupCtx, span := tracing.Start(ctx, "dns.lookup", trace.WithAttributes(
+					attribute.String("dns.host", upstreamServerHost),
+				))
+
+				start := time.Now()
+				ips, err := customResolver.LookupIP(lookupCtx, "ip", upstreamServerHost)
+
+				opts.Metrics.ObserveDNSQuery("httpclient", time.Since(start), err)
+				tracing.End(span, err)
+
 				if err != nil {
+					opts.Metrics.ObserveDialError(name, err)
+
 					return nil, fmt.Errorf("failed to lookup IP: %w", err)
 				}
 
@@ -89,8 +117,18 @@ func NewUpsteamClient(opts UpstreamClientOptions) *http.Client {
 				for _, ip := range ips {
 					upstreamServerAddrAndPort := net.JoinHostPort(ip.String(), upstreamServerPort)
 
-					conn, err = dialFunc(ctx, network, upstreamServerAddrAndPort)
+					dialCtx, span := tracing.Start(ctx, "dial", trace.WithAttributes(
+						attribute.String("dial.method", dialMethod),
+						attribute.String("dial.address", upstreamServerAddrAndPort),
+					))
+
+					conn, err = dialFunc(dialCtx, network, upstreamServerAddrAndPort)
+
+					tracing.End(span, err)
+
 					if err != nil {
+						opts.Metrics.ObserveDialError(name, err)
+
 						return nil, fmt.Errorf("failed to dial upstream server: %w", err)
 					}
 
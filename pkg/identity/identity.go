@@ -0,0 +1,285 @@
+package identity
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+
+	"github.com/charlieegan3/tool-tsnet-proxy/pkg/requestid"
+)
+
+// Headers set for upstreams, any sent by clients are removed.
+const (
+	HeaderPrefix    = "X-Identity-"
+	HeaderTimestamp = "X-Identity-Timestamp"
+	HeaderSignature = "X-Identity-Signature"
+	HeaderToken     = "X-Identity-Token"
+)
+
+const defaultTTL = time.Minute
+
+var (
+	ErrInvalidSignature = errors.New("invalid identity signature")
+	ErrExpired          = errors.New("identity headers expired")
+)
+
+// DefaultClaims are taken from ID tokens when no claims are configured.
+var DefaultClaims = []string{"sub", "email", "name", "groups"}
+
+// Claims are the claims from the ID token of the user making a request.
+type Claims map[string]interface{}
+
+type contextKey struct{}
+
+// ContextKey is the context key for a request's Claims, it's set by the
+// oauth middleware in pkg/tool.
+var ContextKey = contextKey{}
+
+// FromContext returns the claims of the user making the request, if any.
+func FromContext(ctx context.Context) Claims {
+	c, _ := ctx.Value(ContextKey).(Claims)
+
+	return c
+}
+
+// NewContext returns a context with the user's claims.
+func NewContext(ctx context.Context, c Claims) context.Context {
+	return context.WithValue(ctx, ContextKey, c)
+}
+
+// Key returns a hash of the claims, for keeping responses for different
+// users apart. It's empty for nil claims.
+func (c Claims) Key() string {
+	if c == nil {
+		return ""
+	}
+
+	// maps are encoded with sorted keys
+	b, err := json.Marshal(c)
+	if err != nil {
+		return ""
+	}
+
+	sum := sha256.Sum256(b)
+
+	return hex.EncodeToString(sum[:])
+}
+
+// Select returns the named claims which are set in all.
+func Select(all map[string]interface{}, names []string) Claims {
+	if len(names) == 0 {
+		names = DefaultClaims
+	}
+
+	c := make(Claims, len(names))
+
+	for _, name := range names {
+		if v, ok := all[name]; ok {
+			c[name] = v
+		}
+	}
+
+	return c
+}
+
+type Options struct {
+	// Mode is headers, to set a signed header per claim, or jwt, to set
+	// a token in the X-Identity-Token header
+	Mode string
+	// Key signs the headers with HMAC-SHA256, or the token with HS256
+	Key []byte
+	// Issuer is the iss claim of tokens
+	Issuer string
+	// TTL is how long headers or tokens are valid for, it defaults to a
+	// minute
+	TTL time.Duration
+}
+
+// NewMiddleware returns a middleware which forwards the user's claims to
+// upstreams. Requests without claims are passed on without identity
+// headers.
+func NewMiddleware(opts Options) (func(http.Handler) http.Handler, error) {
+	if len(opts.Key) == 0 {
+		return nil, errors.New("identity key is required")
+	}
+
+	if opts.TTL == 0 {
+		opts.TTL = defaultTTL
+	}
+
+	var signer jose.Signer
+
+	switch opts.Mode {
+	case "headers":
+	case "jwt":
+		var err error
+
+		signer, err = jose.NewSigner(jose.SigningKey{Algorithm: jose.HS256, Key: opts.Key}, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create signer: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown identity mode %q", opts.Mode)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for name := range r.Header {
+				if strings.HasPrefix(name, HeaderPrefix) {
+					r.Header.Del(name)
+				}
+			}
+
+			claims := FromContext(r.Context())
+			if claims == nil {
+				next.ServeHTTP(w, r)
+
+				return
+			}
+
+			now := time.Now()
+
+			if signer != nil {
+				token, err := jwt.Signed(signer).
+					Claims(map[string]interface{}(claims)).
+					Claims(jwt.Claims{
+						Issuer:   opts.Issuer,
+						IssuedAt: jwt.NewNumericDate(now),
+						Expiry:   jwt.NewNumericDate(now.Add(opts.TTL)),
+					}).
+					CompactSerialize()
+				if err != nil {
+					requestid.Error(w, r, "failed to sign identity", http.StatusInternalServerError)
+
+					return
+				}
+
+				r.Header.Set(HeaderToken, token)
+				next.ServeHTTP(w, r)
+
+				return
+			}
+
+			setHeaders(r.Header, claims, now, opts.Key)
+			next.ServeHTTP(w, r)
+		})
+	}, nil
+}
+
+// HeaderName returns the header for a claim, such as X-Identity-Email.
+func HeaderName(claim string) string {
+	return http.CanonicalHeaderKey(HeaderPrefix + strings.ReplaceAll(claim, "_", "-"))
+}
+
+// CheckClaimName returns an error if the claim's header would be one of
+// the headers used to verify the others.
+func CheckClaimName(claim string) error {
+	switch name := HeaderName(claim); name {
+	case HeaderTimestamp, HeaderSignature, HeaderToken:
+		return fmt.Errorf("claim %q can't be sent as %s, it's used to verify the identity headers", claim, name)
+	}
+
+	return nil
+}
+
+// headerValue formats strings as they are, lists of strings are comma
+// separated and other values are JSON.
+func headerValue(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case []interface{}:
+		values := make([]string, 0, len(v))
+
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return jsonValue(v)
+			}
+
+			values = append(values, s)
+		}
+
+		return strings.Join(values, ",")
+	default:
+		return jsonValue(v)
+	}
+}
+
+func jsonValue(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+
+	return string(b)
+}
+
+func setHeaders(h http.Header, claims Claims, now time.Time, key []byte) {
+	for name, v := range claims {
+		// claims which collide with the verification headers are rejected
+		// by config validation, they're never sent
+		if CheckClaimName(name) != nil {
+			continue
+		}
+
+		h.Set(HeaderName(name), headerValue(v))
+	}
+
+	h.Set(HeaderTimestamp, strconv.FormatInt(now.Unix(), 10))
+	h.Set(HeaderSignature, signature(h, key))
+}
+
+// signature is the HMAC-SHA256 of the identity headers, sorted by name
+// and written as "name:value\n", encoded as unpadded base64url.
+func signature(h http.Header, key []byte) string {
+	names := make([]string, 0)
+
+	for name := range h {
+		if strings.HasPrefix(name, HeaderPrefix) && name != HeaderSignature {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+
+	mac := hmac.New(sha256.New, key)
+
+	for _, name := range names {
+		fmt.Fprintf(mac, "%s:%s\n", name, h.Get(name))
+	}
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the identity headers were signed with key and are no
+// older than ttl, it's intended for upstreams written in Go.
+func Verify(h http.Header, key []byte, ttl time.Duration) error {
+	if !hmac.Equal([]byte(signature(h, key)), []byte(h.Get(HeaderSignature))) {
+		return ErrInvalidSignature
+	}
+
+	ts, err := strconv.ParseInt(h.Get(HeaderTimestamp), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid identity timestamp: %w", err)
+	}
+
+	if time.Since(time.Unix(ts, 0)) > ttl {
+		return ErrExpired
+	}
+
+	return nil
+}
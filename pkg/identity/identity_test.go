@@ -0,0 +1,197 @@
+package identity
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+func TestSelect(t *testing.T) {
+	t.Parallel()
+
+	all := map[string]interface{}{
+		"sub":    "123",
+		"email":  "alice@example.com",
+		"groups": []interface{}{"admins"},
+		"nonce":  "abc",
+	}
+
+	if exp, got := (Claims{"sub": "123", "email": "alice@example.com", "groups": []interface{}{"admins"}}), Select(all, nil); !reflect.DeepEqual(exp, got) {
+		t.Errorf("Default claims did not match expected: %v != %v", exp, got)
+	}
+
+	if exp, got := (Claims{"nonce": "abc"}), Select(all, []string{"nonce", "missing"}); !reflect.DeepEqual(exp, got) {
+		t.Errorf("Claims did not match expected: %v != %v", exp, got)
+	}
+}
+
+func TestClaimsKey(t *testing.T) {
+	t.Parallel()
+
+	alice := Claims{"sub": "alice", "groups": []interface{}{"admins"}}
+
+	if exp, got := alice.Key(), (Claims{"groups": []interface{}{"admins"}, "sub": "alice"}).Key(); exp != got {
+		t.Errorf("Expected equal claims to have the same key, got %q and %q", exp, got)
+	}
+
+	if alice.Key() == (Claims{"sub": "bob", "groups": []interface{}{"admins"}}).Key() {
+		t.Error("Expected different claims to have different keys")
+	}
+
+	if exp, got := "", Claims(nil).Key(); exp != got {
+		t.Errorf("Expected no key for nil claims, got %q", got)
+	}
+}
+
+func TestCheckClaimName(t *testing.T) {
+	t.Parallel()
+
+	for _, claim := range []string{"email", "signed_at", "tokens"} {
+		if err := CheckClaimName(claim); err != nil {
+			t.Errorf("Expected claim %q to be allowed, got %v", claim, err)
+		}
+	}
+
+	for _, claim := range []string{"timestamp", "Signature", "token"} {
+		if err := CheckClaimName(claim); err == nil {
+			t.Errorf("Expected claim %q to be rejected", claim)
+		}
+	}
+}
+
+func TestMiddlewareHeaders(t *testing.T) {
+	t.Parallel()
+
+	mw, err := NewMiddleware(Options{Mode: "headers", Key: testKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got http.Header
+
+	handler := mw(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Identity-Email", "mallory@example.com")
+	req.Header.Set("X-Identity-Role", "admin")
+
+	claims := Claims{
+		"email":              "alice@example.com",
+		"groups":             []interface{}{"admins", "dev"},
+		"preferred_username": "alice",
+		"email_verified":     true,
+		// claims can't replace the verification headers
+		"token":     "forged",
+		"signature": "forged",
+	}
+
+	handler.ServeHTTP(httptest.NewRecorder(), req.WithContext(NewContext(req.Context(), claims)))
+
+	exp := map[string]string{
+		"X-Identity-Email":              "alice@example.com",
+		"X-Identity-Groups":             "admins,dev",
+		"X-Identity-Preferred-Username": "alice",
+		"X-Identity-Email-Verified":     "true",
+		"X-Identity-Role":               "",
+		"X-Identity-Token":              "",
+	}
+
+	for name, value := range exp {
+		if got := got.Get(name); value != got {
+			t.Errorf("%s: expected %q, got %q", name, value, got)
+		}
+	}
+
+	err = Verify(got, testKey, time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to verify headers: %v", err)
+	}
+
+	got.Set("X-Identity-Groups", "admins,dev,ops")
+
+	err = Verify(got, testKey, time.Minute)
+	if !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("Expected modified headers to be rejected, got %v", err)
+	}
+
+	// requests without claims have the client's headers removed
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Identity-Email", "mallory@example.com")
+
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if exp, got := "", got.Get("X-Identity-Email"); exp != got {
+		t.Errorf("Expected client header to be removed, got %q", got)
+	}
+}
+
+func TestMiddlewareJWT(t *testing.T) {
+	t.Parallel()
+
+	mw, err := NewMiddleware(Options{Mode: "jwt", Key: testKey, Issuer: "proxy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var token string
+
+	handler := mw(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		token = r.Header.Get(HeaderToken)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	claims := Claims{"email": "alice@example.com", "groups": []interface{}{"admins"}}
+
+	handler.ServeHTTP(httptest.NewRecorder(), req.WithContext(NewContext(req.Context(), claims)))
+
+	parsed, err := jwt.ParseSigned(token)
+	if err != nil {
+		t.Fatalf("Failed to parse token: %v", err)
+	}
+
+	var (
+		registered jwt.Claims
+		custom     map[string]interface{}
+	)
+
+	err = parsed.Claims(testKey, &registered, &custom)
+	if err != nil {
+		t.Fatalf("Failed to verify token: %v", err)
+	}
+
+	err = registered.Validate(jwt.Expected{Issuer: "proxy", Time: time.Now()})
+	if err != nil {
+		t.Fatalf("Token claims were invalid: %v", err)
+	}
+
+	if exp, got := "alice@example.com", custom["email"]; exp != got {
+		t.Errorf("Email did not match expected: %v != %v", exp, got)
+	}
+
+	if exp, got := []interface{}{"admins"}, custom["groups"]; !reflect.DeepEqual(exp, got) {
+		t.Errorf("Groups did not match expected: %v != %v", exp, got)
+	}
+}
+
+func TestNewMiddlewareErrors(t *testing.T) {
+	t.Parallel()
+
+	_, err := NewMiddleware(Options{Mode: "headers"})
+	if err == nil {
+		t.Error("Expected a missing key to be rejected")
+	}
+
+	_, err = NewMiddleware(Options{Mode: "cookie", Key: testKey})
+	if err == nil {
+		t.Error("Expected an unknown mode to be rejected")
+	}
+}
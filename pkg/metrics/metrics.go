@@ -0,0 +1,332 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "tsnet_proxy"
+
+// Metrics holds the collectors for the proxy. All methods can be called on
+// a nil *Metrics, in which case nothing is recorded.
+type Metrics struct {
+	gatherer prometheus.Gatherer
+
+	requests          *prometheus.CounterVec
+	requestDuration   *prometheus.HistogramVec
+	inFlight          *prometheus.GaugeVec
+	dialErrors        *prometheus.CounterVec
+	dnsQueries        *prometheus.CounterVec
+	dnsDuration       *prometheus.HistogramVec
+	opaDecisions      *prometheus.CounterVec
+	opaDuration       prometheus.Histogram
+	opaShadow         *prometheus.CounterVec
+	opaShadowDuration prometheus.Histogram
+	opaMismatches     *prometheus.CounterVec
+
+	tailnetStateDesc *prometheus.Desc
+	queueDepthDesc   *prometheus.Desc
+
+	mu            sync.Mutex
+	tailnetStates func() map[string]string
+	queueDepths   func() map[string]int
+}
+
+// New creates the collectors and registers them with a new registry.
+func New() *Metrics {
+	reg := prometheus.NewRegistry()
+
+	m := &Metrics{
+		gatherer: reg,
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "requests_total",
+			Help:      "Requests handled by the proxy.",
+		}, []string{"upstream", "code", "method"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "request_duration_seconds",
+			Help:      "Time taken to handle requests.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"upstream", "code", "method"}),
+		inFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "requests_in_flight",
+			Help:      "Requests currently being handled for each upstream.",
+		}, []string{"upstream"}),
+		dialErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "upstream_dial_errors_total",
+			Help:      "Failed connections to upstreams.",
+		}, []string{"upstream", "cause"}),
+		dnsQueries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "dns_queries_total",
+			Help:      "DNS queries made by the resolver, result is success or failure.",
+		}, []string{"resolver", "result"}),
+		dnsDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "dns_query_duration_seconds",
+			Help:      "Time taken by DNS queries.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"resolver"}),
+		opaDecisions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "opa_decisions_total",
+			Help:      "OPA decisions, result is allow, deny or error.",
+		}, []string{"result"}),
+		opaDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "opa_decision_duration_seconds",
+			Help:      "Time taken to make OPA decisions.",
+			Buckets:   prometheus.DefBuckets,
+		}),
+		opaShadow: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "opa_shadow_decisions_total",
+			Help:      "OPA decisions which were not enforced, result is allow, deny or error.",
+		}, []string{"result"}),
+		opaShadowDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "opa_shadow_decision_duration_seconds",
+			Help:      "Time taken to make OPA decisions which were not enforced.",
+			Buckets:   prometheus.DefBuckets,
+		}),
+		opaMismatches: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "opa_shadow_mismatches_total",
+			Help:      "Requests where the shadow policy's result differed from the enforced result.",
+		}, []string{"upstream", "enforced", "shadow"}),
+		tailnetStateDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "tailnet_state"),
+			"The backend state of each tailnet, set to 1 for the current state.",
+			[]string{"tailnet", "state"},
+			nil,
+		),
+		queueDepthDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "concurrency_queue_depth"),
+			"Requests waiting for a concurrency slot for each upstream with a limit.",
+			[]string{"upstream"},
+			nil,
+		),
+	}
+
+	reg.MustRegister(
+		m.requests,
+		m.requestDuration,
+		m.inFlight,
+		m.dialErrors,
+		m.dnsQueries,
+		m.dnsDuration,
+		m.opaDecisions,
+		m.opaDuration,
+		m.opaShadow,
+		m.opaShadowDuration,
+		m.opaMismatches,
+		tailnetCollector{m},
+		queueCollector{m},
+	)
+
+	return m
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.gatherer, promhttp.HandlerOpts{})
+}
+
+// ObserveRequest records a request which has been handled, upstream is
+// empty when no upstream matched.
+func (m *Metrics) ObserveRequest(upstream, method string, status int, d time.Duration) {
+	if m == nil {
+		return
+	}
+
+	if upstream == "" {
+		upstream = "none"
+	}
+
+	code := strconv.Itoa(status/100) + "xx"
+
+	m.requests.WithLabelValues(upstream, code, method).Inc()
+	m.requestDuration.WithLabelValues(upstream, code, method).Observe(d.Seconds())
+}
+
+// InFlight increments the in flight gauge for the upstream, the returned
+// func decrements it again.
+func (m *Metrics) InFlight(upstream string) func() {
+	if m == nil {
+		return func() {}
+	}
+
+	g := m.inFlight.WithLabelValues(upstream)
+	g.Inc()
+
+	return g.Dec
+}
+
+// ObserveDialError records a failed connection to an upstream.
+func (m *Metrics) ObserveDialError(upstream string, err error) {
+	if m == nil || err == nil {
+		return
+	}
+
+	m.dialErrors.WithLabelValues(upstream, DialErrorCause(err)).Inc()
+}
+
+// DialErrorCause returns a short description of why a connection failed.
+func DialErrorCause(err error) string {
+	var (
+		dnsErr *net.DNSError
+		netErr net.Error
+	)
+
+	switch {
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, syscall.ECONNRESET):
+		return "reset"
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return "unreachable"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	}
+
+	return "other"
+}
+
+// ObserveDNSQuery records a query made by resolver, which is either
+// httpclient or doh.
+func (m *Metrics) ObserveDNSQuery(resolver string, d time.Duration, err error) {
+	if m == nil {
+		return
+	}
+
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+
+	m.dnsQueries.WithLabelValues(resolver, result).Inc()
+	m.dnsDuration.WithLabelValues(resolver).Observe(d.Seconds())
+}
+
+// ObserveOPADecision records a decision, result is allow, deny or error.
+func (m *Metrics) ObserveOPADecision(result string, d time.Duration) {
+	if m == nil {
+		return
+	}
+
+	m.opaDecisions.WithLabelValues(result).Inc()
+	m.opaDuration.Observe(d.Seconds())
+}
+
+// ObserveOPAShadowDecision records a decision which was not enforced,
+// result is allow, deny or error.
+func (m *Metrics) ObserveOPAShadowDecision(result string, d time.Duration) {
+	if m == nil {
+		return
+	}
+
+	m.opaShadow.WithLabelValues(result).Inc()
+	m.opaShadowDuration.Observe(d.Seconds())
+}
+
+// ObserveOPAShadowMismatch records a request where the shadow policy's
+// result differed from the enforced result.
+func (m *Metrics) ObserveOPAShadowMismatch(upstream, enforced, shadow string) {
+	if m == nil {
+		return
+	}
+
+	m.opaMismatches.WithLabelValues(upstream, enforced, shadow).Inc()
+}
+
+// SetTailnetStates sets the func used to get the state of each tailnet
+// when metrics are collected.
+func (m *Metrics) SetTailnetStates(f func() map[string]string) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.tailnetStates = f
+}
+
+// SetQueueDepths sets the func used to get the queue depth of each
+// upstream with a concurrency limit when metrics are collected.
+func (m *Metrics) SetQueueDepths(f func() map[string]int) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.queueDepths = f
+}
+
+// tailnetCollector reports the tailnet states when metrics are scraped so
+// they are always current.
+type tailnetCollector struct {
+	m *Metrics
+}
+
+func (c tailnetCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.m.tailnetStateDesc
+}
+
+func (c tailnetCollector) Collect(ch chan<- prometheus.Metric) {
+	c.m.mu.Lock()
+	f := c.m.tailnetStates
+	c.m.mu.Unlock()
+
+	if f == nil {
+		return
+	}
+
+	for tailnet, state := range f() {
+		ch <- prometheus.MustNewConstMetric(c.m.tailnetStateDesc, prometheus.GaugeValue, 1, tailnet, state)
+	}
+}
+
+// queueCollector reports the queue depths when metrics are scraped, the
+// limiters are replaced when the config is reloaded.
+type queueCollector struct {
+	m *Metrics
+}
+
+func (c queueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.m.queueDepthDesc
+}
+
+func (c queueCollector) Collect(ch chan<- prometheus.Metric) {
+	c.m.mu.Lock()
+	f := c.m.queueDepths
+	c.m.mu.Unlock()
+
+	if f == nil {
+		return
+	}
+
+	for upstream, depth := range f() {
+		ch <- prometheus.MustNewConstMetric(c.m.queueDepthDesc, prometheus.GaugeValue, float64(depth), upstream)
+	}
+}
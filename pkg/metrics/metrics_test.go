@@ -0,0 +1,121 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func scrape(t *testing.T, m *Metrics) string {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	bs, err := io.ReadAll(rec.Body)
+	if err != nil {
+		t.Fatalf("failed to read metrics: %v", err)
+	}
+
+	return string(bs)
+}
+
+func TestMetrics(t *testing.T) {
+	t.Parallel()
+
+	m := New()
+
+	m.ObserveRequest("internal", http.MethodGet, http.StatusNotFound, time.Second)
+	m.ObserveRequest("", http.MethodPost, http.StatusOK, time.Second)
+	m.ObserveDialError("internal", &net.DNSError{Err: "no such host"})
+	m.ObserveDNSQuery("doh", time.Millisecond, errors.New("failed"))
+	m.ObserveOPADecision("deny", time.Millisecond)
+	m.ObserveOPAShadowDecision("deny", time.Millisecond)
+	m.ObserveOPAShadowMismatch("internal", "allow", "deny")
+
+	done := m.InFlight("internal")
+
+	m.SetTailnetStates(func() map[string]string {
+		return map[string]string{"tsnet": "Running"}
+	})
+
+	m.SetQueueDepths(func() map[string]int {
+		return map[string]int{"internal": 3}
+	})
+
+	body := scrape(t, m)
+
+	for _, exp := range []string{
+		`tsnet_proxy_requests_total{code="4xx",method="GET",upstream="internal"} 1`,
+		`tsnet_proxy_requests_total{code="2xx",method="POST",upstream="none"} 1`,
+		`tsnet_proxy_requests_in_flight{upstream="internal"} 1`,
+		`tsnet_proxy_upstream_dial_errors_total{cause="dns",upstream="internal"} 1`,
+		`tsnet_proxy_dns_queries_total{resolver="doh",result="failure"} 1`,
+		`tsnet_proxy_opa_decisions_total{result="deny"} 1`,
+		`tsnet_proxy_opa_shadow_decisions_total{result="deny"} 1`,
+		`tsnet_proxy_opa_decision_duration_seconds_count 1`,
+		`tsnet_proxy_opa_shadow_decision_duration_seconds_count 1`,
+		`tsnet_proxy_opa_shadow_mismatches_total{enforced="allow",shadow="deny",upstream="internal"} 1`,
+		`tsnet_proxy_tailnet_state{state="Running",tailnet="tsnet"} 1`,
+		`tsnet_proxy_concurrency_queue_depth{upstream="internal"} 3`,
+	} {
+		if !strings.Contains(body, exp) {
+			t.Errorf("expected metrics to contain %q", exp)
+		}
+	}
+
+	done()
+
+	if exp := `tsnet_proxy_requests_in_flight{upstream="internal"} 0`; !strings.Contains(scrape(t, m), exp) {
+		t.Errorf("expected metrics to contain %q", exp)
+	}
+}
+
+func TestNilMetrics(t *testing.T) {
+	t.Parallel()
+
+	var m *Metrics
+
+	m.ObserveRequest("internal", http.MethodGet, http.StatusOK, time.Second)
+	m.ObserveDialError("internal", errors.New("failed"))
+	m.ObserveDNSQuery("doh", time.Second, nil)
+	m.ObserveOPADecision("allow", time.Second)
+	m.ObserveOPAShadowDecision("allow", time.Second)
+	m.ObserveOPAShadowMismatch("internal", "allow", "deny")
+	m.SetTailnetStates(nil)
+	m.SetQueueDepths(nil)
+	m.InFlight("internal")()
+}
+
+func TestDialErrorCause(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		err error
+		exp string
+	}{
+		"dns":      {err: fmt.Errorf("lookup: %w", &net.DNSError{}), exp: "dns"},
+		"refused":  {err: &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, exp: "refused"},
+		"timeout":  {err: context.DeadlineExceeded, exp: "timeout"},
+		"canceled": {err: context.Canceled, exp: "canceled"},
+		"other":    {err: errors.New("failed"), exp: "other"},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			if got := DialErrorCause(test.err); test.exp != got {
+				t.Fatalf("expected %q, got %q", test.exp, got)
+			}
+		})
+	}
+}
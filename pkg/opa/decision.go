@@ -0,0 +1,221 @@
+package opa
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/charlieegan3/tool-tsnet-proxy/pkg/identity"
+)
+
+// protectedUpstreamHeaders can't be set by decisions, upstreams trust them
+// to identify the user. Names ending in "-" are prefixes.
+var protectedUpstreamHeaders = []string{"Authorization", "Host", identity.HeaderPrefix, "Tailscale-"}
+
+// Decision is the result of a policy for a request. Policies can return a
+// boolean, which only sets Allow, or an object with the fields below.
+type Decision struct {
+	Allow bool
+
+	// Status, Body and Redirect are used when the request is denied,
+	// Status defaults to 403, or 302 for redirects
+	Status   int
+	Body     string
+	Redirect string
+
+	// Headers are added to the response, UpstreamHeaders replace those
+	// in the request sent to the upstream when it's allowed, they can't
+	// replace Authorization, Host or identity headers
+	Headers         http.Header
+	UpstreamHeaders http.Header
+}
+
+// DecisionFromResult parses the result of a policy, it returns an error if
+// the result isn't a boolean or a valid object.
+func DecisionFromResult(result any) (*Decision, error) {
+	switch v := result.(type) {
+	case bool:
+		return &Decision{Allow: v}, nil
+	case map[string]any:
+		return decisionFromObject(v)
+	default:
+		return nil, fmt.Errorf("decision must be a boolean or an object, got %T", result)
+	}
+}
+
+func decisionFromObject(obj map[string]any) (*Decision, error) {
+	d := &Decision{}
+
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		var err error
+
+		switch v := obj[k]; k {
+		case "allow":
+			var ok bool
+			if d.Allow, ok = v.(bool); !ok {
+				err = fmt.Errorf("must be a boolean, got %T", v)
+			}
+		case "status":
+			d.Status, err = decisionStatus(v)
+		case "body":
+			d.Body, err = decisionString(v)
+		case "redirect":
+			d.Redirect, err = decisionString(v)
+		case "headers":
+			d.Headers, err = decisionHeaders(v)
+		case "upstream_headers":
+			d.UpstreamHeaders, err = decisionHeaders(v)
+			if err == nil {
+				err = checkUpstreamHeaders(d.UpstreamHeaders)
+			}
+		default:
+			err = errors.New("unknown field")
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("decision %s: %w", k, err)
+		}
+	}
+
+	return d, nil
+}
+
+func decisionStatus(v any) (int, error) {
+	var f float64
+
+	switch n := v.(type) {
+	case json.Number:
+		var err error
+
+		f, err = n.Float64()
+		if err != nil {
+			return 0, fmt.Errorf("must be a number: %w", err)
+		}
+	case float64:
+		f = n
+	case int:
+		f = float64(n)
+	default:
+		return 0, fmt.Errorf("must be a number, got %T", v)
+	}
+
+	if f != math.Trunc(f) || f < 100 || f > 599 {
+		return 0, fmt.Errorf("%v is not a valid status code", v)
+	}
+
+	return int(f), nil
+}
+
+func decisionString(v any) (string, error) {
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("must be a string, got %T", v)
+	}
+
+	return s, nil
+}
+
+// decisionHeaders parses an object of header names to a string or a list
+// of strings.
+func decisionHeaders(v any) (http.Header, error) {
+	obj, ok := v.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("must be an object, got %T", v)
+	}
+
+	h := make(http.Header, len(obj))
+
+	for name, value := range obj {
+		switch vs := value.(type) {
+		case string:
+			h.Add(name, vs)
+		case []any:
+			for _, item := range vs {
+				s, ok := item.(string)
+				if !ok {
+					return nil, fmt.Errorf("%s: values must be strings, got %T", name, item)
+				}
+
+				h.Add(name, s)
+			}
+		default:
+			return nil, fmt.Errorf("%s: must be a string or list of strings, got %T", name, value)
+		}
+	}
+
+	return h, nil
+}
+
+func checkUpstreamHeaders(h http.Header) error {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		for _, protected := range protectedUpstreamHeaders {
+			if name == protected || (strings.HasSuffix(protected, "-") && strings.HasPrefix(name, protected)) {
+				return fmt.Errorf("%s: can't be set for the upstream", name)
+			}
+		}
+	}
+
+	return nil
+}
+
+type upstreamHeadersContextKey struct{}
+
+// NewUpstreamHeadersContext returns a copy of ctx with the headers set for
+// the upstream by a decision, added to those set by earlier decisions.
+func NewUpstreamHeadersContext(ctx context.Context, h http.Header) context.Context {
+	merged := UpstreamHeadersFromContext(ctx).Clone()
+	if merged == nil {
+		merged = make(http.Header, len(h))
+	}
+
+	for name, values := range h {
+		merged[name] = values
+	}
+
+	return context.WithValue(ctx, upstreamHeadersContextKey{}, merged)
+}
+
+// UpstreamHeadersFromContext returns the headers decisions set for the
+// upstream, if any.
+func UpstreamHeadersFromContext(ctx context.Context) http.Header {
+	h, _ := ctx.Value(upstreamHeadersContextKey{}).(http.Header)
+
+	return h
+}
+
+// UpstreamHeadersKey identifies the headers decisions set for the
+// upstream, for keeping responses to requests with different headers
+// apart. It's empty if no headers were set.
+func UpstreamHeadersKey(ctx context.Context) string {
+	h := UpstreamHeadersFromContext(ctx)
+	if len(h) == 0 {
+		return ""
+	}
+
+	// maps are encoded with sorted keys
+	b, err := json.Marshal(h)
+	if err != nil {
+		return ""
+	}
+
+	return string(b)
+}
@@ -0,0 +1,119 @@
+package opa
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestUpstreamHeadersKey(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	if exp, got := "", UpstreamHeadersKey(ctx); exp != got {
+		t.Errorf("Expected no key without headers, got %q", got)
+	}
+
+	ctx = NewUpstreamHeadersContext(ctx, http.Header{"X-User": {"alice"}})
+	ctx = NewUpstreamHeadersContext(ctx, http.Header{"X-Role": {"admin"}})
+
+	if exp, got := `{"X-Role":["admin"],"X-User":["alice"]}`, UpstreamHeadersKey(ctx); exp != got {
+		t.Errorf("Expected key %q, got %q", exp, got)
+	}
+}
+
+func TestDecisionFromResult(t *testing.T) {
+	t.Parallel()
+
+	testCases := map[string]struct {
+		result any
+		exp    *Decision
+		expErr string
+	}{
+		"boolean": {
+			result: true,
+			exp:    &Decision{Allow: true},
+		},
+		"object": {
+			result: map[string]any{
+				"allow":    false,
+				"status":   json.Number("401"),
+				"body":     "login required",
+				"redirect": "https://login.example.com",
+				"headers": map[string]any{
+					"www-authenticate": "Bearer",
+					"x-reason":         []any{"a", "b"},
+				},
+				"upstream_headers": map[string]any{
+					"x-user": "alice",
+				},
+			},
+			exp: &Decision{
+				Status:   http.StatusUnauthorized,
+				Body:     "login required",
+				Redirect: "https://login.example.com",
+				Headers: http.Header{
+					"Www-Authenticate": {"Bearer"},
+					"X-Reason":         {"a", "b"},
+				},
+				UpstreamHeaders: http.Header{
+					"X-User": {"alice"},
+				},
+			},
+		},
+		"empty object": {
+			result: map[string]any{},
+			exp:    &Decision{},
+		},
+		"string": {
+			result: "allow",
+			expErr: "decision must be a boolean or an object, got string",
+		},
+		"unknown field": {
+			result: map[string]any{"allowed": true},
+			expErr: "decision allowed: unknown field",
+		},
+		"invalid status": {
+			result: map[string]any{"status": json.Number("42")},
+			expErr: "decision status: 42 is not a valid status code",
+		},
+		"protected upstream header": {
+			result: map[string]any{"upstream_headers": map[string]any{"authorization": "Bearer admin"}},
+			expErr: "decision upstream_headers: Authorization: can't be set for the upstream",
+		},
+		"identity upstream header": {
+			result: map[string]any{"upstream_headers": map[string]any{"x-user": "alice", "x-identity-email": "admin@example.com"}},
+			expErr: "decision upstream_headers: X-Identity-Email: can't be set for the upstream",
+		},
+		"invalid header": {
+			result: map[string]any{"headers": map[string]any{"x-count": json.Number("1")}},
+			expErr: "decision headers: x-count: must be a string or list of strings, got json.Number",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := DecisionFromResult(tc.result)
+			if tc.expErr != "" {
+				if err == nil || err.Error() != tc.expErr {
+					t.Fatalf("Expected error %q, got %v", tc.expErr, err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if !reflect.DeepEqual(tc.exp, got) {
+				t.Fatalf("Decision did not match expected: %+v != %+v", tc.exp, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,391 @@
+package opa
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaskedValue replaces masked values in decision log input.
+const MaskedValue = "REDACTED"
+
+const (
+	defaultFlushInterval = 5 * time.Second
+	maxBatchSize         = 100
+	maxPendingEntries    = 10000
+)
+
+// DefaultMask are the input paths masked when no mask is configured.
+var DefaultMask = []string{
+	"headers.Authorization",
+	"headers.Proxy-Authorization",
+	"headers.Cookie",
+	"headers.X-Identity-Token",
+	"headers.X-Identity-Signature",
+	"cookies",
+}
+
+// maskDepths are the input keys which can be masked and how many path
+// segments can be used under them, -1 is any number. This includes the
+// keys added to the input by the proxy's OPA middleware.
+var maskDepths = map[string]int{
+	"method":         0,
+	"host":           0,
+	"proto":          0,
+	"url":            0,
+	"request_uri":    0,
+	"remote_addr":    0,
+	"content_length": 0,
+	"path":           0,
+	"path_segments":  0,
+	"upstream":       0,
+	"request_id":     0,
+	"headers":        1,
+	"query":          1,
+	"cookies":        1,
+	"time":           1,
+	"tls":            -1,
+	"body":           -1,
+	"tailscale":      -1,
+	"identity":       -1,
+}
+
+// ParseMaskPath splits a dotted mask path, it returns an error if the path
+// can never match the input. Header names are canonicalized to match the
+// request's headers.
+func ParseMaskPath(path string) ([]string, error) {
+	segments := strings.Split(path, ".")
+
+	for _, s := range segments {
+		if s == "" {
+			return nil, fmt.Errorf("invalid path %q", path)
+		}
+	}
+
+	depth, ok := maskDepths[segments[0]]
+	if !ok {
+		return nil, fmt.Errorf("%q is not an input key", segments[0])
+	}
+
+	if depth >= 0 && len(segments)-1 > depth {
+		return nil, fmt.Errorf("%q can't be masked below %q", path, strings.Join(segments[:depth+1], "."))
+	}
+
+	if segments[0] == "headers" && len(segments) == 2 {
+		segments[1] = http.CanonicalHeaderKey(segments[1])
+	}
+
+	return segments, nil
+}
+
+// DecisionLogEntry records a decision and what it was based on, Shadow is
+// set for decisions which were not enforced.
+type DecisionLogEntry struct {
+	DecisionID     string      `json:"decision_id"`
+	RequestID      string      `json:"request_id,omitempty"`
+	Timestamp      time.Time   `json:"timestamp"`
+	Path           string      `json:"path"`
+	Shadow         bool        `json:"shadow,omitempty"`
+	Input          interface{} `json:"input"`
+	Result         interface{} `json:"result"`
+	BundleRevision string      `json:"bundle_revision,omitempty"`
+	Error          string      `json:"error,omitempty"`
+}
+
+type DecisionLogOptions struct {
+	// Output is stdout, file or http
+	Output string
+	// Path is the file entries are appended to
+	Path string
+	// URL receives batches of entries as a JSON array in a POST request
+	URL string
+	// FlushInterval is how often entries are sent to the URL, it defaults
+	// to 5 seconds
+	FlushInterval time.Duration
+	Client        *http.Client
+
+	// Mask are dotted paths in the input which are replaced before entries
+	// are written, such as headers.Authorization, see ParseMaskPath. It
+	// defaults to DefaultMask.
+	Mask []string
+}
+
+// DecisionLogger writes decision log entries with masked input.
+type DecisionLogger struct {
+	opts DecisionLogOptions
+	mask [][]string
+
+	mu sync.Mutex
+	w  io.Writer
+	f  *os.File
+
+	pending chan DecisionLogEntry
+	flush   chan chan struct{}
+	done    chan struct{}
+	closed  bool
+}
+
+func NewDecisionLogger(opts DecisionLogOptions) (*DecisionLogger, error) {
+	if opts.Mask == nil {
+		opts.Mask = DefaultMask
+	}
+
+	l := &DecisionLogger{opts: opts}
+
+	for _, path := range opts.Mask {
+		segments, err := ParseMaskPath(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse mask path: %w", err)
+		}
+
+		l.mask = append(l.mask, segments)
+	}
+
+	switch opts.Output {
+	case "", "stdout":
+		l.w = os.Stdout
+	case "file":
+		f, err := os.OpenFile(opts.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open decision log: %w", err)
+		}
+
+		l.w = f
+		l.f = f
+	case "http":
+		if l.opts.Client == nil {
+			l.opts.Client = &http.Client{Timeout: 10 * time.Second}
+		}
+
+		if l.opts.FlushInterval == 0 {
+			l.opts.FlushInterval = defaultFlushInterval
+		}
+
+		l.pending = make(chan DecisionLogEntry, maxPendingEntries)
+		l.flush = make(chan chan struct{})
+		l.done = make(chan struct{})
+
+		go l.upload()
+	default:
+		return nil, fmt.Errorf("unknown decision log output %q", opts.Output)
+	}
+
+	return l, nil
+}
+
+// Log masks the entry's input and writes the entry, entries for the URL
+// are dropped if they can't be sent fast enough.
+func (l *DecisionLogger) Log(ctx context.Context, entry DecisionLogEntry) {
+	input, err := l.maskInput(entry.Input)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to mask decision log input", "error", err)
+
+		return
+	}
+
+	entry.Input = input
+
+	if l.pending != nil {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		// requests can outlive the handler which closed the logger
+		if l.closed {
+			return
+		}
+
+		select {
+		case l.pending <- entry:
+		default:
+			slog.WarnContext(ctx, "decision log is full, dropping entry", "decision_id", entry.DecisionID)
+		}
+
+		return
+	}
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to encode decision log entry", "error", err)
+
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	_, err = l.w.Write(append(b, '\n'))
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to write decision log entry", "error", err)
+	}
+}
+
+// Flush sends the pending entries to the URL.
+func (l *DecisionLogger) Flush() {
+	if l.flush == nil {
+		return
+	}
+
+	flushed := make(chan struct{})
+
+	select {
+	case l.flush <- flushed:
+		<-flushed
+	case <-l.done:
+	}
+}
+
+// Close sends any pending entries and closes the file.
+func (l *DecisionLogger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return nil
+	}
+
+	l.closed = true
+
+	if l.done != nil {
+		close(l.pending)
+		<-l.done
+	}
+
+	if l.f != nil {
+		//nolint:wrapcheck
+		return l.f.Close()
+	}
+
+	return nil
+}
+
+// maskInput returns a copy of the input with masked values replaced, the
+// input shares maps with the request so it's never changed.
+func (l *DecisionLogger) maskInput(input interface{}) (interface{}, error) {
+	b, err := json.Marshal(input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode input: %w", err)
+	}
+
+	var masked interface{}
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+
+	err = dec.Decode(&masked)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode input: %w", err)
+	}
+
+	for _, path := range l.mask {
+		maskPath(masked, path)
+	}
+
+	return masked, nil
+}
+
+func maskPath(v interface{}, path []string) {
+	obj, ok := v.(map[string]interface{})
+	if !ok || len(path) == 0 {
+		return
+	}
+
+	child, ok := obj[path[0]]
+	if !ok {
+		return
+	}
+
+	if len(path) == 1 {
+		obj[path[0]] = MaskedValue
+
+		return
+	}
+
+	maskPath(child, path[1:])
+}
+
+func (l *DecisionLogger) upload() {
+	defer close(l.done)
+
+	ticker := time.NewTicker(l.opts.FlushInterval)
+	defer ticker.Stop()
+
+	var batch []DecisionLogEntry
+
+	send := func() {
+		if len(batch) == 0 {
+			return
+		}
+
+		err := l.post(batch)
+		if err != nil {
+			slog.Error("failed to send decision log entries", "entries", len(batch), "error", err)
+		}
+
+		batch = nil
+	}
+
+	for {
+		select {
+		case entry, ok := <-l.pending:
+			if !ok {
+				send()
+
+				return
+			}
+
+			batch = append(batch, entry)
+
+			if len(batch) >= maxBatchSize {
+				send()
+			}
+		case <-ticker.C:
+			send()
+		case flushed := <-l.flush:
+			// take what's already been logged before sending
+			for len(l.pending) > 0 {
+				batch = append(batch, <-l.pending)
+			}
+
+			send()
+			close(flushed)
+		}
+	}
+}
+
+func (l *DecisionLogger) post(entries []DecisionLogEntry) error {
+	b, err := json.Marshal(entries)
+	if err != nil {
+		return fmt.Errorf("failed to encode entries: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, l.opts.URL, bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := l.opts.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		return errors.New("unexpected status " + resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,240 @@
+package opa
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	opatest "github.com/charlieegan3/tool-tsnet-proxy/pkg/test/opa"
+)
+
+func TestDecisionLoggerMask(t *testing.T) {
+	t.Parallel()
+
+	input := map[string]interface{}{
+		"headers": map[string][]string{
+			"Authorization":    {"Bearer secret"},
+			"X-Identity-Token": {"secret"},
+			"Accept":           {"*/*"},
+		},
+		"cookies": map[string]string{"session": "secret"},
+		"body":    map[string]interface{}{"password": "secret", "user": "alice"},
+	}
+
+	testCases := map[string]struct {
+		mask []string
+		exp  map[string]interface{}
+	}{
+		"default": {
+			exp: map[string]interface{}{
+				"headers": map[string]interface{}{
+					"Authorization":    MaskedValue,
+					"X-Identity-Token": MaskedValue,
+					"Accept":           []interface{}{"*/*"},
+				},
+				"cookies": MaskedValue,
+				"body":    map[string]interface{}{"password": "secret", "user": "alice"},
+			},
+		},
+		"configured": {
+			mask: []string{"body.password", "headers.Missing", "headers.x-identity-token"},
+			exp: map[string]interface{}{
+				"headers": map[string]interface{}{
+					"Authorization":    []interface{}{"Bearer secret"},
+					"X-Identity-Token": MaskedValue,
+					"Accept":           []interface{}{"*/*"},
+				},
+				"cookies": map[string]interface{}{"session": "secret"},
+				"body":    map[string]interface{}{"password": MaskedValue, "user": "alice"},
+			},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			l, err := NewDecisionLogger(DecisionLogOptions{Mask: tc.mask})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := l.maskInput(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(tc.exp, got) {
+				t.Errorf("Masked input did not match expected: %v != %v", tc.exp, got)
+			}
+		})
+	}
+
+	// the input is shared with the request and must not change
+	if exp, got := "Bearer secret", input["headers"].(map[string][]string)["Authorization"][0]; exp != got {
+		t.Errorf("Expected input to be unchanged, got %q", got)
+	}
+}
+
+func TestParseMaskPath(t *testing.T) {
+	t.Parallel()
+
+	testCases := map[string]struct {
+		path   string
+		exp    []string
+		expErr string
+	}{
+		"header": {
+			path: "headers.proxy-authorization",
+			exp:  []string{"headers", "Proxy-Authorization"},
+		},
+		"object": {
+			path: "body.user.password",
+			exp:  []string{"body", "user", "password"},
+		},
+		"empty segment": {
+			path:   "headers..Authorization",
+			expErr: `invalid path "headers..Authorization"`,
+		},
+		"unknown key": {
+			path:   "Headers.Authorization",
+			expErr: `"Headers" is not an input key`,
+		},
+		"below header": {
+			path:   "headers.Authorization.0",
+			expErr: `"headers.Authorization.0" can't be masked below "headers.Authorization"`,
+		},
+		"below value": {
+			path:   "method.name",
+			expErr: `"method.name" can't be masked below "method"`,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := ParseMaskPath(tc.path)
+			if tc.expErr != "" {
+				if err == nil || err.Error() != tc.expErr {
+					t.Fatalf("Expected error %q, got %v", tc.expErr, err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(tc.exp, got) {
+				t.Errorf("Expected %v, got %v", tc.exp, got)
+			}
+		})
+	}
+}
+
+func TestDecisionLoggerFile(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "decisions.log")
+
+	l, err := NewDecisionLogger(DecisionLogOptions{Output: "file", Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"1", "2"} {
+		l.Log(context.Background(), DecisionLogEntry{
+			DecisionID: id,
+			Input:      map[string]interface{}{"method": "GET"},
+			Result:     true,
+		})
+	}
+
+	err = l.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var ids []string
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry DecisionLogEntry
+
+		err := json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			t.Fatalf("Failed to decode entry: %v", err)
+		}
+
+		ids = append(ids, entry.DecisionID)
+	}
+
+	if exp, got := []string{"1", "2"}, ids; !reflect.DeepEqual(exp, got) {
+		t.Errorf("Decision IDs did not match expected: %v != %v", exp, got)
+	}
+}
+
+func TestDecisionLoggerHTTP(t *testing.T) {
+	t.Parallel()
+
+	server, logs, err := opatest.NewBundleServerWithLogs(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	l, err := NewDecisionLogger(DecisionLogOptions{Output: "http", URL: server.URL + "/logs"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	l.Log(context.Background(), DecisionLogEntry{
+		DecisionID: "1",
+		RequestID:  "abc",
+		Input: map[string]interface{}{
+			"headers": map[string][]string{"Cookie": {"session=secret"}},
+		},
+		Result:         false,
+		BundleRevision: "rev",
+	})
+
+	l.Flush()
+
+	entries := logs.Entries()
+
+	if exp, got := 1, len(entries); exp != got {
+		t.Fatalf("Expected %d entries, got %d", exp, got)
+	}
+
+	exp := map[string]interface{}{
+		"decision_id":     "1",
+		"request_id":      "abc",
+		"path":            "",
+		"timestamp":       "0001-01-01T00:00:00Z",
+		"input":           map[string]interface{}{"headers": map[string]interface{}{"Cookie": MaskedValue}},
+		"result":          false,
+		"bundle_revision": "rev",
+	}
+
+	if got := entries[0]; !reflect.DeepEqual(exp, got) {
+		t.Errorf("Entry did not match expected: %v != %v", exp, got)
+	}
+
+	_, err = NewDecisionLogger(DecisionLogOptions{Output: "kafka"})
+	if err == nil {
+		t.Error("Expected an unknown output to be rejected")
+	}
+}
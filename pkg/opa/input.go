@@ -1,9 +1,20 @@
 package opa
 
-import "net/http"
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
 
 func InputFromHTTPRequest(r *http.Request) map[string]interface{} {
-	return map[string]interface{}{
+	input := map[string]interface{}{
 		"method":         r.Method,
 		"host":           r.Host,
 		"proto":          r.Proto,
@@ -12,5 +23,186 @@ func InputFromHTTPRequest(r *http.Request) map[string]interface{} {
 		"remote_addr":    r.RemoteAddr,
 		"content_length": r.ContentLength,
 		"headers":        r.Header,
+		"path":           r.URL.Path,
+		"path_segments":  pathSegments(r.URL.Path),
+		"query":          map[string][]string(r.URL.Query()),
+		"cookies":        cookies(r),
 	}
+
+	if r.TLS != nil {
+		input["tls"] = tlsInput(r.TLS)
+	}
+
+	return input
+}
+
+// InputOptions are used to build input with more than the request.
+type InputOptions struct {
+	// Upstream is the name of the upstream matched for the request
+	Upstream string
+	// Time is when the request is being authorized, it defaults to now
+	Time time.Time
+	// MaxBodyBytes enables parsing JSON and form bodies of up to this
+	// size, larger bodies are not parsed
+	MaxBodyBytes int64
+}
+
+// NewInput returns the input for a request, the request body is replaced
+// so that it can still be read if it's parsed.
+func NewInput(r *http.Request, opts InputOptions) (map[string]interface{}, error) {
+	input := InputFromHTTPRequest(r)
+
+	if opts.Upstream != "" {
+		input["upstream"] = opts.Upstream
+	}
+
+	t := opts.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+
+	input["time"] = map[string]interface{}{
+		"rfc3339": t.Format(time.RFC3339),
+		"unix":    t.Unix(),
+		"hour":    t.Hour(),
+		"minute":  t.Minute(),
+		"weekday": t.Weekday().String(),
+	}
+
+	if opts.MaxBodyBytes > 0 {
+		body, ok, err := parseBody(r, opts.MaxBodyBytes)
+		if err != nil {
+			return nil, err
+		}
+
+		if ok {
+			input["body"] = body
+		}
+	}
+
+	return input, nil
+}
+
+func pathSegments(path string) []string {
+	segments := []string{}
+
+	for _, s := range strings.Split(path, "/") {
+		if s != "" {
+			segments = append(segments, s)
+		}
+	}
+
+	return segments
+}
+
+// cookies returns the first value of each cookie by name.
+func cookies(r *http.Request) map[string]string {
+	c := make(map[string]string)
+
+	for _, cookie := range r.Cookies() {
+		if _, ok := c[cookie.Name]; !ok {
+			c[cookie.Name] = cookie.Value
+		}
+	}
+
+	return c
+}
+
+func tlsInput(state *tls.ConnectionState) map[string]interface{} {
+	input := map[string]interface{}{
+		"version":     tls.VersionName(state.Version),
+		"server_name": state.ServerName,
+	}
+
+	if len(state.PeerCertificates) == 0 {
+		return input
+	}
+
+	cert := state.PeerCertificates[0]
+
+	uris := make([]string, 0, len(cert.URIs))
+	for _, u := range cert.URIs {
+		uris = append(uris, u.String())
+	}
+
+	ips := make([]string, 0, len(cert.IPAddresses))
+	for _, ip := range cert.IPAddresses {
+		ips = append(ips, ip.String())
+	}
+
+	input["client_certificate"] = map[string]interface{}{
+		"subject":         cert.Subject.String(),
+		"common_name":     cert.Subject.CommonName,
+		"issuer":          cert.Issuer.String(),
+		"serial_number":   cert.SerialNumber.String(),
+		"dns_names":       nonNil(cert.DNSNames),
+		"email_addresses": nonNil(cert.EmailAddresses),
+		"uris":            uris,
+		"ip_addresses":    ips,
+	}
+
+	return input
+}
+
+func nonNil(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+
+	return s
+}
+
+// parseBody parses JSON and form bodies of up to max bytes, ok is false if
+// the body isn't parsed. What was read is put back in front of the rest of
+// the body.
+func parseBody(r *http.Request, maxBytes int64) (body interface{}, ok bool, err error) {
+	if r.Body == nil || r.Body == http.NoBody || r.ContentLength > maxBytes {
+		return nil, false, nil
+	}
+
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, false, nil //nolint:nilerr // bodies without a valid type aren't parsed
+	}
+
+	isJSON := mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+	isForm := mediaType == "application/x-www-form-urlencoded"
+
+	if !isJSON && !isForm {
+		return nil, false, nil
+	}
+
+	buf, err := io.ReadAll(io.LimitReader(r.Body, maxBytes+1))
+
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(buf), r.Body), r.Body}
+
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read body: %w", err)
+	}
+
+	if int64(len(buf)) > maxBytes {
+		return nil, false, nil
+	}
+
+	if isForm {
+		values, err := url.ParseQuery(string(buf))
+		if err != nil {
+			return nil, false, nil //nolint:nilerr // invalid forms are left for the upstream
+		}
+
+		return map[string][]string(values), true, nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.UseNumber()
+
+	err = dec.Decode(&body)
+	if err != nil {
+		return nil, false, nil //nolint:nilerr // invalid JSON is left for the upstream
+	}
+
+	return body, true, nil
 }
@@ -1,10 +1,18 @@
 package opa
 
 import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"io"
+	"math/big"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestInputFromHTTPRequest(t *testing.T) {
@@ -14,14 +22,16 @@ func TestInputFromHTTPRequest(t *testing.T) {
 		Method: http.MethodGet,
 		Proto:  "HTTP/1.1",
 		URL: &url.URL{
-			Path: "/example_path",
+			Path:     "/example_path/items",
+			RawQuery: "page=2&tag=a&tag=b",
 		},
 		Host: "example.com",
 		Header: http.Header{
 			"Host":     {"example.com"},
 			"X-FooBar": {"wow"},
+			"Cookie":   {"session=abc; theme=dark"},
 		},
-		RequestURI:    "/example_path",
+		RequestURI:    "/example_path/items?page=2&tag=a&tag=b",
 		RemoteAddr:    "127.0.0.1:1234",
 		ContentLength: 100000,
 	}
@@ -31,13 +41,24 @@ func TestInputFromHTTPRequest(t *testing.T) {
 		"method":         http.MethodGet,
 		"host":           "example.com",
 		"proto":          "HTTP/1.1",
-		"url":            "/example_path",
-		"request_uri":    "/example_path",
+		"url":            "/example_path/items?page=2&tag=a&tag=b",
+		"request_uri":    "/example_path/items?page=2&tag=a&tag=b",
 		"remote_addr":    "127.0.0.1:1234",
 		"content_length": int64(100000),
 		"headers": http.Header{
 			"Host":     {"example.com"},
 			"X-FooBar": {"wow"},
+			"Cookie":   {"session=abc; theme=dark"},
+		},
+		"path":          "/example_path/items",
+		"path_segments": []string{"example_path", "items"},
+		"query": map[string][]string{
+			"page": {"2"},
+			"tag":  {"a", "b"},
+		},
+		"cookies": map[string]string{
+			"session": "abc",
+			"theme":   "dark",
 		},
 	}
 
@@ -59,3 +80,149 @@ func TestInputFromHTTPRequest(t *testing.T) {
 		}
 	}
 }
+
+func TestNewInput(t *testing.T) {
+	t.Parallel()
+
+	req := httptest.NewRequest(http.MethodPost, "https://example.com/items", strings.NewReader(`{"name":"a","count":2}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.TLS.PeerCertificates = []*x509.Certificate{
+		{
+			Subject:      pkix.Name{CommonName: "client", Organization: []string{"Example"}},
+			Issuer:       pkix.Name{CommonName: "ca"},
+			SerialNumber: big.NewInt(42),
+			DNSNames:     []string{"client.example.com"},
+			URIs:         []*url.URL{{Scheme: "spiffe", Host: "example.com", Path: "/client"}},
+		},
+	}
+
+	now := time.Date(2024, 7, 1, 9, 30, 0, 0, time.UTC)
+
+	input, err := NewInput(req, InputOptions{
+		Upstream:     "app",
+		Time:         now,
+		MaxBodyBytes: 1024,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create input: %v", err)
+	}
+
+	if exp, got := "app", input["upstream"]; exp != got {
+		t.Errorf("Upstream did not match expected: %v != %v", exp, got)
+	}
+
+	expTime := map[string]interface{}{
+		"rfc3339": "2024-07-01T09:30:00Z",
+		"unix":    now.Unix(),
+		"hour":    9,
+		"minute":  30,
+		"weekday": "Monday",
+	}
+	if exp, got := expTime, input["time"]; !reflect.DeepEqual(exp, got) {
+		t.Errorf("Time did not match expected: %v != %v", exp, got)
+	}
+
+	expBody := map[string]interface{}{"name": "a", "count": json.Number("2")}
+	if exp, got := expBody, input["body"]; !reflect.DeepEqual(exp, got) {
+		t.Errorf("Body did not match expected: %v != %v", exp, got)
+	}
+
+	expCert := map[string]interface{}{
+		"subject":         "CN=client,O=Example",
+		"common_name":     "client",
+		"issuer":          "CN=ca",
+		"serial_number":   "42",
+		"dns_names":       []string{"client.example.com"},
+		"email_addresses": []string{},
+		"uris":            []string{"spiffe://example.com/client"},
+		"ip_addresses":    []string{},
+	}
+
+	tlsInput, _ := input["tls"].(map[string]interface{})
+	if exp, got := expCert, tlsInput["client_certificate"]; !reflect.DeepEqual(exp, got) {
+		t.Errorf("Client certificate did not match expected: %v != %v", exp, got)
+	}
+
+	// the body can still be read by the upstream
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exp, got := `{"name":"a","count":2}`, string(body); exp != got {
+		t.Errorf("Body was not restored: %q != %q", exp, got)
+	}
+}
+
+func TestNewInputBody(t *testing.T) {
+	t.Parallel()
+
+	testCases := map[string]struct {
+		contentType string
+		body        string
+		maxBytes    int64
+		exp         interface{}
+	}{
+		"form": {
+			contentType: "application/x-www-form-urlencoded",
+			body:        "a=1&b=2&b=3",
+			maxBytes:    1024,
+			exp:         map[string][]string{"a": {"1"}, "b": {"2", "3"}},
+		},
+		"json suffix": {
+			contentType: "application/vnd.api+json; charset=utf-8",
+			body:        `["a"]`,
+			maxBytes:    1024,
+			exp:         []interface{}{"a"},
+		},
+		"too large": {
+			contentType: "application/json",
+			body:        `{"name":"a"}`,
+			maxBytes:    4,
+		},
+		"invalid json": {
+			contentType: "application/json",
+			body:        `{"name":`,
+			maxBytes:    1024,
+		},
+		"other type": {
+			contentType: "text/plain",
+			body:        "hello",
+			maxBytes:    1024,
+		},
+		"disabled": {
+			contentType: "application/json",
+			body:        `{"name":"a"}`,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", tc.contentType)
+
+			// the length isn't always known up front
+			req.ContentLength = -1
+
+			input, err := NewInput(req, InputOptions{MaxBodyBytes: tc.maxBytes})
+			if err != nil {
+				t.Fatalf("Failed to create input: %v", err)
+			}
+
+			if exp, got := tc.exp, input["body"]; !reflect.DeepEqual(exp, got) {
+				t.Errorf("Body did not match expected: %v != %v", exp, got)
+			}
+
+			body, err := io.ReadAll(req.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if exp, got := tc.body, string(body); exp != got {
+				t.Errorf("Body was not restored: %q != %q", exp, got)
+			}
+		})
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"net/url"
+	"path/filepath"
 	"strings"
 
 	"github.com/open-policy-agent/opa/logging"
@@ -14,12 +16,23 @@ import (
 type InstanceOptions struct {
 	BundleServerAddr string
 	BundlePath       string
-	Logger           logging.Logger
+	// BundleFile is a local .tar.gz bundle or a directory of .rego and
+	// data.json files, it's loaded instead of a bundle from a server
+	BundleFile string
+	Logger     logging.Logger
+
+	// Ready, if set, is closed once the bundle has been activated and
+	// NewInstance returns without waiting for it
+	Ready chan struct{}
 }
 
+// BundleName is the name of the bundle loaded by instances, as used in
+// the provenance of decisions.
+const BundleName = "main"
+
 func NewInstance(ctx context.Context, opts InstanceOptions) (*sdk.OPA, error) {
 	cfg := struct {
-		Services map[string]map[string]interface{} `yaml:"services"`
+		Services map[string]map[string]interface{} `yaml:"services,omitempty"`
 		Bundles  map[string]map[string]interface{} `yaml:"bundles"`
 	}{
 		Services: map[string]map[string]interface{}{
@@ -28,13 +41,25 @@ func NewInstance(ctx context.Context, opts InstanceOptions) (*sdk.OPA, error) {
 			},
 		},
 		Bundles: map[string]map[string]interface{}{
-			"main": {
+			BundleName: {
 				"service":  "main",
 				"resource": "/" + strings.TrimPrefix(opts.BundlePath, "/"),
 			},
 		},
 	}
 
+	if opts.BundleFile != "" {
+		path, err := filepath.Abs(opts.BundleFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find bundle file: %w", err)
+		}
+
+		cfg.Services = nil
+		cfg.Bundles[BundleName] = map[string]interface{}{
+			"resource": (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String(),
+		}
+	}
+
 	cfgBytes, err := yaml.Marshal(cfg)
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal config: %w", err)
@@ -43,6 +68,7 @@ func NewInstance(ctx context.Context, opts InstanceOptions) (*sdk.OPA, error) {
 	inst, err := sdk.New(ctx, sdk.Options{
 		Config: bytes.NewReader(cfgBytes),
 		Logger: opts.Logger,
+		Ready:  opts.Ready,
 	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to create OPA instance: %w", err)
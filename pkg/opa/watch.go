@@ -0,0 +1,135 @@
+package opa
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/open-policy-agent/opa/plugins/bundle"
+	"github.com/open-policy-agent/opa/sdk"
+)
+
+const watchDebounce = 250 * time.Millisecond
+
+// BundleWatcher reloads an instance's local bundle when it changes.
+type BundleWatcher struct {
+	plugin  *bundle.Plugin
+	watcher *fsnotify.Watcher
+	path    string
+	dir     bool
+}
+
+// NewBundleWatcher watches the local bundle at path, changes made after it
+// returns are picked up once Run is called.
+func NewBundleWatcher(inst *sdk.OPA, path string) (*BundleWatcher, error) {
+	plugin, ok := inst.Plugin(bundle.Name).(*bundle.Plugin)
+	if !ok {
+		return nil, errors.New("instance has no bundle plugin")
+	}
+
+	path = filepath.Clean(path)
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bundle: %w", err)
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create watcher: %w", err)
+	}
+
+	w := &BundleWatcher{plugin: plugin, watcher: watcher, path: path, dir: info.IsDir()}
+
+	// files are often replaced rather than written, so the directory
+	// containing a bundle file is watched
+	if w.dir {
+		err = watchDirs(watcher, path)
+	} else {
+		err = watcher.Add(filepath.Dir(path))
+	}
+
+	if err != nil {
+		watcher.Close()
+
+		return nil, fmt.Errorf("failed to watch bundle: %w", err)
+	}
+
+	return w, nil
+}
+
+// Run reloads the bundle after changes until ctx is cancelled. Bundles
+// which fail to load are logged by the instance and the current bundle is
+// kept.
+func (w *BundleWatcher) Run(ctx context.Context) {
+	defer w.watcher.Close()
+
+	// a single save often produces several events
+	debounce := time.NewTimer(time.Hour)
+	debounce.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			debounce.Stop()
+
+			return
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+
+			if !w.dir && filepath.Clean(event.Name) != w.path {
+				continue
+			}
+
+			// new directories in a policy directory are watched too
+			if w.dir && event.Has(fsnotify.Create) {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					err := watchDirs(w.watcher, event.Name)
+					if err != nil {
+						slog.Error("failed to watch policy directory", "error", err)
+					}
+				}
+			}
+
+			debounce.Reset(watchDebounce)
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+
+			slog.Error("bundle watcher failed", "error", err)
+		case <-debounce.C:
+			err := w.plugin.Trigger(ctx)
+			if err != nil {
+				slog.Error("failed to reload bundle", "path", w.path, "error", err)
+
+				continue
+			}
+
+			slog.Info("reloaded bundle", "path", w.path)
+		}
+	}
+}
+
+// watchDirs watches root and the directories within it.
+func watchDirs(watcher *fsnotify.Watcher, root string) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !d.IsDir() {
+			return nil
+		}
+
+		return watcher.Add(path)
+	})
+}
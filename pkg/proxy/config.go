@@ -1,8 +1,13 @@
 package proxy
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
@@ -12,12 +17,114 @@ type Config struct {
 	Port int    `yaml:"port"`
 	Host string `yaml:"host"`
 
+	ReadTimeout       time.Duration `yaml:"read-timeout"`
+	ReadHeaderTimeout time.Duration `yaml:"read-header-timeout"`
+	WriteTimeout      time.Duration `yaml:"write-timeout"`
+	IdleTimeout       time.Duration `yaml:"idle-timeout"`
+	MaxHeaderBytes    int           `yaml:"max-header-bytes"`
+
+	// WatchConfig reloads the config when the file changes, as well as on
+	// SIGHUP. It's only read at startup.
+	WatchConfig bool `yaml:"watch-config"`
+
+	// MaxRequestBody is the largest request body in bytes accepted for any
+	// upstream, zero is unlimited
+	MaxRequestBody int64 `yaml:"max-request-body"`
+	// MinRequestRate is the lowest rate in bytes per second that request
+	// bodies can be sent at once MinRequestRateGrace has passed
+	MinRequestRate      int64         `yaml:"min-request-rate"`
+	MinRequestRateGrace time.Duration `yaml:"min-request-rate-grace"`
+
+	// Admin serves metrics and the admin API on a separate listener so
+	// that they aren't exposed through the proxied hostnames
+	Admin ConfigAdmin `yaml:"admin"`
+
+	RequestID ConfigRequestID  `yaml:"request-id"`
+	AccessLog *ConfigAccessLog `yaml:"access-log"`
+	Tracing   *ConfigTracing   `yaml:"tracing"`
+
 	DNSServers  []ConfigDNSServer        `yaml:"dns-servers"`
 	Middlewares []ConfigMiddleware       `yaml:"middlewares"`
 	Upstreams   []ConfigUpstream         `yaml:"upstreams"`
 	Tailnets    map[string]ConfigTailnet `yaml:"tailnets"`
 
 	OAuth OAuthConfig `yaml:"oauth"`
+
+	// Include are globs of files which add dns-servers, middlewares,
+	// upstreams and tailnets to the config, relative to the config file.
+	// Directories include the YAML files they contain. References such as
+	// env:VAR aren't resolved in included files.
+	Include []string `yaml:"include"`
+
+	// sources are the files which config values came from when they
+	// were included, keyed by their YAML path
+	sources map[string]string
+	// includes are the include patterns relative to the working directory
+	includes []string
+}
+
+type ConfigAdmin struct {
+	// Addr is the host and port to listen on, or the port when Tailnet is
+	// set. Only /metrics is served on addresses other than loopback ones,
+	// use a tailnet or unix socket to expose the admin API to other hosts.
+	Addr string `yaml:"addr"`
+	// Socket is the path of a unix socket to listen on instead
+	Socket string `yaml:"socket"`
+	// Tailnet is the name of a tailnet to listen on instead, so that the
+	// admin API is only reachable from that tailnet
+	Tailnet string `yaml:"tailnet"`
+}
+
+type ConfigRequestID struct {
+	// Header defaults to X-Request-ID
+	Header string `yaml:"header"`
+	// TrustIncoming keeps valid IDs sent by clients, this should only be
+	// set when the proxy is behind something which sets the header
+	TrustIncoming bool `yaml:"trust-incoming"`
+}
+
+type ConfigAccessLog struct {
+	// Format is one of common, combined (the default), json or template
+	Format string `yaml:"format"`
+	// Template is a text/template executed with an accesslog.Entry
+	Template string `yaml:"template"`
+
+	// Output is one of stdout (the default), stderr, file or syslog
+	Output string                `yaml:"output"`
+	File   ConfigAccessLogFile   `yaml:"file"`
+	Syslog ConfigAccessLogSyslog `yaml:"syslog"`
+
+	// SampleRate is the fraction of requests logged, 5xx responses are
+	// always logged
+	SampleRate float64 `yaml:"sample-rate"`
+	// ExcludePaths are path.Match patterns for paths which aren't logged
+	ExcludePaths []string `yaml:"exclude-paths"`
+}
+
+type ConfigAccessLogFile struct {
+	Path string `yaml:"path"`
+	// MaxSize is the size in bytes the file is rotated at, zero disables
+	// rotation
+	MaxSize    int64 `yaml:"max-size"`
+	MaxBackups int   `yaml:"max-backups"`
+}
+
+type ConfigAccessLogSyslog struct {
+	// Network and Addr are empty to use the local syslog server
+	Network string `yaml:"network"`
+	Addr    string `yaml:"addr"`
+	Tag     string `yaml:"tag"`
+}
+
+type ConfigTracing struct {
+	// Endpoint is the URL of the OTLP HTTP traces endpoint, such as
+	// http://localhost:4318/v1/traces
+	Endpoint    string            `yaml:"endpoint"`
+	Headers     map[string]string `yaml:"headers" secret:"true"`
+	ServiceName string            `yaml:"service-name"`
+	// SampleRatio is the fraction of new traces sampled, traces started by
+	// clients follow the client's decision
+	SampleRatio float64 `yaml:"sample-ratio"`
 }
 
 type ConfigDNSServer struct {
@@ -27,48 +134,385 @@ type ConfigDNSServer struct {
 }
 
 type ConfigMiddleware struct {
-	Kind          string                    `yaml:"kind"`
-	OPAProperties *ConfigMiddlewarePropsOPA `yaml:"properties"`
+	// Name is used by upstreams to reference the middleware, or to skip it
+	// if it's global
+	Name string `yaml:"name,omitempty"`
+	Kind string `yaml:"kind"`
+	// Global middlewares are run for every upstream which doesn't skip
+	// them, it defaults to true. Other middlewares are only run for
+	// upstreams which reference them.
+	Global *bool `yaml:"global,omitempty"`
+
+	// Properties are decoded into the type registered for the kind, see
+	// RegisterMiddleware. They're nil for unknown kinds.
+	Properties any `yaml:"properties,omitempty"`
+}
+
+// UnmarshalYAML decodes the properties block into the type registered for
+// the middleware's kind.
+func (m *ConfigMiddleware) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	// kind and properties are decoded together so that strict decoding
+	// doesn't reject either of them as unknown
+	var raw struct {
+		Name       string  `yaml:"name"`
+		Kind       string  `yaml:"kind"`
+		Global     *bool   `yaml:"global"`
+		Properties rawYAML `yaml:"properties"`
+	}
+
+	err := unmarshal(&raw)
+	if err != nil {
+		return err
+	}
+
+	m.Name = raw.Name
+	m.Kind = raw.Kind
+	m.Global = raw.Global
+
+	// unknown kinds are reported when the config is validated
+	kind, ok := lookupMiddlewareKind(m.Kind)
+	if !ok {
+		return nil
+	}
+
+	m.Properties = kind.properties()
+
+	return raw.Properties.decode(m.Properties)
+}
+
+// IsGlobal returns true if the middleware is run for all upstreams.
+func (m ConfigMiddleware) IsGlobal() bool {
+	return m.Global == nil || *m.Global
+}
+
+// DisplayName is the name of the middleware, or its kind if it's unnamed.
+func (m ConfigMiddleware) DisplayName() string {
+	if m.Name != "" {
+		return m.Name
+	}
+
+	return m.Kind
+}
+
+// rawYAML holds a value until the type to decode it into is known.
+type rawYAML struct {
+	unmarshal func(interface{}) error
+}
+
+func (r *rawYAML) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	r.unmarshal = unmarshal
+
+	return nil
+}
+
+// decode decodes the value into v, leaving v unchanged if the value wasn't
+// set.
+func (r rawYAML) decode(v interface{}) error {
+	if r.unmarshal == nil {
+		return nil
+	}
+
+	return r.unmarshal(v)
 }
 
 type ConfigMiddlewarePropsOPA struct {
 	Bundle ConfigMiddlewarePropsOPABundle `yaml:"bundle"`
+
+	// DecisionPath is the rule queried for requests, it defaults to
+	// authz/allow. UpstreamDecisionPaths overrides it for upstreams by
+	// name, so that one bundle can hold the policies for many services.
+	DecisionPath          string            `yaml:"decision-path"`
+	UpstreamDecisionPaths map[string]string `yaml:"upstream-decision-paths"`
+
+	// Default is the decision used when the rule is undefined for a
+	// request, it defaults to false which denies the request.
+	Default bool `yaml:"default"`
+
+	// MaxBodyBytes enables parsing JSON and form request bodies of up to
+	// this size into input.body, the body is still sent to the upstream
+	MaxBodyBytes int64 `yaml:"max-body-bytes"`
+
+	// DecisionLogs records each decision with its input and the bundle
+	// revision, decisions aren't logged if it's not set
+	DecisionLogs *ConfigMiddlewarePropsOPADecisionLogs `yaml:"decision-logs"`
+
+	// Mode is enforce (the default) or shadow, where decisions are made
+	// and logged but every request is allowed
+	Mode string `yaml:"mode"`
+
+	// Shadow is a second policy evaluated alongside this one without
+	// being enforced, requests where the results differ are counted
+	Shadow *ConfigMiddlewarePropsOPAShadow `yaml:"shadow"`
+
+	// Wait blocks building the handler until the bundle has been
+	// downloaded from the server and activated, for up to WaitTimeout
+	// which defaults to 30 seconds. By default requests are handled by
+	// OnError until then. Bundles loaded from a file or inline Rego are
+	// always waited for.
+	Wait        bool          `yaml:"wait"`
+	WaitTimeout time.Duration `yaml:"wait-timeout"`
+
+	// OnError is what happens to requests when there's no decision, such
+	// as before the bundle is activated or when the query fails. It's
+	// deny, allow or 503, by default requests fail with a 500.
+	OnError string `yaml:"on-error"`
+}
+
+// waitForBundle returns true if building the handler should block until
+// the bundle has been activated.
+func (p *ConfigMiddlewarePropsOPA) waitForBundle() bool {
+	return p.Wait || p.Bundle.ServerEndpoint == ""
 }
 
+// ConfigMiddlewarePropsOPAShadow is a policy which is evaluated but not
+// enforced, such as a new bundle revision, to compare it with the
+// enforced policy before rolling it out.
+type ConfigMiddlewarePropsOPAShadow struct {
+	Bundle                ConfigMiddlewarePropsOPABundle `yaml:"bundle"`
+	DecisionPath          string                         `yaml:"decision-path"`
+	UpstreamDecisionPaths map[string]string              `yaml:"upstream-decision-paths"`
+	Default               bool                           `yaml:"default"`
+}
+
+// props returns the properties used to query the shadow policy, input is
+// built as it is for the enforced policy.
+func (s *ConfigMiddlewarePropsOPAShadow) props(enforced *ConfigMiddlewarePropsOPA) *ConfigMiddlewarePropsOPA {
+	return &ConfigMiddlewarePropsOPA{
+		Bundle:                s.Bundle,
+		DecisionPath:          s.DecisionPath,
+		UpstreamDecisionPaths: s.UpstreamDecisionPaths,
+		Default:               s.Default,
+		MaxBodyBytes:          enforced.MaxBodyBytes,
+		Mode:                  opaModeShadow,
+	}
+}
+
+// ConfigMiddlewarePropsOPADecisionLogs is where decision logs are written.
+type ConfigMiddlewarePropsOPADecisionLogs struct {
+	// Output is stdout (the default), file or http
+	Output string `yaml:"output"`
+	Path   string `yaml:"path"`
+
+	// URL receives batches of entries as a JSON array every FlushInterval
+	URL           string        `yaml:"url"`
+	FlushInterval time.Duration `yaml:"flush-interval"`
+
+	// Mask are dotted paths in the input which are redacted, such as
+	// headers.Authorization, header names aren't case sensitive. It
+	// defaults to the credential headers and cookies, an empty list masks
+	// nothing.
+	Mask []string `yaml:"mask"`
+}
+
+// decisionPath returns the rule to query for requests to the upstream.
+func (p *ConfigMiddlewarePropsOPA) decisionPath(upstream string) string {
+	if path, ok := p.UpstreamDecisionPaths[upstream]; ok {
+		return path
+	}
+
+	if p.DecisionPath != "" {
+		return p.DecisionPath
+	}
+
+	return defaultDecisionPath
+}
+
+// ConfigMiddlewarePropsOPABundle is where policies are loaded from, one of
+// a bundle server, a local file or inline Rego.
 type ConfigMiddlewarePropsOPABundle struct {
 	ServerEndpoint string `yaml:"server-endpoint"`
 	Path           string `yaml:"path"`
+
+	// File is a local .tar.gz bundle or a directory of .rego and
+	// data.json files, it's reloaded when it changes if Watch is set
+	File  string `yaml:"file"`
+	Watch bool   `yaml:"watch"`
+
+	// Rego is an inline policy module, references in it aren't resolved
+	Rego string `yaml:"rego" literal:"true"`
+}
+
+// String describes where the policies are loaded from.
+func (b ConfigMiddlewarePropsOPABundle) String() string {
+	switch {
+	case b.ServerEndpoint != "":
+		return strings.TrimSuffix(b.ServerEndpoint, "/") + "/" + strings.TrimPrefix(b.Path, "/")
+	case b.File != "":
+		return b.File
+	default:
+		return "inline"
+	}
+}
+
+// ConfigMiddlewarePropsTailscale looks up the Tailscale identity of
+// requests from the tailnet, for OPA input and upstream headers.
+type ConfigMiddlewarePropsTailscale struct {
+	Tailnet string `yaml:"tailnet"`
+	// Headers enables setting Tailscale-User-Login and similar headers
+	// for upstreams
+	Headers bool `yaml:"headers"`
+}
+
+// ConfigMiddlewarePropsIdentity forwards the claims of users signed in
+// with oauth to upstreams.
+type ConfigMiddlewarePropsIdentity struct {
+	// Mode is headers, for a header per claim signed with HMAC-SHA256, or
+	// jwt, for an HS256 token in the X-Identity-Token header
+	Mode   string        `yaml:"mode"`
+	Key    string        `yaml:"key" secret:"true"`
+	Issuer string        `yaml:"issuer"`
+	TTL    time.Duration `yaml:"ttl"`
+}
+
+type ConfigMiddlewarePropsRateLimit struct {
+	// Key is what requests are counted by, one of ip (the default),
+	// header, email or upstream. Requests without a header or email are
+	// counted by ip.
+	Key    string `yaml:"key"`
+	Header string `yaml:"header"`
+
+	// Requests are allowed per Period, with up to Burst at once. Burst
+	// defaults to Requests.
+	Requests int           `yaml:"requests"`
+	Period   time.Duration `yaml:"period"`
+	Burst    int           `yaml:"burst"`
+
+	// EvictionInterval is how often idle buckets are removed
+	EvictionInterval time.Duration `yaml:"eviction-interval"`
 }
 
 type ConfigUpstream struct {
-	Endpoint           string   `yaml:"endpoint"`
-	Hosts              []string `yaml:"hosts"`
-	PathPrefixes       []string `yaml:"path-prefixes"`
-	Tailnet            string   `yaml:"tailnet"`
-	InsecureSkipVerify bool     `yaml:"insecure-skip-verify"`
+	Name               string                     `yaml:"name"`
+	Endpoint           string                     `yaml:"endpoint"`
+	Hosts              []string                   `yaml:"hosts"`
+	PathPrefixes       []string                   `yaml:"path-prefixes"`
+	Tailnet            string                     `yaml:"tailnet"`
+	InsecureSkipVerify bool                       `yaml:"insecure-skip-verify"`
+	Cache              *ConfigUpstreamCache       `yaml:"cache"`
+	Coalesce           *ConfigUpstreamCoalesce    `yaml:"coalesce"`
+	Concurrency        *ConfigUpstreamConcurrency `yaml:"concurrency"`
+	MaxRequestBody     int64                      `yaml:"max-request-body"`
+
+	// Middlewares are the names of middlewares to run for the upstream
+	// after the global middlewares
+	Middlewares []string `yaml:"middlewares"`
+	// SkipMiddlewares are the names of global middlewares which aren't
+	// run for the upstream, such as auth for a public status page
+	SkipMiddlewares []string `yaml:"skip-middlewares"`
+}
+
+// ConfigUpstreamCache configures a shared cache for the upstream, responses
+// for tailnet users are stored per user and node, and for signed in users
+// per user.
+type ConfigUpstreamCache struct {
+	// Store is either memory (the default) or disk
+	Store string `yaml:"store"`
+	// Dir is where entries are kept when using the disk store
+	Dir string `yaml:"dir"`
+	// MaxSize is the size in bytes of the store, zero is unlimited
+	MaxSize int64 `yaml:"max-size"`
+	// MaxEntrySize is the largest response body which will be stored
+	MaxEntrySize int64 `yaml:"max-entry-size"`
+}
+
+type ConfigUpstreamConcurrency struct {
+	// MaxInFlight is the number of requests sent to the upstream at once
+	MaxInFlight int `yaml:"max-in-flight"`
+	// MaxQueue is the number of requests which can wait for a slot
+	MaxQueue int `yaml:"max-queue"`
+	// QueueTimeout is how long requests wait before getting a 503
+	QueueTimeout time.Duration `yaml:"queue-timeout"`
+}
+
+type ConfigUpstreamCoalesce struct {
+	// VaryHeaders are request headers which must also match for requests
+	// to share a response, requests from different tailnet or signed in
+	// users never share one
+	VaryHeaders []string `yaml:"vary-headers"`
+	// MaxBodySize is the largest response body which will be shared
+	MaxBodySize int64 `yaml:"max-body-size"`
 }
 
 type ConfigTailnet struct {
 	ID      string `yaml:"id"`
-	AuthKey string `yaml:"auth-key"`
+	AuthKey string `yaml:"auth-key" secret:"true"`
 }
 
 type OAuthConfig struct {
 	CallbackURL  string `yaml:"callback_url"`
 	ProviderURL  string `yaml:"provider_url"`
 	ClientID     string `yaml:"client_id"`
-	ClientSecret string `yaml:"client_secret"`
+	ClientSecret string `yaml:"client_secret" secret:"true"`
 	Domain       string `yaml:"domain"`
 	Debug        bool   `yaml:"debug"`
+
+	// Claims are taken from ID tokens for OPA input and the identity
+	// middleware, they default to sub, email, name and groups. Claims
+	// named timestamp, signature or token are rejected as they'd replace
+	// the identity verification headers.
+	Claims []string `yaml:"claims"`
 }
 
+// LoadConfig decodes and validates the config. Unknown fields are
+// rejected so that typos aren't silently ignored. Environment variable and
+// file references in strings are resolved before the config is validated,
+// see resolveReferences. Included files are relative to the working
+// directory.
 func LoadConfig(r io.Reader) (*Config, error) {
+	return loadConfig(r, "")
+}
+
+// LoadConfigFile loads the config from the file at path, included files
+// are relative to its directory.
+func LoadConfigFile(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open config file: %w", err)
+	}
+	defer f.Close()
+
+	return loadConfig(f, path)
+}
+
+func loadConfig(r io.Reader, path string) (*Config, error) {
 	var cfg Config
 
-	err := yaml.NewDecoder(r).Decode(&cfg)
+	err := decodeConfig(r, &cfg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to decode config: %w", err)
+		return nil, err
+	}
+
+	dir, name := ".", "the main config"
+	if path != "" {
+		dir, name = filepath.Dir(path), filepath.Base(path)
+	}
+
+	err = cfg.include(dir, name)
+	if err != nil {
+		return nil, err
+	}
+
+	err = resolveReferences(&cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	err = cfg.Validate()
+	if err != nil {
+		return nil, err
 	}
 
 	return &cfg, nil
 }
+
+func decodeConfig(r io.Reader, v interface{}) error {
+	dec := yaml.NewDecoder(r)
+	dec.SetStrict(true)
+
+	err := dec.Decode(v)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("failed to decode config: %w", err)
+	}
+
+	return nil
+}
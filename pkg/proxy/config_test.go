@@ -1,9 +1,11 @@
 package proxy
 
 import (
+	"reflect"
 	"slices"
 	"strings"
 	"testing"
+	"time"
 
 	_ "embed"
 )
@@ -33,10 +35,46 @@ func TestLoadConfig(t *testing.T) {
 		t.Fatalf("Host did not match expected: %q != %q", exp, got)
 	}
 
+	if exp, got := 30*time.Second, cfg.ReadTimeout; exp != got {
+		t.Fatalf("ReadTimeout did not match expected: %s != %s", exp, got)
+	}
+
+	if exp, got := 2*time.Minute, cfg.IdleTimeout; exp != got {
+		t.Fatalf("IdleTimeout did not match expected: %s != %s", exp, got)
+	}
+
+	if exp, got := 65536, cfg.MaxHeaderBytes; exp != got {
+		t.Fatalf("MaxHeaderBytes did not match expected: %d != %d", exp, got)
+	}
+
+	if exp, got := int64(10485760), cfg.MaxRequestBody; exp != got {
+		t.Fatalf("MaxRequestBody did not match expected: %d != %d", exp, got)
+	}
+
+	if exp, got := "localhost:9090", cfg.Admin.Addr; exp != got {
+		t.Fatalf("Admin addr did not match expected: %s != %s", exp, got)
+	}
+
+	expectedAccessLog := &ConfigAccessLog{
+		Format: "json",
+		Output: "file",
+		File: ConfigAccessLogFile{
+			Path:       "/var/log/proxy/access.log",
+			MaxSize:    104857600,
+			MaxBackups: 5,
+		},
+		SampleRate:   0.5,
+		ExcludePaths: []string{"/healthz"},
+	}
+
+	if !reflect.DeepEqual(cfg.AccessLog, expectedAccessLog) {
+		t.Fatalf("AccessLog did not match expected: %+v != %+v", cfg.AccessLog, expectedAccessLog)
+	}
+
 	expectedDNSServers := []ConfigDNSServer{
-		{Addr: "::1", Net: "udp6"},
+		{Addr: "[::1]:53", Net: "udp6"},
 		{Addr: "[::1]:53", Net: "tcp6"},
-		{Addr: "1.1.1.1", Net: "udp4"},
+		{Addr: "1.1.1.1:53", Net: "udp4"},
 		{Addr: "1.1.1.1:53", Net: "tcp4"},
 	}
 
@@ -47,7 +85,7 @@ func TestLoadConfig(t *testing.T) {
 	expectedMiddlewares := []ConfigMiddleware{
 		{
 			Kind: "opa",
-			OPAProperties: &ConfigMiddlewarePropsOPA{
+			Properties: &ConfigMiddlewarePropsOPA{
 				Bundle: ConfigMiddlewarePropsOPABundle{
 					ServerEndpoint: "https://example.com",
 					Path:           "/bundles/policy.tar.gz",
@@ -65,17 +103,14 @@ func TestLoadConfig(t *testing.T) {
 			t.Fatalf("Middleware kind did not match expected")
 		}
 
-		if mw.OPAProperties.Bundle.ServerEndpoint != expectedMiddlewares[i].OPAProperties.Bundle.ServerEndpoint {
-			t.Fatalf("Middleware bundle server-endpoint did not match expected")
-		}
-
-		if mw.OPAProperties.Bundle.Path != expectedMiddlewares[i].OPAProperties.Bundle.Path {
-			t.Fatalf("Middleware bundle path did not match expected")
+		if !reflect.DeepEqual(mw.Properties, expectedMiddlewares[i].Properties) {
+			t.Fatalf("Middleware properties did not match expected: %+v", mw.Properties)
 		}
 	}
 
 	expectedUpstreams := []ConfigUpstream{
 		{
+			Name:     "internal",
 			Endpoint: "http://internal.example.com",
 			Hosts: []string{
 				"foo.example.com",
@@ -85,7 +120,20 @@ func TestLoadConfig(t *testing.T) {
 				"/foo",
 				"/bar",
 			},
-			Tailnet: "tsnet",
+			Tailnet: "foobar",
+			Cache: &ConfigUpstreamCache{
+				Store:   "memory",
+				MaxSize: 1048576,
+			},
+			Coalesce: &ConfigUpstreamCoalesce{
+				VaryHeaders: []string{"Accept"},
+			},
+			Concurrency: &ConfigUpstreamConcurrency{
+				MaxInFlight:  2,
+				MaxQueue:     10,
+				QueueTimeout: 5 * time.Second,
+			},
+			MaxRequestBody: 1024,
 		},
 		{
 			Endpoint: "http://internal2.example.com",
@@ -105,6 +153,10 @@ func TestLoadConfig(t *testing.T) {
 	}
 
 	for i, us := range cfg.Upstreams {
+		if us.Name != expectedUpstreams[i].Name {
+			t.Fatalf("Upstream name did not match expected")
+		}
+
 		if us.Endpoint != expectedUpstreams[i].Endpoint {
 			t.Fatalf("Upstream endpoint did not match expected")
 		}
@@ -120,6 +172,25 @@ func TestLoadConfig(t *testing.T) {
 		if us.Tailnet != expectedUpstreams[i].Tailnet {
 			t.Fatalf("Upstream tailnet did not match expected")
 		}
+
+		if (us.Cache == nil) != (expectedUpstreams[i].Cache == nil) ||
+			us.Cache != nil && *us.Cache != *expectedUpstreams[i].Cache {
+			t.Fatalf("Upstream cache did not match expected")
+		}
+
+		if (us.Coalesce == nil) != (expectedUpstreams[i].Coalesce == nil) ||
+			us.Coalesce != nil && !slices.Equal(us.Coalesce.VaryHeaders, expectedUpstreams[i].Coalesce.VaryHeaders) {
+			t.Fatalf("Upstream coalesce did not match expected")
+		}
+
+		if (us.Concurrency == nil) != (expectedUpstreams[i].Concurrency == nil) ||
+			us.Concurrency != nil && *us.Concurrency != *expectedUpstreams[i].Concurrency {
+			t.Fatalf("Upstream concurrency did not match expected")
+		}
+
+		if us.MaxRequestBody != expectedUpstreams[i].MaxRequestBody {
+			t.Fatalf("Upstream max-request-body did not match expected")
+		}
 	}
 
 	expectedTailnets := map[string]ConfigTailnet{
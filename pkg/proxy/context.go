@@ -0,0 +1,46 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+)
+
+type matchContextKey struct{}
+
+// match is the route selected for a request and the upstream it will be
+// sent to.
+type match struct {
+	route    route
+	client   *http.Client
+	endpoint string
+}
+
+func matchFromContext(ctx context.Context) *match {
+	m, _ := ctx.Value(matchContextKey{}).(*match)
+
+	return m
+}
+
+// UpstreamFromContext returns the name of the route matched for the
+// request, ok is false if no route matched.
+func UpstreamFromContext(ctx context.Context) (name string, ok bool) {
+	m := matchFromContext(ctx)
+	if m == nil {
+		return "", false
+	}
+
+	return m.route.name, true
+}
+
+type emailContextKey struct{}
+
+// EmailContextKey is the context key for the authenticated user's email,
+// it's set by the oauth middleware in pkg/tool.
+var EmailContextKey = emailContextKey{}
+
+// EmailFromContext returns the authenticated user's email, if any.
+func EmailFromContext(ctx context.Context) string {
+	email, _ := ctx.Value(EmailContextKey).(string)
+
+	return email
+}
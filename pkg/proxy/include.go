@@ -0,0 +1,224 @@
+package proxy
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// configFragment is the part of the config which included files can set.
+type configFragment struct {
+	DNSServers  []ConfigDNSServer        `yaml:"dns-servers"`
+	Middlewares []ConfigMiddleware       `yaml:"middlewares"`
+	Upstreams   []ConfigUpstream         `yaml:"upstreams"`
+	Tailnets    map[string]ConfigTailnet `yaml:"tailnets"`
+}
+
+// include merges the files matched by the include patterns into the
+// config, relative patterns are relative to dir. Lists from included files
+// are appended in order, files matched by a pattern are sorted by name.
+// Tailnets and upstream names must be unique across all files.
+func (c *Config) include(dir, path string) error {
+	if len(c.Include) == 0 {
+		return nil
+	}
+
+	var problems []string
+
+	c.sources = make(map[string]string)
+
+	tailnets := make(map[string]string)
+	for name := range c.Tailnets {
+		tailnets[name] = path
+	}
+
+	upstreams := make(map[string]string)
+
+	for _, u := range c.Upstreams {
+		if u.Name != "" {
+			upstreams[u.Name] = path
+		}
+	}
+
+	seen := make(map[string]bool)
+
+	for i, pattern := range c.Include {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(dir, pattern)
+		}
+
+		c.includes = append(c.includes, pattern)
+
+		files, err := includedFiles(pattern)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("include[%d]: %s", i, err))
+
+			continue
+		}
+
+		for _, file := range files {
+			if seen[file] {
+				continue
+			}
+
+			seen[file] = true
+
+			name := displayPath(dir, file)
+
+			var fragment configFragment
+
+			err := decodeConfigFile(file, &fragment)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %s", name, err))
+
+				continue
+			}
+
+			for _, k := range sortedKeys(fragment.Tailnets) {
+				t := fragment.Tailnets[k]
+
+				if other, ok := tailnets[k]; ok {
+					problems = append(problems, fmt.Sprintf("tailnets.%s: defined in both %s and %s", k, other, name))
+
+					continue
+				}
+
+				if c.Tailnets == nil {
+					c.Tailnets = make(map[string]ConfigTailnet)
+				}
+
+				c.Tailnets[k] = t
+				tailnets[k] = name
+				c.sources["tailnets."+k] = name
+			}
+
+			for _, u := range fragment.Upstreams {
+				if u.Name != "" {
+					if other, ok := upstreams[u.Name]; ok {
+						problems = append(problems, fmt.Sprintf("upstreams: %q defined in both %s and %s", u.Name, other, name))
+
+						continue
+					}
+
+					upstreams[u.Name] = name
+				}
+
+				c.sources[fmt.Sprintf("upstreams[%d]", len(c.Upstreams))] = name
+				c.Upstreams = append(c.Upstreams, u)
+			}
+
+			for _, m := range fragment.Middlewares {
+				c.sources[fmt.Sprintf("middlewares[%d]", len(c.Middlewares))] = name
+				c.Middlewares = append(c.Middlewares, m)
+			}
+
+			for _, s := range fragment.DNSServers {
+				c.sources[fmt.Sprintf("dns-servers[%d]", len(c.DNSServers))] = name
+				c.DNSServers = append(c.DNSServers, s)
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+
+	return nil
+}
+
+// includedFiles returns the files matching pattern, matched directories
+// contribute the YAML files they contain.
+func includedFiles(pattern string) ([]string, error) {
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+	}
+
+	// a pattern which is a plain path must exist, but a glob can match
+	// nothing, such as an empty conf.d
+	if len(matches) == 0 && !strings.ContainsAny(pattern, "*?[") {
+		return nil, fmt.Errorf("%s does not exist", pattern)
+	}
+
+	sort.Strings(matches)
+
+	var files []string
+
+	for _, match := range matches {
+		info, err := os.Stat(match)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", match, err)
+		}
+
+		if !info.IsDir() {
+			files = append(files, match)
+
+			continue
+		}
+
+		entries, err := os.ReadDir(match)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", match, err)
+		}
+
+		for _, e := range entries {
+			if e.IsDir() || !slices.Contains([]string{".yaml", ".yml"}, filepath.Ext(e.Name())) {
+				continue
+			}
+
+			files = append(files, filepath.Join(match, e.Name()))
+		}
+	}
+
+	return files, nil
+}
+
+func decodeConfigFile(path string, v interface{}) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open config file: %w", err)
+	}
+	defer f.Close()
+
+	return decodeConfig(f, v)
+}
+
+// displayPath shortens paths within dir so that errors are easier to read.
+func displayPath(dir, path string) string {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return path
+	}
+
+	return rel
+}
+
+// watchedBy returns true if the file at name is, or could be, included by
+// the config.
+func (c *Config) watchedBy(name string) bool {
+	for _, pattern := range c.includes {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+
+		if filepath.Dir(name) == pattern {
+			return true
+		}
+	}
+
+	return false
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,224 @@
+package proxy
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeConfigFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+
+		err := os.MkdirAll(filepath.Dir(path), 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		writeConfig(t, path, content)
+	}
+
+	return dir
+}
+
+func TestLoadConfigFileInclude(t *testing.T) {
+	t.Parallel()
+
+	dir := writeConfigFiles(t, map[string]string{
+		"config.yaml": `
+port: 8080
+include:
+  - conf.d
+  - "services/*.yaml"
+tailnets:
+  main:
+    id: proxy
+upstreams:
+  - name: main
+    endpoint: "http://main.example.com"
+    hosts: ["main.example.com"]
+`,
+		"conf.d/b.yaml": `
+upstreams:
+  - name: b
+    endpoint: "http://b.example.com"
+    hosts: ["b.example.com"]
+`,
+		"conf.d/a.yml": `
+dns-servers:
+  - addr: "1.1.1.1:53"
+    net: udp
+tailnets:
+  other:
+    id: other-proxy
+upstreams:
+  - name: a
+    endpoint: "http://a.example.com"
+    hosts: ["a.example.com"]
+    tailnet: other
+`,
+		"conf.d/empty.yaml": ``,
+		"conf.d/notes.txt":  `not config`,
+		"services/c.yaml": `
+middlewares:
+  - kind: ratelimit
+    properties:
+      requests: 1
+      period: 1s
+upstreams:
+  - name: c
+    endpoint: "http://c.example.com"
+`,
+	})
+
+	cfg, err := LoadConfigFile(filepath.Join(dir, "config.yaml"))
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	var names []string
+	for _, u := range cfg.Upstreams {
+		names = append(names, u.Name)
+	}
+
+	if exp, got := []string{"main", "a", "b", "c"}, names; !reflect.DeepEqual(exp, got) {
+		t.Errorf("Upstreams did not match expected: %v != %v", exp, got)
+	}
+
+	if exp, got := 2, len(cfg.Tailnets); exp != got {
+		t.Errorf("Expected %d tailnets, got %v", exp, cfg.Tailnets)
+	}
+
+	if exp, got := 1, len(cfg.DNSServers); exp != got {
+		t.Errorf("Expected %d DNS servers, got %d", exp, got)
+	}
+
+	if exp, got := 1, len(cfg.Middlewares); exp != got {
+		t.Errorf("Expected %d middlewares, got %d", exp, got)
+	}
+
+	if exp, got := 8080, cfg.Port; exp != got {
+		t.Errorf("Port did not match expected: %d != %d", exp, got)
+	}
+
+	if !cfg.watchedBy(filepath.Join(dir, "conf.d", "new.yaml")) {
+		t.Error("Expected new files in conf.d to be watched")
+	}
+
+	if !cfg.watchedBy(filepath.Join(dir, "services", "d.yaml")) {
+		t.Error("Expected new files matching services/*.yaml to be watched")
+	}
+}
+
+func TestLoadConfigFileIncludeErrors(t *testing.T) {
+	t.Parallel()
+
+	testCases := map[string]struct {
+		files map[string]string
+		exp   []string
+	}{
+		"duplicates": {
+			files: map[string]string{
+				"config.yaml": `
+include: ["conf.d"]
+tailnets:
+  tsnet:
+    id: proxy
+upstreams:
+  - name: app
+    endpoint: "http://app.example.com"
+    hosts: ["app.example.com"]
+`,
+				"conf.d/a.yaml": `
+upstreams:
+  - name: other
+    endpoint: "http://other.example.com"
+    hosts: ["other.example.com"]
+`,
+				"conf.d/b.yaml": `
+tailnets:
+  tsnet:
+    id: proxy2
+upstreams:
+  - name: app
+    endpoint: "http://app2.example.com"
+  - name: other
+    endpoint: "http://other2.example.com"
+`,
+			},
+			exp: []string{
+				`tailnets.tsnet: defined in both config.yaml and conf.d/b.yaml`,
+				`upstreams: "app" defined in both config.yaml and conf.d/b.yaml`,
+				`upstreams: "other" defined in both conf.d/a.yaml and conf.d/b.yaml`,
+			},
+		},
+		"only some fields can be included": {
+			files: map[string]string{
+				"config.yaml": `include: ["extra.yaml"]`,
+				"extra.yaml":  `port: 8080`,
+			},
+			exp: []string{
+				`extra.yaml: failed to decode config: yaml: unmarshal errors:
+  line 1: field port not found in type proxy.configFragment`,
+			},
+		},
+		"missing file": {
+			files: map[string]string{
+				"config.yaml": `include: ["missing.yaml", "missing/*.yaml"]`,
+			},
+			exp: []string{
+				`include[0]: ` + "DIR" + `/missing.yaml does not exist`,
+			},
+		},
+		"problems name the included file": {
+			files: map[string]string{
+				"config.yaml": `
+include: ["conf.d"]
+upstreams:
+  - endpoint: "http://app.example.com"
+    hosts: ["app.example.com"]
+`,
+				"conf.d/app.yaml": `
+upstreams:
+  - endpoint: "http://app2.example.com"
+    tailnet: tsnet
+`,
+			},
+			exp: []string{
+				`upstreams[1].tailnet: "tsnet" not defined in tailnets (in conf.d/app.yaml)`,
+			},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			dir := writeConfigFiles(t, tc.files)
+
+			_, err := LoadConfigFile(filepath.Join(dir, "config.yaml"))
+
+			var validationErr *ValidationError
+			if !errors.As(err, &validationErr) {
+				t.Fatalf("Expected a validation error, got %v", err)
+			}
+
+			exp := make([]string, 0, len(tc.exp))
+			for _, e := range tc.exp {
+				exp = append(exp, strings.ReplaceAll(e, "DIR", dir))
+			}
+
+			if got := validationErr.Problems; !reflect.DeepEqual(exp, got) {
+				t.Fatalf("Problems did not match expected:\n%s\n!=\n%s",
+					strings.Join(exp, "\n"), strings.Join(got, "\n"))
+			}
+		})
+	}
+}
@@ -4,62 +4,532 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"net"
 	"net/http"
+	"time"
 
 	"github.com/open-policy-agent/opa/sdk"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 
+	"github.com/charlieegan3/tool-tsnet-proxy/pkg/accesslog"
+	"github.com/charlieegan3/tool-tsnet-proxy/pkg/cache"
+	"github.com/charlieegan3/tool-tsnet-proxy/pkg/identity"
+	"github.com/charlieegan3/tool-tsnet-proxy/pkg/metrics"
 	"github.com/charlieegan3/tool-tsnet-proxy/pkg/opa"
+	"github.com/charlieegan3/tool-tsnet-proxy/pkg/ratelimit"
+	"github.com/charlieegan3/tool-tsnet-proxy/pkg/requestid"
+	"github.com/charlieegan3/tool-tsnet-proxy/pkg/tracing"
+	"github.com/charlieegan3/tool-tsnet-proxy/pkg/whois"
 )
 
 type Middleware func(http.Handler) http.Handler
 
-func MiddlewareFromConfigMiddleware(ctx context.Context, config ConfigMiddleware) (Middleware, error) {
-	if config.Kind != "opa" || config.OPAProperties == nil {
-		return nil, errors.New("invalid config kind")
+// MiddlewareFromConfigMiddleware builds a middleware outside of a handler,
+// resources it opens, such as OPA instances, are not released.
+func MiddlewareFromConfigMiddleware(
+	ctx context.Context,
+	config ConfigMiddleware,
+	m *metrics.Metrics,
+) (Middleware, error) {
+	return newResources(m, nil).middleware(ctx, config)
+}
+
+func opaMiddlewareFactory(ctx context.Context, env *MiddlewareEnv, props *ConfigMiddlewarePropsOPA) (Middleware, error) {
+	var logger *opa.DecisionLogger
+
+	if l := props.DecisionLogs; l != nil {
+		var err error
+
+		logger, err = opa.NewDecisionLogger(opa.DecisionLogOptions{
+			Output:        l.Output,
+			Path:          l.Path,
+			URL:           l.URL,
+			FlushInterval: l.FlushInterval,
+			Mask:          l.Mask,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create decision logger: %w", err)
+		}
+
+		env.AddCloser(logger)
 	}
 
-	bundleServerAddr := config.OPAProperties.Bundle.ServerEndpoint
-	bundlePath := config.OPAProperties.Bundle.Path
+	return env.res.opaMiddleware(ctx, props, logger)
+}
 
-	opaInstance, err := opa.NewInstance(ctx, opa.InstanceOptions{
-		BundleServerAddr: bundleServerAddr,
-		BundlePath:       bundlePath,
+func rateLimitMiddlewareFactory(_ context.Context, _ *MiddlewareEnv, props *ConfigMiddlewarePropsRateLimit) (Middleware, error) {
+	return rateLimitMiddlewareFromConfig(props)
+}
+
+func identityMiddlewareFactory(_ context.Context, _ *MiddlewareEnv, props *ConfigMiddlewarePropsIdentity) (Middleware, error) {
+	mw, err := identity.NewMiddleware(identity.Options{
+		Mode:   props.Mode,
+		Key:    []byte(props.Key),
+		Issuer: props.Issuer,
+		TTL:    props.TTL,
 	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to create OPA instance: %w", err)
+		return nil, fmt.Errorf("failed to create identity middleware: %w", err)
+	}
+
+	return mw, nil
+}
+
+func tailscaleMiddlewareFactory(_ context.Context, env *MiddlewareEnv, props *ConfigMiddlewarePropsTailscale) (Middleware, error) {
+	env.res.mu.Lock()
+	t, ok := env.res.tailnets[props.Tailnet]
+	env.res.mu.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrTailnetNotFound, props.Tailnet)
+	}
+
+	return whois.NewMiddleware(whois.Options{
+		Client:  t,
+		Headers: props.Headers,
+	}), nil
+}
+
+func (res *resources) opaMiddleware(
+	ctx context.Context,
+	props *ConfigMiddlewarePropsOPA,
+	logger *opa.DecisionLogger,
+) (Middleware, error) {
+	m := res.metrics
+
+	enforced, err := res.opaPolicy(ctx, props.Bundle)
+	if err != nil {
+		return nil, err
+	}
+
+	if props.waitForBundle() {
+		timeout := props.WaitTimeout
+		if timeout == 0 {
+			timeout = defaultOPAWaitTimeout
+		}
+
+		waitCtx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+
+		err = enforced.wait(waitCtx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var (
+		shadow      *policy
+		shadowProps *ConfigMiddlewarePropsOPA
+	)
+
+	// requests aren't held up waiting for the shadow bundle, they're
+	// counted as errors until it's activated
+	if props.Shadow != nil {
+		shadow, err = res.opaPolicy(ctx, props.Shadow.Bundle)
+		if err != nil {
+			return nil, err
+		}
+
+		shadowProps = props.Shadow.props(props)
 	}
 
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			statusCode, err := authorizeRequest(ctx, opaInstance, r)
+			start := time.Now()
+			decision, err := authorizeRequest(r.Context(), enforced, props, logger, r)
+			result := decisionResult(decision, err)
+
+			if props.Mode == opaModeShadow {
+				m.ObserveOPAShadowDecision(result, time.Since(start))
+			} else {
+				m.ObserveOPADecision(result, time.Since(start))
+			}
+
+			if shadow != nil {
+				compareShadowDecision(r, m, shadow, shadowProps, logger, result)
+			}
+
+			if props.Mode == opaModeShadow {
+				accesslog.SetDecision(r.Context(), "shadow-"+result)
+
+				switch {
+				case err != nil:
+					slog.WarnContext(r.Context(), "failed to authorize request in shadow mode", "error", err)
+				case !decision.Allow:
+					slog.InfoContext(r.Context(), "shadow policy would deny request", "path", r.URL.Path)
+				}
+
+				next.ServeHTTP(w, r)
+
+				return
+			}
+
+			accesslog.SetDecision(r.Context(), result)
+
 			if err != nil {
-				http.Error(w, err.Error(), statusCode)
+				slog.ErrorContext(r.Context(), "failed to authorize request", "error", err)
+
+				switch props.OnError {
+				case opaOnErrorAllow:
+					next.ServeHTTP(w, r)
+				case opaOnErrorDeny:
+					deny(w, r, &opa.Decision{})
+				case opaOnErrorUnavailable:
+					requestid.Error(w, r, "policy unavailable", http.StatusServiceUnavailable)
+				default:
+					requestid.Error(w, r, "failed to authorize request", http.StatusInternalServerError)
+				}
+
+				return
+			}
+
+			for name, values := range decision.Headers {
+				w.Header()[name] = append(w.Header()[name], values...)
+			}
+
+			if !decision.Allow {
+				deny(w, r, decision)
 
 				return
 			}
 
+			// upstream headers replace any sent by the client, so that
+			// they can be trusted by the upstream
+			for name, values := range decision.UpstreamHeaders {
+				r.Header[name] = values
+			}
+
+			// responses may depend on the headers, the cache and
+			// coalescing keep them apart
+			if len(decision.UpstreamHeaders) > 0 {
+				r = r.WithContext(opa.NewUpstreamHeadersContext(r.Context(), decision.UpstreamHeaders))
+			}
+
 			next.ServeHTTP(w, r)
 		})
 	}, nil
 }
 
-func authorizeRequest(ctx context.Context, opaInstance *sdk.OPA, r *http.Request) (int, error) {
-	rs, err := opaInstance.Decision(ctx, sdk.DecisionOptions{
-		Path:  "authz/allow",
-		Input: opa.InputFromHTTPRequest(r),
+// decisionResult returns allow, deny or error for metrics and logs.
+func decisionResult(decision *opa.Decision, err error) string {
+	switch {
+	case err != nil:
+		return "error"
+	case !decision.Allow:
+		return "deny"
+	default:
+		return "allow"
+	}
+}
+
+// compareShadowDecision queries the shadow policy for the request, which
+// is never enforced, and counts results which differ from the enforced
+// result.
+func compareShadowDecision(
+	r *http.Request,
+	m *metrics.Metrics,
+	p *policy,
+	props *ConfigMiddlewarePropsOPA,
+	logger *opa.DecisionLogger,
+	enforced string,
+) {
+	start := time.Now()
+	decision, err := authorizeRequest(r.Context(), p, props, logger, r)
+	result := decisionResult(decision, err)
+
+	m.ObserveOPAShadowDecision(result, time.Since(start))
+
+	if err != nil {
+		slog.WarnContext(r.Context(), "failed to get shadow decision", "error", err)
+	}
+
+	if result == enforced {
+		return
+	}
+
+	upstream, _ := UpstreamFromContext(r.Context())
+
+	m.ObserveOPAShadowMismatch(upstream, enforced, result)
+	slog.InfoContext(r.Context(), "shadow decision differed",
+		"upstream", upstream, "enforced", enforced, "shadow", result)
+}
+
+// deny replies to a request denied by a policy, using the status, body or
+// redirect from the decision.
+func deny(w http.ResponseWriter, r *http.Request, decision *opa.Decision) {
+	status := decision.Status
+
+	if decision.Redirect != "" {
+		if status == 0 {
+			status = http.StatusFound
+		}
+
+		http.Redirect(w, r, decision.Redirect, status)
+
+		return
+	}
+
+	if status == 0 {
+		status = http.StatusForbidden
+	}
+
+	if decision.Body == "" {
+		requestid.Error(w, r, "not allowed", status)
+
+		return
+	}
+
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+
+	w.WriteHeader(status)
+
+	_, err := io.WriteString(w, decision.Body)
+	if err != nil {
+		slog.DebugContext(r.Context(), "failed to write response", "error", err)
+	}
+}
+
+const defaultDecisionPath = "authz/allow"
+
+// defaultOPAWaitTimeout is how long building the handler waits for the
+// bundle to be activated when wait is set without a timeout.
+const defaultOPAWaitTimeout = 30 * time.Second
+
+// OPA middleware modes, shadow decisions are made and logged but every
+// request is allowed.
+const (
+	opaModeEnforce = "enforce"
+	opaModeShadow  = "shadow"
+)
+
+// What happens to requests when there's no decision.
+const (
+	opaOnErrorDeny        = "deny"
+	opaOnErrorAllow       = "allow"
+	opaOnErrorUnavailable = "503"
+)
+
+var errPolicyNotReady = errors.New("policy bundle has not been activated")
+
+// authorizeRequest queries the decision path for the request's upstream,
+// the default is used if the rule is undefined. Results can be a boolean
+// or an object, see opa.Decision. Decisions are logged if logger is set.
+func authorizeRequest(
+	ctx context.Context,
+	p *policy,
+	props *ConfigMiddlewarePropsOPA,
+	logger *opa.DecisionLogger,
+	r *http.Request,
+) (*opa.Decision, error) {
+	// before activation there's no policy and every rule is undefined
+	if !p.isReady() {
+		return nil, errPolicyNotReady
+	}
+
+	upstream, _ := UpstreamFromContext(r.Context())
+	path := props.decisionPath(upstream)
+
+	input, err := opa.NewInput(r, opa.InputOptions{
+		Upstream:     upstream,
+		MaxBodyBytes: props.MaxBodyBytes,
 	})
 	if err != nil {
-		return http.StatusInternalServerError, fmt.Errorf("failed to get decision: %w", err)
+		return nil, fmt.Errorf("failed to create input: %w", err)
+	}
+
+	input["request_id"] = requestid.FromContext(r.Context())
+
+	if id := whois.FromContext(r.Context()); id != nil {
+		input["tailscale"] = id.Input()
+	}
+
+	if claims := identity.FromContext(r.Context()); claims != nil {
+		input["identity"] = map[string]interface{}(claims)
+	}
+
+	ctx, span := tracing.Start(ctx, "opa.decision", trace.WithAttributes(
+		attribute.String("opa.path", path),
+	))
+
+	rs, err := p.inst.Decision(ctx, sdk.DecisionOptions{
+		Path:  path,
+		Input: input,
+	})
+	if rs != nil {
+		span.SetAttributes(attribute.String("opa.decision_id", rs.ID))
+	}
+
+	if logger != nil {
+		logDecision(ctx, logger, path, props.Mode == opaModeShadow, input, rs, err)
+	}
+
+	// an undefined rule is reported as an error by the sdk
+	if sdk.IsUndefinedErr(err) {
+		err = nil
+		rs = nil
+	}
+
+	var decision *opa.Decision
+
+	switch {
+	case err != nil:
+		err = fmt.Errorf("failed to get decision: %w", err)
+	case rs == nil || rs.Result == nil:
+		decision = &opa.Decision{Allow: props.Default}
+	default:
+		decision, err = opa.DecisionFromResult(rs.Result)
+	}
+
+	tracing.End(span, err)
+
+	if err != nil {
+		return nil, err
 	}
 
-	if rs == nil || rs.Result == nil {
-		return http.StatusForbidden, errors.New("not allowed")
+	return decision, nil
+}
+
+// logDecision logs the result of a query, undefined results are logged
+// with a nil result.
+func logDecision(
+	ctx context.Context,
+	logger *opa.DecisionLogger,
+	path string,
+	shadow bool,
+	input map[string]interface{},
+	rs *sdk.DecisionResult,
+	err error,
+) {
+	entry := opa.DecisionLogEntry{
+		RequestID: requestid.FromContext(ctx),
+		Timestamp: time.Now(),
+		Path:      path,
+		Shadow:    shadow,
+		Input:     input,
+	}
+
+	if rs != nil {
+		entry.DecisionID = rs.ID
+		entry.Result = rs.Result
+		entry.BundleRevision = rs.Provenance.Bundles[opa.BundleName].Revision
+	}
+
+	if err != nil && !sdk.IsUndefinedErr(err) {
+		entry.Error = err.Error()
+	}
+
+	logger.Log(ctx, entry)
+}
+
+func rateLimitMiddlewareFromConfig(props *ConfigMiddlewarePropsRateLimit) (Middleware, error) {
+	if props.Requests <= 0 || props.Period <= 0 {
+		return nil, errors.New("ratelimit requests and period must be greater than zero")
 	}
 
-	allowed, ok := rs.Result.(bool)
-	if !ok || !allowed {
-		return http.StatusForbidden, errors.New("not allowed")
+	burst := props.Burst
+	if burst == 0 {
+		burst = props.Requests
+	}
+
+	var key func(*http.Request) string
+
+	switch props.Key {
+	case "", "ip":
+		key = clientIP
+	case "header":
+		if props.Header == "" {
+			return nil, errors.New("ratelimit header is required for header key")
+		}
+
+		key = func(r *http.Request) string {
+			if v := r.Header.Get(props.Header); v != "" {
+				return "header:" + v
+			}
+
+			return clientIP(r)
+		}
+	case "email":
+		key = func(r *http.Request) string {
+			if email := EmailFromContext(r.Context()); email != "" {
+				return "email:" + email
+			}
+
+			return clientIP(r)
+		}
+	case "upstream":
+		key = func(r *http.Request) string {
+			name, _ := UpstreamFromContext(r.Context())
+
+			return "upstream:" + name
+		}
+	default:
+		return nil, fmt.Errorf("unknown ratelimit key %q", props.Key)
+	}
+
+	return ratelimit.NewMiddleware(ratelimit.Options{
+		Limit: ratelimit.Limit{
+			Rate:  float64(props.Requests) / props.Period.Seconds(),
+			Burst: burst,
+		},
+		Store: ratelimit.NewMemoryStore(props.EvictionInterval),
+		Key:   key,
+	}), nil
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return "ip:" + r.RemoteAddr
+	}
+
+	return "ip:" + host
+}
+
+func cacheMiddlewareFromConfig(config *ConfigUpstreamCache) (Middleware, cache.Store, error) {
+	var store cache.Store
+
+	switch config.Store {
+	case "", "memory":
+		store = cache.NewMemoryStore(config.MaxSize)
+	case "disk":
+		if config.Dir == "" {
+			return nil, nil, errors.New("dir is required for disk cache store")
+		}
+
+		diskStore, err := cache.NewDiskStore(config.Dir, config.MaxSize)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open disk cache store: %w", err)
+		}
+
+		store = diskStore
+	default:
+		return nil, nil, fmt.Errorf("unknown cache store %q", config.Store)
+	}
+
+	return cache.NewMiddleware(cache.Options{
+		Store:        store,
+		MaxEntrySize: config.MaxEntrySize,
+	}), store, nil
+}
+
+func accessLogOutputFromConfig(config *ConfigAccessLog) (io.WriteCloser, error) {
+	output, err := accesslog.NewOutput(accesslog.OutputOptions{
+		Output:        config.Output,
+		Path:          config.File.Path,
+		MaxSize:       config.File.MaxSize,
+		MaxBackups:    config.File.MaxBackups,
+		SyslogNetwork: config.Syslog.Network,
+		SyslogAddr:    config.Syslog.Addr,
+		SyslogTag:     config.Syslog.Tag,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open access log output: %w", err)
 	}
 
-	return http.StatusOK, nil
+	return output, nil
 }
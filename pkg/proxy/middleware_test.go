@@ -2,11 +2,29 @@ package proxy
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/bundle"
+	"tailscale.com/client/tailscale/apitype"
+
+	"github.com/charlieegan3/tool-tsnet-proxy/pkg/identity"
+	"github.com/charlieegan3/tool-tsnet-proxy/pkg/metrics"
+	"github.com/charlieegan3/tool-tsnet-proxy/pkg/opa"
 	opatest "github.com/charlieegan3/tool-tsnet-proxy/pkg/test/opa"
+	whoistest "github.com/charlieegan3/tool-tsnet-proxy/pkg/test/whois"
+	"github.com/charlieegan3/tool-tsnet-proxy/pkg/whois"
 )
 
 func TestMiddlewareFromConfigMiddleware(t *testing.T) {
@@ -36,16 +54,17 @@ func TestMiddlewareFromConfigMiddleware(t *testing.T) {
 	// Define a sample ConfigMiddleware
 	config := ConfigMiddleware{
 		Kind: "opa",
-		OPAProperties: &ConfigMiddlewarePropsOPA{
+		Properties: &ConfigMiddlewarePropsOPA{
 			Bundle: ConfigMiddlewarePropsOPABundle{
 				ServerEndpoint: bundleServer.URL,
 				Path:           "bundle.tar.gz",
 			},
+			Wait: true,
 		},
 	}
 
 	// Convert the config to a middleware
-	middleware, err := MiddlewareFromConfigMiddleware(ctx, config)
+	middleware, err := MiddlewareFromConfigMiddleware(ctx, config, nil)
 	if err != nil {
 		t.Fatalf("Failed to create middleware from config: %v", err)
 	}
@@ -89,3 +108,976 @@ func TestMiddlewareFromConfigMiddleware(t *testing.T) {
 		}
 	}
 }
+
+func TestRateLimitMiddlewareFromConfig(t *testing.T) {
+	t.Parallel()
+
+	cfg, err := LoadConfig(strings.NewReader(`
+middlewares:
+  - kind: ratelimit
+    properties:
+      key: upstream
+      requests: 1
+      period: 1m
+`))
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	props, ok := cfg.Middlewares[0].Properties.(*ConfigMiddlewarePropsRateLimit)
+	if !ok {
+		t.Fatalf("Unexpected properties type %T", cfg.Middlewares[0].Properties)
+	}
+
+	if exp, got := time.Minute, props.Period; exp != got {
+		t.Fatalf("Expected period %s, got %s", exp, got)
+	}
+
+	middleware, err := MiddlewareFromConfigMiddleware(context.Background(), cfg.Middlewares[0], nil)
+	if err != nil {
+		t.Fatalf("Failed to create middleware from config: %v", err)
+	}
+
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstreamServer.Close()
+
+	matcherForPath := func(path string) Matcher {
+		return func(req *http.Request) (*http.Client, string, bool) {
+			return upstreamServer.Client(), upstreamServer.URL, req.URL.Path == path
+		}
+	}
+
+	handler, err := NewHandler(&Options{
+		Routes: []Route{
+			{Name: "a", Matcher: matcherForPath("/a")},
+			{Name: "b", Matcher: matcherForPath("/b")},
+		},
+		Middlewares: []Middleware{middleware},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+
+	tests := []struct {
+		path     string
+		expected int
+	}{
+		{"/a", http.StatusOK},
+		{"/a", http.StatusTooManyRequests},
+		{"/b", http.StatusOK},
+	}
+
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, test.path, nil))
+
+		if rec.Code != test.expected {
+			t.Errorf("Expected status %d for %s, got %d", test.expected, test.path, rec.Code)
+		}
+	}
+}
+
+func TestOPAMiddlewareDecisionPaths(t *testing.T) {
+	t.Parallel()
+
+	upstreamServer := newTextServer(t, "ok")
+
+	bundleServer, err := opatest.NewBundleServer(map[string][]byte{
+		"a.rego": []byte(`
+			package services.a
+
+			allow {
+				input.method == "GET"
+			}
+		`),
+		"b.rego": []byte(`
+			package services.b
+
+			default allow = false
+		`),
+	})
+	if err != nil {
+		t.Fatalf("Failed to create bundle server: %v", err)
+	}
+
+	// subtests run in parallel after the test returns
+	t.Cleanup(bundleServer.Close)
+
+	testCases := map[string]struct {
+		def bool
+		exp map[string]int
+	}{
+		"undefined denies by default": {
+			exp: map[string]int{
+				"GET /a":  http.StatusOK,
+				"POST /a": http.StatusForbidden,
+				"GET /b":  http.StatusForbidden,
+				"GET /c":  http.StatusForbidden,
+			},
+		},
+		"undefined allowed": {
+			def: true,
+			exp: map[string]int{
+				"GET /a":  http.StatusOK,
+				"POST /a": http.StatusOK,
+				"GET /b":  http.StatusForbidden,
+				"GET /c":  http.StatusOK,
+			},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			cfg, err := LoadConfig(strings.NewReader(fmt.Sprintf(`
+middlewares:
+  - kind: opa
+    properties:
+      bundle:
+        server-endpoint: %[1]q
+        path: bundle.tar.gz
+      wait: true
+      decision-path: services/c/allow
+      upstream-decision-paths:
+        a: services/a/allow
+        b: services/b/allow
+      default: %[3]t
+  - kind: opa
+    properties:
+      bundle:
+        server-endpoint: %[1]q
+        path: bundle.tar.gz
+      wait: true
+      default: true
+upstreams:
+  - name: a
+    endpoint: %[2]q
+    path-prefixes: ["/a"]
+  - name: b
+    endpoint: %[2]q
+    path-prefixes: ["/b"]
+  - name: c
+    endpoint: %[2]q
+`, bundleServer.URL, upstreamServer.URL, tc.def)))
+			if err != nil {
+				t.Fatalf("Failed to load config: %v", err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			proxyHandler, _, err := NewHandlerFromConfig(ctx, cfg, nil)
+			if err != nil {
+				t.Fatalf("Failed to create proxy handler: %v", err)
+			}
+			defer proxyHandler.Close()
+
+			// middlewares with the same bundle share an instance
+			if exp, got := 1, len(proxyHandler.resources.policies); exp != got {
+				t.Fatalf("Expected %d OPA instances, got %d", exp, got)
+			}
+
+			for request, exp := range tc.exp {
+				method, path, _ := strings.Cut(request, " ")
+
+				rec := httptest.NewRecorder()
+				proxyHandler.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+
+				if got := rec.Code; exp != got {
+					t.Errorf("%s: expected status %d, got %d", request, exp, got)
+				}
+			}
+		})
+	}
+}
+
+func TestOPAMiddlewareStructuredDecisions(t *testing.T) {
+	t.Parallel()
+
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := w.Write([]byte(r.Header.Get("X-User")))
+		if err != nil {
+			t.Errorf("Failed to write response: %s", err)
+		}
+	}))
+	defer upstreamServer.Close()
+
+	bundleServer, err := opatest.NewBundleServer(map[string][]byte{
+		"policy.rego": []byte(`
+			package authz
+
+			allow := {"allow": true, "upstream_headers": {"x-user": "alice"}} {
+				input.url == "/app"
+			}
+
+			allow := {"allow": false, "redirect": "https://login.example.com"} {
+				input.url == "/login"
+			}
+
+			allow := {
+				"status": 401,
+				"headers": {"www-authenticate": "Bearer"},
+				"body": "token required",
+			} {
+				input.url == "/api"
+			}
+
+			allow := "yes" {
+				input.url == "/invalid"
+			}
+		`),
+	})
+	if err != nil {
+		t.Fatalf("Failed to create bundle server: %v", err)
+	}
+	defer bundleServer.Close()
+
+	cfg, err := LoadConfig(strings.NewReader(fmt.Sprintf(`
+middlewares:
+  - kind: opa
+    properties:
+      bundle:
+        server-endpoint: %q
+        path: bundle.tar.gz
+      wait: true
+upstreams:
+  - endpoint: %q
+`, bundleServer.URL, upstreamServer.URL)))
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	proxyHandler, _, err := NewHandlerFromConfig(ctx, cfg, nil)
+	if err != nil {
+		t.Fatalf("Failed to create proxy handler: %v", err)
+	}
+	defer proxyHandler.Close()
+
+	testCases := map[string]struct {
+		status int
+		header string
+		value  string
+		body   string
+	}{
+		// the client can't set the header sent to the upstream
+		"/app":     {status: http.StatusOK, body: "alice"},
+		"/login":   {status: http.StatusFound, header: "Location", value: "https://login.example.com"},
+		"/api":     {status: http.StatusUnauthorized, header: "WWW-Authenticate", value: "Bearer", body: "token required"},
+		"/invalid": {status: http.StatusInternalServerError},
+		"/other":   {status: http.StatusForbidden},
+	}
+
+	for path, tc := range testCases {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("X-User", "mallory")
+
+		rec := httptest.NewRecorder()
+		proxyHandler.ServeHTTP(rec, req)
+
+		if exp, got := tc.status, rec.Code; exp != got {
+			t.Errorf("%s: expected status %d, got %d", path, exp, got)
+		}
+
+		if tc.header != "" {
+			if exp, got := tc.value, rec.Header().Get(tc.header); exp != got {
+				t.Errorf("%s: expected %s header %q, got %q", path, tc.header, exp, got)
+			}
+		}
+
+		if tc.body != "" {
+			if exp, got := tc.body, rec.Body.String(); exp != got {
+				t.Errorf("%s: expected body %q, got %q", path, exp, got)
+			}
+		}
+	}
+}
+
+func TestOPAMiddlewareLocalBundles(t *testing.T) {
+	t.Parallel()
+
+	upstreamServer := newTextServer(t, "ok")
+
+	bundlePath := filepath.Join(t.TempDir(), "bundle.tar.gz")
+
+	f, err := os.Create(bundlePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = bundle.NewWriter(f).Write(bundle.Bundle{
+		Data: map[string]any{},
+		Modules: []bundle.ModuleFile{
+			{
+				URL:    "policy.rego",
+				Path:   "policy.rego",
+				Parsed: ast.MustParseModule(regoPolicy),
+				Raw:    []byte(regoPolicy),
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := map[string]string{
+		"directory": "file: fixtures",
+		"tarball":   fmt.Sprintf("file: %q", bundlePath),
+		"inline":    fmt.Sprintf("rego: %q", regoPolicy),
+	}
+
+	for name, source := range testCases {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			cfg, err := LoadConfig(strings.NewReader(fmt.Sprintf(`
+middlewares:
+  - kind: opa
+    properties:
+      bundle:
+        %s
+upstreams:
+  - endpoint: %q
+`, source, upstreamServer.URL)))
+			if err != nil {
+				t.Fatalf("Failed to load config: %v", err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			proxyHandler, _, err := NewHandlerFromConfig(ctx, cfg, nil)
+			if err != nil {
+				t.Fatalf("Failed to create proxy handler: %v", err)
+			}
+			defer proxyHandler.Close()
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("X-Test", "true")
+
+			rec := httptest.NewRecorder()
+			proxyHandler.ServeHTTP(rec, req)
+
+			if exp, got := http.StatusOK, rec.Code; exp != got {
+				t.Errorf("Expected status %d with header, got %d", exp, got)
+			}
+
+			rec = httptest.NewRecorder()
+			proxyHandler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+			if exp, got := http.StatusForbidden, rec.Code; exp != got {
+				t.Errorf("Expected status %d without header, got %d", exp, got)
+			}
+		})
+	}
+}
+
+func TestOPAMiddlewareWatchBundle(t *testing.T) {
+	t.Parallel()
+
+	upstreamServer := newTextServer(t, "ok")
+
+	dir := t.TempDir()
+	policyPath := filepath.Join(dir, "policy.rego")
+
+	writePolicy := func(allow bool) {
+		t.Helper()
+
+		err := os.WriteFile(policyPath, []byte(fmt.Sprintf("package authz\n\nallow := %t\n", allow)), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writePolicy(false)
+
+	cfg, err := LoadConfig(strings.NewReader(fmt.Sprintf(`
+middlewares:
+  - kind: opa
+    properties:
+      bundle:
+        file: %q
+        watch: true
+upstreams:
+  - endpoint: %q
+`, dir, upstreamServer.URL)))
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	proxyHandler, _, err := NewHandlerFromConfig(ctx, cfg, nil)
+	if err != nil {
+		t.Fatalf("Failed to create proxy handler: %v", err)
+	}
+	defer proxyHandler.Close()
+
+	status := func() int {
+		rec := httptest.NewRecorder()
+		proxyHandler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+		return rec.Code
+	}
+
+	if exp, got := http.StatusForbidden, status(); exp != got {
+		t.Fatalf("Expected status %d, got %d", exp, got)
+	}
+
+	writePolicy(true)
+
+	for status() != http.StatusOK {
+		select {
+		case <-ctx.Done():
+			t.Fatal("Timed out waiting for the policy to be reloaded")
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+func TestOPAMiddlewareRequestBody(t *testing.T) {
+	t.Parallel()
+
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := io.Copy(w, r.Body)
+		if err != nil {
+			t.Errorf("Failed to write response: %s", err)
+		}
+	}))
+	defer upstreamServer.Close()
+
+	cfg, err := LoadConfig(strings.NewReader(fmt.Sprintf(`
+middlewares:
+  - kind: opa
+    properties:
+      bundle:
+        rego: |
+          package authz
+
+          allow {
+            input.upstream == "orders"
+            input.path_segments == ["orders"]
+            input.body.quantity < 10
+          }
+      max-body-bytes: 1024
+upstreams:
+  - name: orders
+    endpoint: %q
+`, upstreamServer.URL)))
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	proxyHandler, _, err := NewHandlerFromConfig(ctx, cfg, nil)
+	if err != nil {
+		t.Fatalf("Failed to create proxy handler: %v", err)
+	}
+	defer proxyHandler.Close()
+
+	testCases := map[string]int{
+		`{"quantity": 5}`:  http.StatusOK,
+		`{"quantity": 50}`: http.StatusForbidden,
+	}
+
+	for body, exp := range testCases {
+		req := httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+
+		rec := httptest.NewRecorder()
+		proxyHandler.ServeHTTP(rec, req)
+
+		if got := rec.Code; exp != got {
+			t.Errorf("%s: expected status %d, got %d", body, exp, got)
+		}
+
+		if exp == http.StatusOK && rec.Body.String() != body {
+			t.Errorf("%s: expected the upstream to receive the body, got %q", body, rec.Body.String())
+		}
+	}
+}
+
+func TestOPAMiddlewareTailscaleInput(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	policy, err := MiddlewareFromConfigMiddleware(ctx, ConfigMiddleware{
+		Kind: "opa",
+		Properties: &ConfigMiddlewarePropsOPA{
+			Bundle: ConfigMiddlewarePropsOPABundle{
+				Rego: `
+					package authz
+
+					import future.keywords.in
+
+					allow {
+						"tag:admin" in input.tailscale.tags
+					}
+				`,
+			},
+		},
+	}, nil)
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+
+	identity := whois.NewMiddleware(whois.Options{
+		Client: &whoistest.Client{
+			Identities: map[string]*apitype.WhoIsResponse{
+				"100.64.0.1": whoistest.NewIdentity("alice@example.com", "laptop", "tag:admin"),
+				"100.64.0.2": whoistest.NewIdentity("bob@example.com", "phone"),
+			},
+		},
+	})
+
+	handler := identity(policy(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})))
+
+	testCases := map[string]int{
+		"100.64.0.1:1234": http.StatusOK,
+		"100.64.0.2:1234": http.StatusForbidden,
+		"192.0.2.1:1234":  http.StatusForbidden,
+	}
+
+	for remoteAddr, exp := range testCases {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remoteAddr
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if got := rec.Code; exp != got {
+			t.Errorf("%s: expected status %d, got %d", remoteAddr, exp, got)
+		}
+	}
+}
+
+func TestOPAMiddlewareIdentityInput(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	policy, err := MiddlewareFromConfigMiddleware(ctx, ConfigMiddleware{
+		Kind: "opa",
+		Properties: &ConfigMiddlewarePropsOPA{
+			Bundle: ConfigMiddlewarePropsOPABundle{
+				Rego: `
+					package authz
+
+					import future.keywords.in
+
+					allow {
+						"admins" in input.identity.groups
+					}
+				`,
+			},
+		},
+	}, nil)
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+
+	handler := policy(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	testCases := map[string]struct {
+		claims identity.Claims
+		exp    int
+	}{
+		"admin": {
+			claims: identity.Claims{"email": "alice@example.com", "groups": []interface{}{"admins"}},
+			exp:    http.StatusOK,
+		},
+		"other group": {
+			claims: identity.Claims{"email": "bob@example.com", "groups": []interface{}{"dev"}},
+			exp:    http.StatusForbidden,
+		},
+		"signed out": {
+			exp: http.StatusForbidden,
+		},
+	}
+
+	for name, tc := range testCases {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tc.claims != nil {
+			req = req.WithContext(identity.NewContext(req.Context(), tc.claims))
+		}
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if got := rec.Code; tc.exp != got {
+			t.Errorf("%s: expected status %d, got %d", name, tc.exp, got)
+		}
+	}
+}
+
+func TestOPAMiddlewareDecisionLogs(t *testing.T) {
+	t.Parallel()
+
+	upstreamServer := newTextServer(t, "ok")
+
+	bundleServer, logs, err := opatest.NewBundleServerWithLogs(map[string][]byte{
+		"authz.rego": []byte(`
+			package authz
+
+			allow {
+				input.method == "GET"
+			}
+		`),
+	})
+	if err != nil {
+		t.Fatalf("Failed to create bundle server: %v", err)
+	}
+	defer bundleServer.Close()
+
+	cfg, err := LoadConfig(strings.NewReader(fmt.Sprintf(`
+middlewares:
+  - kind: opa
+    properties:
+      bundle:
+        server-endpoint: %q
+        path: /bundle.tar.gz
+      wait: true
+      decision-logs:
+        output: http
+        url: %q
+        flush-interval: 1h
+upstreams:
+  - name: example
+    endpoint: %q
+`, bundleServer.URL, bundleServer.URL+"/logs", upstreamServer.URL)))
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	proxyHandler, _, err := NewHandlerFromConfig(ctx, cfg, nil)
+	if err != nil {
+		t.Fatalf("Failed to create proxy handler: %v", err)
+	}
+	defer proxyHandler.Close()
+
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		req := httptest.NewRequest(method, "/example", nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		req.Header.Set("X-Request-Id", "req-"+method)
+
+		proxyHandler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// closing the handler sends the pending entries
+	err = proxyHandler.Close()
+	if err != nil {
+		t.Fatalf("Failed to close proxy handler: %v", err)
+	}
+
+	entries := logs.Entries()
+
+	if exp, got := 2, len(entries); exp != got {
+		t.Fatalf("Expected %d entries, got %d", exp, got)
+	}
+
+	for i, expResult := range []interface{}{true, nil} {
+		entry := entries[i]
+
+		if exp, got := expResult, entry["result"]; exp != got {
+			t.Errorf("Entry %d: result did not match expected: %v != %v", i, exp, got)
+		}
+
+		if exp, got := "authz/allow", entry["path"]; exp != got {
+			t.Errorf("Entry %d: path did not match expected: %v != %v", i, exp, got)
+		}
+
+		if entry["decision_id"] == "" || entry["decision_id"] == nil {
+			t.Errorf("Entry %d: expected a decision ID", i)
+		}
+
+		if entry["request_id"] == "" || entry["request_id"] == nil {
+			t.Errorf("Entry %d: expected a request ID", i)
+		}
+
+		if entry["bundle_revision"] == "" || entry["bundle_revision"] == nil {
+			t.Errorf("Entry %d: expected a bundle revision", i)
+		}
+
+		input, _ := entry["input"].(map[string]interface{})
+		headers, _ := input["headers"].(map[string]interface{})
+
+		if exp, got := opa.MaskedValue, headers["Authorization"]; exp != got {
+			t.Errorf("Entry %d: expected Authorization to be masked, got %v", i, got)
+		}
+	}
+}
+
+func TestOPAMiddlewareShadow(t *testing.T) {
+	t.Parallel()
+
+	upstreamServer := newTextServer(t, "ok")
+
+	logPath := filepath.Join(t.TempDir(), "decisions.log")
+
+	cfg, err := LoadConfig(strings.NewReader(fmt.Sprintf(`
+middlewares:
+  - name: shadow-mode
+    kind: opa
+    global: false
+    properties:
+      mode: shadow
+      bundle:
+        rego: |
+          package authz
+
+          allow {
+            input.method == "GET"
+          }
+      decision-logs:
+        output: file
+        path: %q
+  - name: shadow-policy
+    kind: opa
+    global: false
+    properties:
+      bundle:
+        rego: |
+          package authz
+
+          allow = true
+      shadow:
+        bundle:
+          rego: |
+            package authz
+
+            allow {
+              input.method == "GET"
+            }
+upstreams:
+  - name: new-policy
+    endpoint: %q
+    path-prefixes: ["/new"]
+    middlewares: ["shadow-mode"]
+  - name: migration
+    endpoint: %q
+    path-prefixes: ["/migration"]
+    middlewares: ["shadow-policy"]
+`, logPath, upstreamServer.URL, upstreamServer.URL)))
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	m := metrics.New()
+
+	proxyHandler, _, err := NewHandlerFromConfig(ctx, cfg, m)
+	if err != nil {
+		t.Fatalf("Failed to create proxy handler: %v", err)
+	}
+	defer proxyHandler.Close()
+
+	// requests are allowed whatever the shadow decision
+	for _, req := range []string{"GET /new", "POST /new", "GET /migration", "POST /migration"} {
+		method, path, _ := strings.Cut(req, " ")
+
+		rec := httptest.NewRecorder()
+		proxyHandler.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+
+		if exp, got := http.StatusOK, rec.Code; exp != got {
+			t.Errorf("%s: expected status %d, got %d", req, exp, got)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	for _, exp := range []string{
+		`tsnet_proxy_opa_decisions_total{result="allow"} 2`,
+		`tsnet_proxy_opa_shadow_decisions_total{result="allow"} 2`,
+		`tsnet_proxy_opa_shadow_decisions_total{result="deny"} 2`,
+		`tsnet_proxy_opa_shadow_mismatches_total{enforced="allow",shadow="deny",upstream="migration"} 1`,
+	} {
+		if !strings.Contains(rec.Body.String(), exp) {
+			t.Errorf("Expected metrics to contain %q", exp)
+		}
+	}
+
+	err = proxyHandler.Close()
+	if err != nil {
+		t.Fatalf("Failed to close proxy handler: %v", err)
+	}
+
+	logs, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatalf("Failed to read decision log: %v", err)
+	}
+
+	// the would be denial is logged as a shadow decision
+	if exp, got := 2, strings.Count(string(logs), `"shadow":true`); exp != got {
+		t.Errorf("Expected %d shadow decisions to be logged, got %d:\n%s", exp, got, logs)
+	}
+
+	if exp, got := 1, strings.Count(string(logs), `"result":null`); exp != got {
+		t.Errorf("Expected %d undefined decisions to be logged, got %d:\n%s", exp, got, logs)
+	}
+}
+
+// newHeldBundleServer returns a bundle server which holds downloads until
+// release is called.
+func newHeldBundleServer(t *testing.T) (*httptest.Server, func()) {
+	t.Helper()
+
+	bundleServer, err := opatest.NewBundleServer(map[string][]byte{
+		"authz.rego": []byte(`
+			package authz
+
+			allow = true
+		`),
+	})
+	if err != nil {
+		t.Fatalf("Failed to create bundle server: %v", err)
+	}
+
+	held := make(chan struct{})
+
+	var once sync.Once
+
+	release := func() { once.Do(func() { close(held) }) }
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-held:
+		case <-r.Context().Done():
+			return
+		}
+
+		bundleServer.Config.Handler.ServeHTTP(w, r)
+	}))
+
+	// cleanups run last first, downloads are released before closing
+	t.Cleanup(bundleServer.Close)
+	t.Cleanup(s.Close)
+	t.Cleanup(release)
+
+	return s, release
+}
+
+func TestOPAMiddlewareReadiness(t *testing.T) {
+	t.Parallel()
+
+	upstreamServer := newTextServer(t, "ok")
+
+	newConfig := func(t *testing.T, bundleServer *httptest.Server, props string) *Config {
+		t.Helper()
+
+		cfg, err := LoadConfig(strings.NewReader(fmt.Sprintf(`
+middlewares:
+  - kind: opa
+    properties:
+      bundle:
+        server-endpoint: %q
+        path: /bundle.tar.gz
+%s
+upstreams:
+  - endpoint: %q
+`, bundleServer.URL, props, upstreamServer.URL)))
+		if err != nil {
+			t.Fatalf("Failed to load config: %v", err)
+		}
+
+		return cfg
+	}
+
+	t.Run("wait timeout", func(t *testing.T) {
+		t.Parallel()
+
+		bundleServer, _ := newHeldBundleServer(t)
+
+		cfg := newConfig(t, bundleServer, "      wait: true\n      wait-timeout: 100ms")
+
+		_, _, err := NewHandlerFromConfig(context.Background(), cfg, nil)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("Expected the bundle wait to time out, got %v", err)
+		}
+	})
+
+	testCases := map[string]struct {
+		onError string
+		exp     int
+	}{
+		"default": {exp: http.StatusInternalServerError},
+		"deny":    {onError: "deny", exp: http.StatusForbidden},
+		"allow":   {onError: "allow", exp: http.StatusOK},
+		"503":     {onError: `"503"`, exp: http.StatusServiceUnavailable},
+	}
+
+	for name, tc := range testCases {
+		t.Run("on error "+name, func(t *testing.T) {
+			t.Parallel()
+
+			bundleServer, release := newHeldBundleServer(t)
+
+			props := ""
+			if tc.onError != "" {
+				props = "      on-error: " + tc.onError
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			proxyHandler, _, err := NewHandlerFromConfig(ctx, newConfig(t, bundleServer, props), nil)
+			if err != nil {
+				t.Fatalf("Failed to create proxy handler: %v", err)
+			}
+			defer proxyHandler.Close()
+
+			if exp, got := []PolicyStatus{{Bundle: bundleServer.URL + "/bundle.tar.gz"}}, proxyHandler.Policies(); !reflect.DeepEqual(exp, got) {
+				t.Fatalf("Policies did not match expected: %+v != %+v", exp, got)
+			}
+
+			rec := httptest.NewRecorder()
+			proxyHandler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+			if exp, got := tc.exp, rec.Code; exp != got {
+				t.Errorf("Expected status %d before activation, got %d", exp, got)
+			}
+
+			release()
+
+			for !proxyHandler.Policies()[0].Ready {
+				select {
+				case <-ctx.Done():
+					t.Fatal("Bundle was not activated")
+				case <-time.After(10 * time.Millisecond):
+				}
+			}
+
+			rec = httptest.NewRecorder()
+			proxyHandler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+			if exp, got := http.StatusOK, rec.Code; exp != got {
+				t.Errorf("Expected status %d after activation, got %d", exp, got)
+			}
+		})
+	}
+}
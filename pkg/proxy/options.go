@@ -1,6 +1,51 @@
 package proxy
 
+import (
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/charlieegan3/tool-tsnet-proxy/pkg/accesslog"
+	"github.com/charlieegan3/tool-tsnet-proxy/pkg/cache"
+	"github.com/charlieegan3/tool-tsnet-proxy/pkg/concurrency"
+	"github.com/charlieegan3/tool-tsnet-proxy/pkg/metrics"
+	"github.com/charlieegan3/tool-tsnet-proxy/pkg/requestid"
+)
+
 type Options struct {
 	Matchers    []Matcher
 	Middlewares []Middleware
+	Routes      []Route
+
+	// RequestID configures how the ID assigned to each request is sent
+	RequestID requestid.Options
+
+	// AccessLog, if set, logs every request once the response is sent. The
+	// identity defaults to the authenticated user's email.
+	AccessLog *accesslog.Options
+
+	// Metrics, if set, records request counts, latency and requests in
+	// flight
+	Metrics *metrics.Metrics
+
+	// TracerProvider, if set, is used to trace requests. Trace context sent
+	// by clients is always propagated to upstreams.
+	TracerProvider trace.TracerProvider
+}
+
+// Route is a Matcher with middlewares which are only applied to the
+// requests that it matches. Routes are checked after Matchers.
+type Route struct {
+	Name        string
+	Matcher     Matcher
+	Middlewares []Middleware
+
+	// Tailnet is the name of the tailnet used to reach the upstream, it's
+	// only used for logging.
+	Tailnet string
+
+	// Limiter, if set, limits the requests in flight to the upstream.
+	Limiter *concurrency.Limiter
+
+	// Caches are the stores used by the route's middlewares, they are
+	// purged by Handler.FlushCaches.
+	Caches []cache.Store
 }
@@ -5,50 +5,96 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/url"
-	"strconv"
+	"slices"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
-	"tailscale.com/tsnet"
-
-	"github.com/charlieegan3/tool-tsnet-proxy/pkg/doh"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/charlieegan3/tool-tsnet-proxy/pkg/accesslog"
+	"github.com/charlieegan3/tool-tsnet-proxy/pkg/bodylimit"
+	"github.com/charlieegan3/tool-tsnet-proxy/pkg/cache"
+	"github.com/charlieegan3/tool-tsnet-proxy/pkg/coalesce"
+	"github.com/charlieegan3/tool-tsnet-proxy/pkg/concurrency"
 	"github.com/charlieegan3/tool-tsnet-proxy/pkg/httpclient"
-	"github.com/charlieegan3/tool-tsnet-proxy/pkg/utils"
+	"github.com/charlieegan3/tool-tsnet-proxy/pkg/metrics"
+	"github.com/charlieegan3/tool-tsnet-proxy/pkg/requestid"
+	"github.com/charlieegan3/tool-tsnet-proxy/pkg/tracing"
 )
 
-func NewHandlerFromConfig(ctx context.Context, config *Config) (
-	http.Handler,
+// NewHandlerFromConfig builds the handler and DNS servers described by the
+// config, m can be nil if metrics aren't needed.
+func NewHandlerFromConfig(ctx context.Context, config *Config, m *metrics.Metrics) (
+	*Handler,
 	[]*dns.Server,
 	error,
 ) {
+	return newHandlerFromConfig(ctx, config, newResources(m, nil))
+}
+
+// Rebuild builds a new handler from config, reusing the tailnets, DoH
+// servers and OPA instances of h whose config has not changed. Only DNS
+// servers which have not been started yet are returned. Upstream states set
+// at runtime are carried over to upstreams with the same name.
+//
+// h keeps serving requests and must still be closed, resources passed on to
+// the new handler are left open.
+func (h *Handler) Rebuild(ctx context.Context, config *Config) (*Handler, []*dns.Server, error) {
+	handler, dnsServers, err := newHandlerFromConfig(ctx, config, newResources(h.metrics, h.resources))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, rt := range h.routes {
+		if state := UpstreamState(rt.state.Load()); state != UpstreamActive {
+			// upstreams which have been removed are ignored
+			//nolint:errcheck
+			handler.SetUpstreamState(rt.name, state)
+		}
+	}
+
+	return handler, dnsServers, nil
+}
+
+func newHandlerFromConfig(ctx context.Context, config *Config, res *resources) (
+	*Handler,
+	[]*dns.Server,
+	error,
+) {
+	m := res.metrics
+
+	// resources are owned by the handler once it's built
+	built := false
+
+	defer func() {
+		if !built {
+			res.discard()
+		}
+	}()
+
 	dnsServers := make([]httpclient.DNSServer, 0)
 	wrappedDNSServers := make([]*dns.Server, 0)
 
 	for _, dnsServer := range config.DNSServers {
 		if dnsServer.DoH {
-			wrappedDNSServerPort, err := utils.FreePort(0)
+			wrapped, isNew, err := res.dohServer(dnsServer.Addr)
 			if err != nil {
-				return nil, nil, fmt.Errorf("failed to find free port for wrapped DNS server: %w", err)
+				return nil, nil, err
 			}
 
-			addr := net.JoinHostPort("localhost", strconv.Itoa(wrappedDNSServerPort))
-
-			//nolint:contextcheck
-			dnsServer := doh.NewWrappingDNSServer(
-				&doh.WrappingDNSServerOptions{
-					Addr:       addr,
-					DoHServers: []string{dnsServer.Addr},
-					Timeout:    1 * time.Second,
-				},
-			)
-
-			wrappedDNSServers = append(wrappedDNSServers, dnsServer)
+			if isNew {
+				wrappedDNSServers = append(wrappedDNSServers, wrapped.server)
+			}
 
 			dnsServers = append(dnsServers, httpclient.DNSServer{
-				Addr:    addr,
+				Addr:    wrapped.addr,
 				Network: "tcp",
 			})
 
@@ -61,16 +107,32 @@ func NewHandlerFromConfig(ctx context.Context, config *Config) (
 		})
 	}
 
-	tsNetServers := make(map[string]*tsnet.Server)
+	tsNetServers := make(map[string]*tailnet)
 	for k, tnet := range config.Tailnets {
-		tsNetServers[k] = &tsnet.Server{
-			Hostname: tnet.ID,
-			AuthKey:  tnet.AuthKey,
+		tsNetServers[k] = res.tailnet(k, tnet)
+	}
+
+	// config middlewares are created once and shared by the routes which
+	// use them
+	configMiddlewares := make([]Middleware, len(config.Middlewares))
+	namedMiddlewares := make(map[string]Middleware)
+
+	for i, configMiddleware := range config.Middlewares {
+		middleware, err := res.middleware(ctx, configMiddleware)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create middleware: %w", err)
+		}
+
+		configMiddlewares[i] = middleware
+
+		if configMiddleware.Name != "" {
+			namedMiddlewares[configMiddleware.Name] = middleware
 		}
 	}
 
-	// Create matchers from upstreams
-	matchers := make([]Matcher, 0)
+	// Create routes from upstreams
+	routes := make([]Route, 0)
+	routeMiddlewareNames := make([][]string, 0)
 
 	for _, upstream := range config.Upstreams {
 		upstreamURL, err := url.Parse(upstream.Endpoint)
@@ -93,51 +155,266 @@ func NewHandlerFromConfig(ctx context.Context, config *Config) (
 			dialFunc = tsNetServer.Dial
 		}
 
+		// unnamed upstreams are identified by their endpoint
+		name := upstream.Name
+		if name == "" {
+			name = upstream.Endpoint
+		}
+
 		client := httpclient.NewUpsteamClient(httpclient.UpstreamClientOptions{
 			Host:               upstreamURL.Hostname(),
 			Port:               upstreamURL.Port(),
 			DNSServers:         dnsServers,
 			DialFunc:           dialFunc,
 			InsecureSkipVerify: upstream.InsecureSkipVerify,
+			Name:               name,
+			Metrics:            m,
+		})
+
+		var (
+			routeMiddlewares []Middleware
+			middlewareNames  []string
+			caches           []cache.Store
+		)
+
+		addMiddleware := func(name string, mw Middleware) {
+			routeMiddlewares = append(routeMiddlewares, tracedMiddleware(name, mw))
+			middlewareNames = append(middlewareNames, name)
+		}
+
+		if upstream.MaxRequestBody > 0 {
+			addMiddleware("bodylimit", bodylimit.NewMiddleware(bodylimit.Options{
+				MaxBytes: upstream.MaxRequestBody,
+			}))
+		}
+
+		// global middlewares run first, then those the upstream references
+		for i, configMiddleware := range config.Middlewares {
+			if configMiddleware.IsGlobal() && !slices.Contains(upstream.SkipMiddlewares, configMiddleware.Name) {
+				addMiddleware(configMiddleware.DisplayName(), configMiddlewares[i])
+			}
+		}
+
+		for _, middlewareName := range upstream.Middlewares {
+			middleware, ok := namedMiddlewares[middlewareName]
+			if !ok {
+				return nil, nil, fmt.Errorf("middleware %q for upstream %q not found", middlewareName, name)
+			}
+
+			addMiddleware(middlewareName, middleware)
+		}
+
+		if upstream.Cache != nil {
+			cacheMiddleware, store, err := cacheMiddlewareFromConfig(upstream.Cache)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to create cache for upstream %q: %w", upstream.Endpoint, err)
+			}
+
+			addMiddleware("cache", cacheMiddleware)
+			caches = append(caches, store)
+		}
+
+		if upstream.Coalesce != nil {
+			addMiddleware("coalesce", coalesce.NewMiddleware(coalesce.Options{
+				VaryHeaders: upstream.Coalesce.VaryHeaders,
+				MaxBodySize: upstream.Coalesce.MaxBodySize,
+			}))
+		}
+
+		var limiter *concurrency.Limiter
+
+		if upstream.Concurrency != nil {
+			if upstream.Concurrency.MaxInFlight <= 0 {
+				return nil, nil, fmt.Errorf("max-in-flight for upstream %q must be greater than zero", name)
+			}
+
+			limiter = concurrency.NewLimiter(concurrency.Options{
+				MaxInFlight:  upstream.Concurrency.MaxInFlight,
+				MaxQueue:     upstream.Concurrency.MaxQueue,
+				QueueTimeout: upstream.Concurrency.QueueTimeout,
+			})
+		}
+
+		routes = append(routes, Route{
+			Name:        name,
+			Matcher:     MatcherFromUpstream(upstream, client),
+			Middlewares: routeMiddlewares,
+			Tailnet:     upstream.Tailnet,
+			Limiter:     limiter,
+			Caches:      caches,
 		})
-		matcher := MatcherFromUpstream(upstream, client)
-		matchers = append(matchers, matcher)
+
+		routeMiddlewareNames = append(routeMiddlewareNames, middlewareNames)
 	}
 
 	// Create middlewares from config middlewares
 	middlewares := make([]Middleware, 0)
+	middlewareNames := make([]string, 0)
+
+	// body limits are checked before any other middleware reads the body
+	if config.MaxRequestBody > 0 || config.MinRequestRate > 0 {
+		middlewares = append(middlewares, tracedMiddleware("bodylimit", bodylimit.NewMiddleware(bodylimit.Options{
+			MaxBytes:    config.MaxRequestBody,
+			MinRate:     config.MinRequestRate,
+			GracePeriod: config.MinRequestRateGrace,
+		})))
+		middlewareNames = append(middlewareNames, "bodylimit")
+	}
+
+	var accessLogOptions *accesslog.Options
 
-	for _, configMiddleware := range config.Middlewares {
-		middleware, err := MiddlewareFromConfigMiddleware(ctx, configMiddleware)
+	if config.AccessLog != nil {
+		output, err := accessLogOutputFromConfig(config.AccessLog)
 		if err != nil {
-			return nil, nil, fmt.Errorf("failed to create middleware: %w", err)
+			return nil, nil, err
 		}
 
-		middlewares = append(middlewares, middleware)
+		res.closers = append(res.closers, output)
+
+		format, err := accesslog.NewFormat(config.AccessLog.Format, config.AccessLog.Template)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create access log format: %w", err)
+		}
+
+		accessLogOptions = &accesslog.Options{
+			Format:       format,
+			Writer:       output,
+			SampleRate:   config.AccessLog.SampleRate,
+			ExcludePaths: config.AccessLog.ExcludePaths,
+		}
+	}
+
+	var tracerProvider trace.TracerProvider
+
+	if config.Tracing != nil {
+		tp, err := tracing.NewProvider(ctx, tracing.Options{
+			Endpoint:    config.Tracing.Endpoint,
+			Headers:     config.Tracing.Headers,
+			ServiceName: config.Tracing.ServiceName,
+			SampleRatio: config.Tracing.SampleRatio,
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create tracer provider: %w", err)
+		}
+
+		tracerProvider = tp
+
+		res.closers = append(res.closers, closerFunc(func() error {
+			return tp.Shutdown(context.Background())
+		}))
 	}
 
 	// Create a new proxy handler with the matchers and middlewares
 	handler, err := NewHandler(&Options{
-		Matchers:    matchers,
+		Routes:      routes,
 		Middlewares: middlewares,
+		RequestID: requestid.Options{
+			Header:        config.RequestID.Header,
+			TrustIncoming: config.RequestID.TrustIncoming,
+		},
+		AccessLog:      accessLogOptions,
+		Metrics:        m,
+		TracerProvider: tracerProvider,
 	})
 	if err != nil {
 		return nil, nil, err
 	}
 
+	handler.config = config
+	handler.tailnets = tsNetServers
+	handler.resources = res
+	handler.middlewares = middlewareNames
+
+	for i := range handler.routes {
+		handler.routes[i].middlewares = routeMiddlewareNames[i]
+	}
+
+	res.commit()
+
+	built = true
+
+	m.SetTailnetStates(func() map[string]string {
+		return tailnetStates(tsNetServers)
+	})
+	m.SetQueueDepths(handler.queueDepths)
+
 	return handler, wrappedDNSServers, nil
 }
 
-func NewHandler(opts *Options) (http.Handler, error) {
-	var handler http.Handler
-	handler = &proxy{
-		matchers: opts.Matchers,
+func NewHandler(opts *Options) (*Handler, error) {
+	routes := make([]route, 0, len(opts.Matchers)+len(opts.Routes))
+
+	for _, matcher := range opts.Matchers {
+		routes = append(routes, route{
+			matcher:  matcher,
+			handler:  forwarder{},
+			inFlight: &atomic.Int64{},
+			state:    &atomic.Int32{},
+			health:   &health{},
+		})
+	}
+
+	for _, r := range opts.Routes {
+		var handler http.Handler = forwarder{}
+
+		// the limiter is innermost so that responses from route middlewares,
+		// such as cache hits, don't need to wait for a slot
+		if r.Limiter != nil {
+			handler = r.Limiter.Middleware(handler)
+		}
+
+		handler, err := applyMiddlewares(handler, r.Middlewares)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build route %q: %w", r.Name, err)
+		}
+
+		routes = append(routes, route{
+			name:     r.Name,
+			matcher:  r.Matcher,
+			handler:  handler,
+			tailnet:  r.Tailnet,
+			limiter:  r.Limiter,
+			caches:   r.Caches,
+			inFlight: &atomic.Int64{},
+			state:    &atomic.Int32{},
+			health:   &health{},
+		})
+	}
+
+	handler, err := applyMiddlewares(dispatcher{metrics: opts.Metrics}, opts.Middlewares)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &Handler{routes: routes, handler: handler, metrics: opts.Metrics}
+
+	var entry http.Handler = http.HandlerFunc(h.serve)
+
+	if opts.AccessLog != nil {
+		accessLogOptions := *opts.AccessLog
+		if accessLogOptions.Identity == nil {
+			accessLogOptions.Identity = func(r *http.Request) string {
+				return EmailFromContext(r.Context())
+			}
+		}
+
+		entry = accesslog.NewMiddleware(accessLogOptions)(entry)
 	}
 
-	// middlewares are applied in reverse order to they are called
-	// in the order that they appear in the slice.
-	for i := len(opts.Middlewares) - 1; i >= 0; i-- {
-		handler = opts.Middlewares[i](handler)
+	h.entry = traceRequests(
+		tracing.Tracer(opts.TracerProvider),
+		requestid.NewMiddleware(opts.RequestID)(entry),
+	)
+
+	return h, nil
+}
+
+// applyMiddlewares wraps the handler in middlewares, they are applied in
+// reverse order to they are called in the order that they appear in the
+// slice.
+func applyMiddlewares(handler http.Handler, middlewares []Middleware) (http.Handler, error) {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
 		if handler == nil {
 			return nil, errors.New("middleware returned nil handler")
 		}
@@ -146,46 +423,229 @@ func NewHandler(opts *Options) (http.Handler, error) {
 	return handler, nil
 }
 
-type proxy struct {
-	matchers []Matcher
+type route struct {
+	name     string
+	matcher  Matcher
+	handler  http.Handler
+	tailnet  string
+	limiter  *concurrency.Limiter
+	caches   []cache.Store
+	inFlight *atomic.Int64
+
+	// middlewares are the names of the route's middlewares
+	middlewares []string
+
+	// state is an UpstreamState which can be changed at runtime
+	state  *atomic.Int32
+	health *health
+}
+
+// Handler matches the request to a route before running the middlewares so
+// that they can use the matched upstream.
+type Handler struct {
+	routes  []route
+	handler http.Handler
+	metrics *metrics.Metrics
+
+	// entry starts the trace, assigns the request ID and starts the access
+	// log entry before anything else happens
+	entry http.Handler
+
+	// active is the number of requests being served
+	active atomic.Int64
+
+	// config, tailnets and resources are only set for handlers built by
+	// NewHandlerFromConfig
+	config      *Config
+	tailnets    map[string]*tailnet
+	resources   *resources
+	middlewares []string
+}
+
+// UpstreamStats is the current load on a route.
+type UpstreamStats struct {
+	Name        string
+	Tailnet     string
+	Middlewares []string
+	InFlight    int
+	QueueDepth  int
+	State       UpstreamState
+	Health      Health
 }
 
-func (p *proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	var client *http.Client
-	var endpoint string
+// Upstreams returns the current load on each route in the order they are
+// matched.
+func (h *Handler) Upstreams() []UpstreamStats {
+	stats := make([]UpstreamStats, 0, len(h.routes))
+
+	for _, rt := range h.routes {
+		s := UpstreamStats{
+			Name:        rt.name,
+			Tailnet:     rt.tailnet,
+			Middlewares: rt.middlewares,
+			InFlight:    int(rt.inFlight.Load()),
+			State:       UpstreamState(rt.state.Load()),
+			Health:      rt.health.get(),
+		}
+
+		if rt.limiter != nil {
+			s.QueueDepth = rt.limiter.QueueDepth()
+		}
+
+		stats = append(stats, s)
+	}
+
+	return stats
+}
 
-	for _, matcher := range p.matchers {
-		var ok bool
+// queueDepths returns the queue depth of each route with a concurrency
+// limit.
+func (h *Handler) queueDepths() map[string]int {
+	depths := make(map[string]int)
 
-		client, endpoint, ok = matcher(r)
-		if ok {
-			break
+	for _, rt := range h.routes {
+		if rt.limiter != nil {
+			depths[rt.name] = rt.limiter.QueueDepth()
 		}
 	}
 
-	if client == nil {
-		http.Error(w, "not found", http.StatusNotFound)
+	return depths
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.active.Add(1)
+	defer h.active.Add(-1)
+
+	h.entry.ServeHTTP(w, r)
+}
+
+func (h *Handler) serve(w http.ResponseWriter, r *http.Request) {
+	span := trace.SpanFromContext(r.Context())
+	span.SetAttributes(attribute.String("request.id", requestid.FromContext(r.Context())))
+
+	var m *match
+
+	for _, rt := range h.routes {
+		// disabled routes are skipped so requests can match later routes
+		if UpstreamState(rt.state.Load()) == UpstreamDisabled {
+			continue
+		}
+
+		client, endpoint, ok := rt.matcher(r)
+		if !ok {
+			continue
+		}
+
+		if client != nil {
+			m = &match{route: rt, client: client, endpoint: endpoint}
+
+			accesslog.SetUpstream(r.Context(), rt.name, endpoint, rt.tailnet)
+			span.SetAttributes(attribute.String("proxy.upstream", rt.name))
+		}
+
+		break
+	}
+
+	ctx := context.WithValue(r.Context(), matchContextKey{}, m)
+
+	if h.metrics == nil {
+		h.handler.ServeHTTP(w, r.WithContext(ctx))
+
+		return
+	}
+
+	start := time.Now()
+	sw := &statusWriter{ResponseWriter: w}
+
+	h.handler.ServeHTTP(sw, r.WithContext(ctx))
+
+	var upstream string
+	if m != nil {
+		upstream = m.route.name
+	}
+
+	h.metrics.ObserveRequest(upstream, r.Method, sw.status(), time.Since(start))
+}
+
+// dispatcher passes the request on to the matched route's handler.
+type dispatcher struct {
+	metrics *metrics.Metrics
+}
+
+func (d dispatcher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m := matchFromContext(r.Context())
+	if m == nil {
+		requestid.Error(w, r, "not found", http.StatusNotFound)
+
+		return
+	}
+
+	if UpstreamState(m.route.state.Load()) == UpstreamDraining {
+		w.Header().Set("Retry-After", "1")
+		requestid.Error(w, r, "upstream is draining", http.StatusServiceUnavailable)
+
+		return
+	}
+
+	m.route.inFlight.Add(1)
+	defer m.route.inFlight.Add(-1)
+
+	defer d.metrics.InFlight(m.route.name)()
+
+	m.route.handler.ServeHTTP(w, r)
+}
+
+// forwarder sends requests to the upstream selected by the route's matcher.
+type forwarder struct{}
+
+func (forwarder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u := matchFromContext(r.Context())
+	if u == nil {
+		requestid.Error(w, r, "not found", http.StatusNotFound)
 
 		return
 	}
 
-	rURL, err := url.Parse(fmt.Sprintf("%s%s", endpoint, r.URL.Path))
+	rURL, err := url.Parse(fmt.Sprintf("%s%s", u.endpoint, r.URL.Path))
 	if err != nil {
-		http.Error(w, "failed to build downstream URL", http.StatusInternalServerError)
+		requestid.Error(w, r, "failed to build downstream URL", http.StatusInternalServerError)
 
 		return
 	}
 
-	req := &http.Request{
+	ctx, span := tracing.Start(r.Context(), "upstream.round_trip", trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("proxy.upstream", u.route.name),
+		attribute.String("url.full", rURL.String()),
+	)
+
+	tracing.Inject(ctx, r.Header)
+
+	req := (&http.Request{
 		Method: r.Method,
 		Header: r.Header,
 		URL:    rURL,
 		Body:   r.Body,
-	}
+	}).WithContext(ctx)
+
+	start := time.Now()
+	resp, err := u.client.Do(req)
+
+	accesslog.SetUpstreamLatency(r.Context(), time.Since(start))
+	u.route.health.record(err)
 
-	resp, err := client.Do(req)
 	if err != nil {
-		http.Error(w,
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+
+		slog.ErrorContext(r.Context(), "failed to send request to upstream",
+			"upstream", u.route.name,
+			"error", err,
+		)
+
+		requestid.Error(w, r,
 			fmt.Errorf("failed to send request: %w", err).Error(),
 			http.StatusBadGateway,
 		)
@@ -194,6 +654,8 @@ func (p *proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	defer resp.Body.Close()
 
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+
 	for k, v := range resp.Header {
 		for _, vv := range v {
 			w.Header().Add(k, vv)
@@ -204,8 +666,13 @@ func (p *proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	_, err = io.Copy(w, resp.Body)
 	if err != nil {
-		http.Error(
-			w,
+		slog.ErrorContext(r.Context(), "failed to copy response body",
+			"upstream", u.route.name,
+			"error", err,
+		)
+
+		requestid.Error(
+			w, r,
 			fmt.Errorf("failed to copy response body: %w", err).Error(),
 			http.StatusBadGateway,
 		)
@@ -213,3 +680,92 @@ func (p *proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
+
+// statusWriter records the status code of the response for metrics.
+type statusWriter struct {
+	http.ResponseWriter
+
+	code int
+}
+
+func (w *statusWriter) WriteHeader(statusCode int) {
+	if w.code == 0 {
+		w.code = statusCode
+	}
+
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+
+	//nolint:wrapcheck
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusWriter) status() int {
+	if w.code == 0 {
+		return http.StatusOK
+	}
+
+	return w.code
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// traceRequests starts a server span for each request, continuing the trace
+// sent by the client if there is one.
+func traceRequests(tracer trace.Tracer, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := tracer.Start(
+			tracing.Extract(r.Context(), r.Header),
+			"proxy.request",
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("server.address", r.Host),
+				attribute.String("url.path", r.URL.Path),
+			),
+		)
+		defer span.End()
+
+		sw := &statusWriter{ResponseWriter: w}
+
+		next.ServeHTTP(sw, r.WithContext(ctx))
+
+		span.SetAttributes(attribute.Int("http.response.status_code", sw.status()))
+
+		if sw.status() >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(sw.status()))
+		}
+	})
+}
+
+// tracedMiddleware wraps the middleware in a span, the span includes the
+// time spent in the rest of the chain.
+func tracedMiddleware(name string, mw Middleware) Middleware {
+	return func(next http.Handler) http.Handler {
+		wrapped := mw(next)
+		if wrapped == nil {
+			return nil
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, span := tracing.Start(r.Context(), "middleware "+name)
+			defer span.End()
+
+			wrapped.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// closerFunc adapts a func to io.Closer.
+type closerFunc func() error
+
+func (f closerFunc) Close() error {
+	return f()
+}
@@ -1,7 +1,9 @@
 package proxy
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
@@ -11,15 +13,23 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/miekg/dns"
 	"github.com/open-policy-agent/opa/sdk"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 
+	"github.com/charlieegan3/tool-tsnet-proxy/pkg/accesslog"
+	"github.com/charlieegan3/tool-tsnet-proxy/pkg/cache"
+	"github.com/charlieegan3/tool-tsnet-proxy/pkg/concurrency"
 	"github.com/charlieegan3/tool-tsnet-proxy/pkg/doh"
 	"github.com/charlieegan3/tool-tsnet-proxy/pkg/httpclient"
+	"github.com/charlieegan3/tool-tsnet-proxy/pkg/metrics"
 	opa "github.com/charlieegan3/tool-tsnet-proxy/pkg/opa"
+	"github.com/charlieegan3/tool-tsnet-proxy/pkg/requestid"
 	dnstest "github.com/charlieegan3/tool-tsnet-proxy/pkg/test/dns"
 	dohtest "github.com/charlieegan3/tool-tsnet-proxy/pkg/test/doh"
 	opatest "github.com/charlieegan3/tool-tsnet-proxy/pkg/test/opa"
@@ -378,6 +388,7 @@ middlewares:
       bundle:
         server-endpoint: %q
         path: "/bundles/policy.tar.gz"
+      wait: true
 upstreams:
   - endpoint: "http://internal.example.com:%s"
     hosts:
@@ -400,7 +411,7 @@ upstreams:
 	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
 	defer cancel()
 
-	proxyHandler, dohDNSServers, err := NewHandlerFromConfig(ctx, loadedCfg)
+	proxyHandler, dohDNSServers, err := NewHandlerFromConfig(ctx, loadedCfg, nil)
 	if err != nil {
 		t.Fatalf("Failed to create proxy handler: %v", err)
 	}
@@ -474,6 +485,68 @@ upstreams:
 	assertStatusAndContent(t, resp, http.StatusOK, headerValue)
 }
 
+func TestProxyWithUpstreamMiddlewares(t *testing.T) {
+	t.Parallel()
+
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := fmt.Fprintf(w, "auth=%s admin=%s", r.Header.Get("X-Auth"), r.Header.Get("X-Admin"))
+		if err != nil {
+			t.Errorf("Failed to write response: %s", err)
+		}
+	}))
+	defer upstreamServer.Close()
+
+	cfg, err := LoadConfig(strings.NewReader(fmt.Sprintf(`
+middlewares:
+  - name: auth
+    kind: test-header
+    properties:
+      name: X-Auth
+      value: "true"
+  - name: admin
+    kind: test-header
+    global: false
+    properties:
+      name: X-Admin
+      value: "true"
+upstreams:
+  - name: status
+    endpoint: %[1]q
+    path-prefixes: ["/status"]
+    skip-middlewares: ["auth"]
+  - name: admin
+    endpoint: %[1]q
+    path-prefixes: ["/admin"]
+    middlewares: ["admin"]
+  - name: app
+    endpoint: %[1]q
+`, upstreamServer.URL)))
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	proxyHandler, _, err := NewHandlerFromConfig(context.Background(), cfg, nil)
+	if err != nil {
+		t.Fatalf("Failed to create proxy handler: %v", err)
+	}
+	defer proxyHandler.Close()
+
+	testCases := map[string]string{
+		"/status": "auth= admin=",
+		"/admin":  "auth=true admin=true",
+		"/":       "auth=true admin=",
+	}
+
+	for path, exp := range testCases {
+		rec := httptest.NewRecorder()
+		proxyHandler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+
+		if got := rec.Body.String(); exp != got {
+			t.Errorf("%s: expected %q, got %q", path, exp, got)
+		}
+	}
+}
+
 func TestProxyWithDoH(t *testing.T) {
 	t.Parallel()
 
@@ -536,7 +609,7 @@ upstreams:
       - "bar.example.com"
     path-prefixes:
       - "/bar"
-`, dnsServer.Addr, upstreamServer.URL, externalHost)
+`, dohServer.URL, upstreamServer.URL, externalHost)
 
 	loadedCfg, err := LoadConfig(strings.NewReader(cfg))
 	if err != nil {
@@ -546,7 +619,7 @@ upstreams:
 	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
 	defer cancel()
 
-	proxyHandler, _, err := NewHandlerFromConfig(ctx, loadedCfg)
+	proxyHandler, _, err := NewHandlerFromConfig(ctx, loadedCfg, nil)
 	if err != nil {
 		t.Fatalf("Failed to create proxy handler: %v", err)
 	}
@@ -581,6 +654,320 @@ upstreams:
 	assertStatusAndContent(t, resp, http.StatusOK, "upstream")
 }
 
+func TestProxyWithRouteCache(t *testing.T) {
+	t.Parallel()
+
+	var upstreamCalls atomic.Int32
+
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamCalls.Add(1)
+
+		w.Header().Set("Cache-Control", "max-age=60")
+
+		_, err := w.Write([]byte(r.URL.Path))
+		if err != nil {
+			t.Fatalf("Failed to write response: %s", err)
+		}
+	}))
+	defer upstreamServer.Close()
+
+	matcherForPrefix := func(prefix string) Matcher {
+		return func(req *http.Request) (*http.Client, string, bool) {
+			if !strings.HasPrefix(req.URL.Path, prefix) {
+				return nil, "", false
+			}
+
+			return upstreamServer.Client(), upstreamServer.URL, true
+		}
+	}
+
+	proxyHandler, err := NewHandler(&Options{
+		Routes: []Route{
+			{
+				Name:    "cached",
+				Matcher: matcherForPrefix("/cached"),
+				Middlewares: []Middleware{
+					cache.NewMiddleware(cache.Options{Store: cache.NewMemoryStore(0)}),
+				},
+			},
+			{
+				Name:    "uncached",
+				Matcher: matcherForPrefix("/uncached"),
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create proxy handler: %v", err)
+	}
+
+	proxyServer := httptest.NewServer(proxyHandler)
+	defer proxyServer.Close()
+
+	for _, path := range []string{"/cached", "/cached", "/uncached", "/uncached", "/missing"} {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, proxyServer.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := proxyServer.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		if path == "/missing" {
+			assertStatusAndContent(t, resp, http.StatusNotFound, "not found")
+
+			continue
+		}
+
+		assertStatusAndContent(t, resp, http.StatusOK, path)
+	}
+
+	if exp, got := int32(3), upstreamCalls.Load(); exp != got {
+		t.Fatalf("Expected %d upstream calls, got %d", exp, got)
+	}
+}
+
+func TestProxyWithRouteLimiter(t *testing.T) {
+	t.Parallel()
+
+	started := make(chan struct{})
+	finish := make(chan struct{})
+
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		close(started)
+		<-finish
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstreamServer.Close()
+
+	proxyHandler, err := NewHandler(&Options{
+		Routes: []Route{
+			{
+				Name: "limited",
+				Matcher: func(_ *http.Request) (*http.Client, string, bool) {
+					return upstreamServer.Client(), upstreamServer.URL, true
+				},
+				Limiter: concurrency.NewLimiter(concurrency.Options{MaxInFlight: 1}),
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create proxy handler: %v", err)
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		proxyHandler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	}()
+
+	<-started
+
+	stats := proxyHandler.Upstreams()
+	if len(stats) != 1 || stats[0].Name != "limited" || stats[0].InFlight != 1 {
+		t.Fatalf("Unexpected upstream stats: %+v", stats)
+	}
+
+	rec := httptest.NewRecorder()
+	proxyHandler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if exp, got := http.StatusServiceUnavailable, rec.Code; exp != got {
+		t.Fatalf("Expected status %d, got %d", exp, got)
+	}
+
+	close(finish)
+	<-done
+}
+
+func TestProxyQueueDepthMetric(t *testing.T) {
+	t.Parallel()
+
+	started := make(chan struct{}, 2)
+	finish := make(chan struct{})
+
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		started <- struct{}{}
+		<-finish
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstreamServer.Close()
+
+	cfg, err := LoadConfig(strings.NewReader(fmt.Sprintf(`
+upstreams:
+  - name: limited
+    endpoint: %q
+    concurrency:
+      max-in-flight: 1
+      max-queue: 1
+`, upstreamServer.URL)))
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	m := metrics.New()
+
+	proxyHandler, _, err := NewHandlerFromConfig(context.Background(), cfg, m)
+	if err != nil {
+		t.Fatalf("Failed to create proxy handler: %v", err)
+	}
+	defer proxyHandler.Close()
+
+	done := make(chan struct{}, 2)
+
+	for range 2 {
+		go func() {
+			proxyHandler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+			done <- struct{}{}
+		}()
+	}
+
+	<-started
+
+	exp := `tsnet_proxy_concurrency_queue_depth{upstream="limited"} 1`
+
+	deadline := time.Now().Add(time.Second)
+
+	for {
+		rec := httptest.NewRecorder()
+		m.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+		if strings.Contains(rec.Body.String(), exp) {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected metrics to contain %q", exp)
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	close(finish)
+	<-done
+	<-done
+}
+
+func TestProxyRequestBodyLimitFromConfig(t *testing.T) {
+	t.Parallel()
+
+	// bodies over the limit are cut short, so the upstream can't
+	// check for errors copying them
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		//nolint:errcheck
+		io.Copy(w, r.Body)
+	}))
+	defer upstreamServer.Close()
+
+	cfg, err := LoadConfig(strings.NewReader(fmt.Sprintf(`
+max-request-body: 10
+upstreams:
+  - endpoint: %q
+    path-prefixes:
+      - "/small"
+    max-request-body: 5
+  - endpoint: %q
+`, upstreamServer.URL, upstreamServer.URL)))
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	proxyHandler, _, err := NewHandlerFromConfig(context.Background(), cfg, nil)
+	if err != nil {
+		t.Fatalf("Failed to create proxy handler: %v", err)
+	}
+
+	proxyServer := httptest.NewServer(proxyHandler)
+	defer proxyServer.Close()
+
+	tests := []struct {
+		path   string
+		body   string
+		status int
+	}{
+		{"/small", "12345", http.StatusOK},
+		{"/small", "123456", http.StatusRequestEntityTooLarge},
+		{"/large", "123456", http.StatusOK},
+		{"/large", "12345678901", http.StatusRequestEntityTooLarge},
+	}
+
+	for _, test := range tests {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, proxyServer.URL+test.path, strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// send the body without a content length so that the limit is
+		// reached while it's being read
+		req.ContentLength = -1
+
+		resp, err := proxyServer.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != test.status {
+			t.Errorf("Expected status %d for %s with body %q, got %d", test.status, test.path, test.body, resp.StatusCode)
+		}
+	}
+}
+
+func TestProxyRequestID(t *testing.T) {
+	t.Parallel()
+
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := w.Write([]byte(r.Header.Get("X-Request-ID")))
+		if err != nil {
+			t.Errorf("Failed to write response: %s", err)
+		}
+	}))
+	defer upstreamServer.Close()
+
+	proxyHandler, err := NewHandler(&Options{
+		Matchers: []Matcher{
+			func(req *http.Request) (*http.Client, string, bool) {
+				return upstreamServer.Client(), upstreamServer.URL, req.URL.Path == "/found"
+			},
+		},
+		RequestID: requestid.Options{TrustIncoming: true},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create proxy handler: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	proxyHandler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/found", nil))
+
+	id := rec.Header().Get("X-Request-ID")
+	if id == "" || rec.Body.String() != id {
+		t.Fatalf("Expected request ID %q to be sent upstream, got %q", id, rec.Body.String())
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/missing", nil)
+	req.Header.Set("X-Request-ID", "incoming-id")
+
+	rec = httptest.NewRecorder()
+	proxyHandler.ServeHTTP(rec, req)
+
+	if exp, got := "incoming-id", rec.Header().Get("X-Request-ID"); exp != got {
+		t.Fatalf("Expected request ID %q, got %q", exp, got)
+	}
+
+	if !strings.Contains(rec.Body.String(), "request id: incoming-id") {
+		t.Fatalf("Expected error page to contain request ID, got %q", rec.Body.String())
+	}
+}
+
 func assertStatusAndContent(t *testing.T, resp *http.Response, status int, content string) {
 	t.Helper()
 
@@ -619,3 +1006,172 @@ func newTestServerAndClient(
 
 	return s, sURL, c
 }
+
+func TestProxyAccessLog(t *testing.T) {
+	t.Parallel()
+
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, err := w.Write([]byte("ok"))
+		if err != nil {
+			t.Errorf("Failed to write response: %s", err)
+		}
+	}))
+	defer upstreamServer.Close()
+
+	var buf bytes.Buffer
+
+	proxyHandler, err := NewHandler(&Options{
+		Routes: []Route{
+			{
+				Name:    "internal",
+				Tailnet: "tsnet",
+				Matcher: func(req *http.Request) (*http.Client, string, bool) {
+					return upstreamServer.Client(), upstreamServer.URL, req.URL.Path == "/found"
+				},
+			},
+		},
+		AccessLog: &accesslog.Options{
+			Format: accesslog.JSONFormat,
+			Writer: &buf,
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create proxy handler: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/found", nil)
+	req = req.WithContext(context.WithValue(req.Context(), EmailContextKey, "user@example.com"))
+
+	rec := httptest.NewRecorder()
+	proxyHandler.ServeHTTP(rec, req)
+
+	var entry map[string]any
+
+	err = json.Unmarshal(buf.Bytes(), &entry)
+	if err != nil {
+		t.Fatalf("Failed to decode access log entry %q: %v", buf.String(), err)
+	}
+
+	exp := map[string]any{
+		"upstream":   "internal",
+		"endpoint":   upstreamServer.URL,
+		"tailnet":    "tsnet",
+		"identity":   "user@example.com",
+		"request_id": rec.Header().Get("X-Request-ID"),
+		"bytes_out":  float64(2),
+	}
+
+	for k, v := range exp {
+		if entry[k] != v {
+			t.Errorf("Expected %s to be %v, got %v", k, v, entry[k])
+		}
+	}
+}
+
+func TestProxyMetrics(t *testing.T) {
+	t.Parallel()
+
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer upstreamServer.Close()
+
+	m := metrics.New()
+
+	proxyHandler, err := NewHandler(&Options{
+		Routes: []Route{
+			{
+				Name: "internal",
+				Matcher: func(req *http.Request) (*http.Client, string, bool) {
+					return upstreamServer.Client(), upstreamServer.URL, req.URL.Path == "/found"
+				},
+			},
+		},
+		Metrics: m,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create proxy handler: %v", err)
+	}
+
+	for _, path := range []string{"/found", "/found", "/missing"} {
+		proxyHandler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	for _, exp := range []string{
+		`tsnet_proxy_requests_total{code="2xx",method="GET",upstream="internal"} 2`,
+		`tsnet_proxy_requests_total{code="4xx",method="GET",upstream="none"} 1`,
+		`tsnet_proxy_requests_in_flight{upstream="internal"} 0`,
+	} {
+		if !strings.Contains(rec.Body.String(), exp) {
+			t.Errorf("Expected metrics to contain %q", exp)
+		}
+	}
+}
+
+func TestProxyTracing(t *testing.T) {
+	t.Parallel()
+
+	var upstreamTraceparent string
+
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamTraceparent = r.Header.Get("traceparent")
+
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstreamServer.Close()
+
+	sr := tracetest.NewSpanRecorder()
+
+	proxyHandler, err := NewHandler(&Options{
+		Routes: []Route{
+			{
+				Name: "internal",
+				Matcher: func(_ *http.Request) (*http.Client, string, bool) {
+					return upstreamServer.Client(), upstreamServer.URL, true
+				},
+				Middlewares: []Middleware{
+					tracedMiddleware("noop", func(next http.Handler) http.Handler { return next }),
+				},
+			},
+		},
+		TracerProvider: sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)),
+	})
+	if err != nil {
+		t.Fatalf("Failed to create proxy handler: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	proxyHandler.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, s := range sr.Ended() {
+		spans[s.Name()] = s
+	}
+
+	for _, name := range []string{"proxy.request", "middleware noop", "upstream.round_trip"} {
+		s, ok := spans[name]
+		if !ok {
+			t.Fatalf("Expected span %q, got %v", name, spans)
+		}
+
+		if exp, got := "4bf92f3577b34da6a3ce929d0e0e4736", s.SpanContext().TraceID().String(); exp != got {
+			t.Fatalf("Expected span %q to continue trace %s, got %s", name, exp, got)
+		}
+	}
+
+	if exp, got := "00f067aa0ba902b7", spans["proxy.request"].Parent().SpanID().String(); exp != got {
+		t.Fatalf("Expected proxy.request to be a child of the client span %s, got %s", exp, got)
+	}
+
+	roundTrip := spans["upstream.round_trip"].SpanContext()
+
+	exp := fmt.Sprintf("00-%s-%s-01", roundTrip.TraceID(), roundTrip.SpanID())
+	if upstreamTraceparent != exp {
+		t.Fatalf("Expected upstream traceparent %s, got %s", exp, upstreamTraceparent)
+	}
+}
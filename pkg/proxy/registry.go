@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/charlieegan3/tool-tsnet-proxy/pkg/metrics"
+)
+
+// MiddlewareFactory builds a middleware from its decoded properties.
+type MiddlewareFactory[P any] func(ctx context.Context, env *MiddlewareEnv, props *P) (Middleware, error)
+
+// MiddlewareEnv is passed to middleware factories by the handler being
+// built.
+type MiddlewareEnv struct {
+	// Metrics is nil when metrics aren't needed
+	Metrics *metrics.Metrics
+
+	res *resources
+}
+
+// AddCloser closes c when the handler is closed, or straight away if the
+// handler fails to build.
+func (e *MiddlewareEnv) AddCloser(c io.Closer) {
+	e.res.mu.Lock()
+	defer e.res.mu.Unlock()
+
+	e.res.closers = append(e.res.closers, c)
+}
+
+// PropertiesValidator is implemented by properties which can check their
+// values. The problems in a returned *ValidationError are paths relative to
+// the properties block, any other error is reported for the whole block.
+type PropertiesValidator interface {
+	Validate() error
+}
+
+type middlewareKind struct {
+	properties func() any
+	build      func(ctx context.Context, env *MiddlewareEnv, props any) (Middleware, error)
+}
+
+var middlewareRegistry = struct {
+	mu    sync.RWMutex
+	kinds map[string]middlewareKind
+}{
+	kinds: make(map[string]middlewareKind),
+}
+
+//nolint:gochecknoinits
+func init() {
+	RegisterMiddleware("identity", identityMiddlewareFactory)
+	RegisterMiddleware("opa", opaMiddlewareFactory)
+	RegisterMiddleware("ratelimit", rateLimitMiddlewareFactory)
+	RegisterMiddleware("tailscale", tailscaleMiddlewareFactory)
+}
+
+// RegisterMiddleware adds a middleware kind which can be used in config.
+// The properties block of middlewares of the kind is decoded into a P,
+// which is zero when there is no block. If *P implements
+// PropertiesValidator, it's checked when the config is loaded.
+//
+// Kinds must be registered before config using them is loaded, it panics
+// if the kind is already registered.
+func RegisterMiddleware[P any](kind string, factory MiddlewareFactory[P]) {
+	middlewareRegistry.mu.Lock()
+	defer middlewareRegistry.mu.Unlock()
+
+	if _, ok := middlewareRegistry.kinds[kind]; ok {
+		panic(fmt.Sprintf("middleware kind %q is already registered", kind))
+	}
+
+	middlewareRegistry.kinds[kind] = middlewareKind{
+		properties: func() any { return new(P) },
+		build: func(ctx context.Context, env *MiddlewareEnv, props any) (Middleware, error) {
+			if props == nil {
+				props = new(P)
+			}
+
+			p, ok := props.(*P)
+			if !ok {
+				return nil, fmt.Errorf("properties for %s middleware are %T, expected %T", kind, props, new(P))
+			}
+
+			return factory(ctx, env, p)
+		},
+	}
+}
+
+// MiddlewareKinds returns the registered kinds in name order.
+func MiddlewareKinds() []string {
+	middlewareRegistry.mu.RLock()
+	defer middlewareRegistry.mu.RUnlock()
+
+	return sortedKeys(middlewareRegistry.kinds)
+}
+
+func lookupMiddlewareKind(kind string) (middlewareKind, bool) {
+	middlewareRegistry.mu.RLock()
+	defer middlewareRegistry.mu.RUnlock()
+
+	k, ok := middlewareRegistry.kinds[kind]
+
+	return k, ok
+}
+
+func (res *resources) middleware(ctx context.Context, config ConfigMiddleware) (Middleware, error) {
+	kind, ok := lookupMiddlewareKind(config.Kind)
+	if !ok {
+		return nil, fmt.Errorf("unknown middleware kind %q", config.Kind)
+	}
+
+	mw, err := kind.build(ctx, &MiddlewareEnv{Metrics: res.metrics, res: res}, config.Properties)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s middleware: %w", config.Kind, err)
+	}
+
+	if mw == nil {
+		return nil, errors.New("middleware factory returned nil middleware")
+	}
+
+	return mw, nil
+}
@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+type testHeaderProps struct {
+	Name  string `yaml:"name"`
+	Value string `yaml:"value"`
+}
+
+func (p *testHeaderProps) Validate() error {
+	if p.Name == "" {
+		return &ValidationError{Problems: []string{"name: required"}}
+	}
+
+	return nil
+}
+
+type closeCounter struct {
+	closed atomic.Int32
+}
+
+func (c *closeCounter) Close() error {
+	c.closed.Add(1)
+
+	return nil
+}
+
+var testHeaderCloser = &closeCounter{}
+
+// kinds are registered before tests run since the registry is shared by
+// parallel tests
+//
+//nolint:gochecknoinits
+func init() {
+	RegisterMiddleware("test-header", func(_ context.Context, env *MiddlewareEnv, props *testHeaderProps) (Middleware, error) {
+		env.AddCloser(testHeaderCloser)
+
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				r.Header.Set(props.Name, props.Value)
+				next.ServeHTTP(w, r)
+			})
+		}, nil
+	})
+}
+
+func TestRegisterMiddleware(t *testing.T) {
+	t.Parallel()
+
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := w.Write([]byte(r.Header.Get("X-Test")))
+		if err != nil {
+			t.Errorf("Failed to write response: %s", err)
+		}
+	}))
+	defer upstreamServer.Close()
+
+	cfg, err := LoadConfig(strings.NewReader(fmt.Sprintf(`
+middlewares:
+  - kind: test-header
+    properties:
+      name: X-Test
+      value: registered
+upstreams:
+  - endpoint: %q
+`, upstreamServer.URL)))
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	if exp, got := (&testHeaderProps{Name: "X-Test", Value: "registered"}), cfg.Middlewares[0].Properties; !reflect.DeepEqual(exp, got) {
+		t.Fatalf("Properties did not match expected: %+v != %+v", exp, got)
+	}
+
+	closed := testHeaderCloser.closed.Load()
+
+	proxyHandler, _, err := NewHandlerFromConfig(context.Background(), cfg, nil)
+	if err != nil {
+		t.Fatalf("Failed to create proxy handler: %v", err)
+	}
+
+	if exp, got := "registered", get(t, proxyHandler); exp != got {
+		t.Fatalf("Expected %q, got %q", exp, got)
+	}
+
+	err = proxyHandler.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exp, got := closed+1, testHeaderCloser.closed.Load(); exp != got {
+		t.Fatalf("Expected closer to be closed %d times, got %d", exp, got)
+	}
+
+	_, err = LoadConfig(strings.NewReader(`
+middlewares:
+  - kind: test-header
+    properties:
+      value: registered
+`))
+
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("Expected a validation error, got %v", err)
+	}
+
+	if exp, got := []string{"middlewares[0].properties.name: required"}, validationErr.Problems; !reflect.DeepEqual(exp, got) {
+		t.Fatalf("Problems did not match expected: %v != %v", exp, got)
+	}
+
+	_, err = LoadConfig(strings.NewReader(`
+middlewares:
+  - kind: test-header
+    properties:
+      header: X-Test
+`))
+	if err == nil || !strings.Contains(err.Error(), "field header not found") {
+		t.Fatalf("Expected unknown property to be rejected, got %v", err)
+	}
+}
+
+func TestRegisterMiddlewareDuplicate(t *testing.T) {
+	t.Parallel()
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("Expected registering a kind twice to panic")
+		}
+	}()
+
+	RegisterMiddleware("ratelimit", func(context.Context, *MiddlewareEnv, *struct{}) (Middleware, error) {
+		return nil, errors.New("not used")
+	})
+}
@@ -0,0 +1,284 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/miekg/dns"
+
+	"github.com/charlieegan3/tool-tsnet-proxy/pkg/metrics"
+)
+
+const (
+	defaultDrainTimeout  = 30 * time.Second
+	defaultWatchDebounce = 250 * time.Millisecond
+)
+
+type ReloaderOptions struct {
+	// Path is the config file to load
+	Path    string
+	Metrics *metrics.Metrics
+
+	// StartDNSServer is called for each DNS server which needs to be
+	// started, servers are shut down when the handler using them is closed.
+	StartDNSServer func(*dns.Server)
+
+	// DrainTimeout is how long requests in flight on a replaced handler are
+	// given to finish before it's closed, it defaults to 30 seconds.
+	DrainTimeout time.Duration
+
+	// OnReload, if set, is called with the replaced and new handlers once
+	// the new handler is serving requests, before the replaced handler is
+	// closed.
+	OnReload func(prev, h *Handler)
+}
+
+// Reloader serves requests using the handler built from the config file,
+// the handler is swapped atomically when the config is reloaded.
+// Requests in flight finish on the handler they started on.
+type Reloader struct {
+	opts ReloaderOptions
+
+	current atomic.Pointer[Handler]
+
+	// mu serialises reloads
+	mu sync.Mutex
+	// retiring are closed once their requests in flight have finished
+	retiring sync.WaitGroup
+}
+
+// NewReloader loads the config and builds the first handler.
+func NewReloader(ctx context.Context, opts ReloaderOptions) (*Reloader, error) {
+	if opts.DrainTimeout == 0 {
+		opts.DrainTimeout = defaultDrainTimeout
+	}
+
+	if opts.StartDNSServer == nil {
+		return nil, errors.New("StartDNSServer is required")
+	}
+
+	cfg, err := LoadConfigFile(opts.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	h, dnsServers, err := NewHandlerFromConfig(ctx, cfg, opts.Metrics)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create proxy: %w", err)
+	}
+
+	for _, s := range dnsServers {
+		opts.StartDNSServer(s)
+	}
+
+	r := &Reloader{opts: opts}
+	r.current.Store(h)
+
+	return r, nil
+}
+
+// Handler returns the handler which is currently serving requests.
+func (r *Reloader) Handler() *Handler {
+	return r.current.Load()
+}
+
+func (r *Reloader) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	h := r.acquire()
+	defer h.active.Add(-1)
+
+	h.entry.ServeHTTP(w, req)
+}
+
+// acquire returns the current handler with a request counted as in flight
+// on it. Replaced handlers are retired once they're no longer current, so
+// a handler which is still current after counting the request won't be
+// closed until the request has finished.
+func (r *Reloader) acquire() *Handler {
+	for {
+		h := r.current.Load()
+		h.active.Add(1)
+
+		if r.current.Load() == h {
+			return h
+		}
+
+		h.active.Add(-1)
+	}
+}
+
+// Reload loads the config file again and swaps in a handler built from
+// it. If the config can't be loaded or the handler can't be built, the
+// current handler is kept and the error is returned.
+func (r *Reloader) Reload(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cfg, err := LoadConfigFile(r.opts.Path)
+	if err != nil {
+		return err
+	}
+
+	old := r.current.Load()
+
+	h, dnsServers, err := old.Rebuild(ctx, cfg)
+	if err != nil {
+		return fmt.Errorf("failed to create proxy: %w", err)
+	}
+
+	for _, s := range dnsServers {
+		r.opts.StartDNSServer(s)
+	}
+
+	r.current.Store(h)
+
+	if r.opts.OnReload != nil {
+		r.opts.OnReload(old, h)
+	}
+
+	r.retiring.Add(1)
+
+	go func() {
+		defer r.retiring.Done()
+
+		r.retire(old)
+	}()
+
+	return nil
+}
+
+// retire closes h once it has no requests in flight, or the drain timeout
+// has passed.
+func (r *Reloader) retire(h *Handler) {
+	deadline := time.Now().Add(r.opts.DrainTimeout)
+
+	for h.active.Load() > 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if err := h.Close(); err != nil {
+		slog.Error("failed to close replaced handler", "error", err)
+	}
+}
+
+// Watch reloads the config when the file changes until ctx is done. The
+// directory is watched rather than the file so that files replaced by
+// editors or by a rename, as in Kubernetes config maps, are picked up.
+func (r *Reloader) Watch(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create watcher: %w", err)
+	}
+	defer watcher.Close()
+
+	path := filepath.Clean(r.opts.Path)
+
+	err = r.watchIncludes(watcher, path)
+	if err != nil {
+		return err
+	}
+
+	// a single save often produces several events
+	debounce := time.NewTimer(time.Hour)
+	debounce.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			debounce.Stop()
+
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+
+			if !r.watched(event.Name, path) {
+				continue
+			}
+
+			debounce.Reset(defaultWatchDebounce)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+
+			slog.Error("config watcher failed", "error", err)
+		case <-debounce.C:
+			err := r.Reload(ctx)
+			if err != nil {
+				slog.Error("failed to reload config, keeping the current config", "error", err)
+
+				continue
+			}
+
+			slog.Info("reloaded config", "path", path)
+
+			// the reloaded config may include files in new directories
+			err = r.watchIncludes(watcher, path)
+			if err != nil {
+				slog.Error("failed to watch included config", "error", err)
+			}
+		}
+	}
+}
+
+// watchIncludes watches the directory of the config file and those of
+// the files it includes.
+func (r *Reloader) watchIncludes(watcher *fsnotify.Watcher, path string) error {
+	dirs := []string{filepath.Dir(path)}
+
+	for _, pattern := range r.Handler().Config().includes {
+		// included directories are watched for files being added
+		if info, err := os.Stat(pattern); err == nil && info.IsDir() {
+			dirs = append(dirs, pattern)
+
+			continue
+		}
+
+		dirs = append(dirs, filepath.Dir(pattern))
+	}
+
+	for _, dir := range dirs {
+		err := watcher.Add(dir)
+		if err != nil {
+			return fmt.Errorf("failed to watch config: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// watched returns true for events which may have changed the config file
+// at path or the files it includes, including the ..data symlink swapped by
+// Kubernetes.
+func (r *Reloader) watched(name, path string) bool {
+	name = filepath.Clean(name)
+
+	if name == path || filepath.Base(name) == "..data" {
+		return true
+	}
+
+	return r.Handler().Config().watchedBy(name)
+}
+
+// Close closes the current handler, and waits for replaced handlers to be
+// closed.
+func (r *Reloader) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	err := r.current.Load().Close()
+
+	r.retiring.Wait()
+
+	return err
+}
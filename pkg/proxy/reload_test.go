@@ -0,0 +1,432 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func newTextServer(t *testing.T, body string) *httptest.Server {
+	t.Helper()
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, err := w.Write([]byte(body))
+		if err != nil {
+			t.Errorf("Failed to write response: %s", err)
+		}
+	}))
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+func writeConfig(t *testing.T, path, config string) {
+	t.Helper()
+
+	err := os.WriteFile(path, []byte(config), 0o600)
+	if err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+}
+
+func get(t *testing.T, h http.Handler) string {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	return rec.Body.String()
+}
+
+func TestReloaderReload(t *testing.T) {
+	t.Parallel()
+
+	upstream1 := newTextServer(t, "1")
+	upstream2 := newTextServer(t, "2")
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, path, fmt.Sprintf("upstreams:\n  - name: app\n    endpoint: %q\n", upstream1.URL))
+
+	var reloaded [][2]*Handler
+
+	reloader, err := NewReloader(context.Background(), ReloaderOptions{
+		Path:           path,
+		StartDNSServer: func(*dns.Server) {},
+		OnReload: func(prev, h *Handler) {
+			reloaded = append(reloaded, [2]*Handler{prev, h})
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create reloader: %v", err)
+	}
+	defer reloader.Close()
+
+	first := reloader.Handler()
+
+	if exp, got := "1", get(t, reloader); exp != got {
+		t.Fatalf("Expected %q, got %q", exp, got)
+	}
+
+	err = reloader.Handler().SetUpstreamState("app", UpstreamDraining)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeConfig(t, path, fmt.Sprintf("upstreams:\n  - name: app\n    endpoint: %q\n", upstream2.URL))
+
+	err = reloader.Reload(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+
+	if exp, got := UpstreamDraining, reloader.Handler().Upstreams()[0].State; exp != got {
+		t.Fatalf("Expected state %s to be carried over, got %s", exp, got)
+	}
+
+	if exp, got := [][2]*Handler{{first, reloader.Handler()}}, reloaded; !reflect.DeepEqual(exp, got) {
+		t.Fatalf("Expected OnReload to be called with the replaced and new handlers")
+	}
+
+	err = reloader.Handler().SetUpstreamState("app", UpstreamActive)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exp, got := "2", get(t, reloader); exp != got {
+		t.Fatalf("Expected %q, got %q", exp, got)
+	}
+
+	// an upstream in an unknown tailnet can't be built
+	writeConfig(t, path, fmt.Sprintf("upstreams:\n  - endpoint: %q\n    tailnet: missing\n", upstream1.URL))
+
+	err = reloader.Reload(context.Background())
+	if err == nil {
+		t.Fatal("Expected invalid config to fail to reload")
+	}
+
+	if exp, got := "2", get(t, reloader); exp != got {
+		t.Fatalf("Expected the previous config to be kept, got %q", got)
+	}
+
+	if exp, got := 1, len(reloaded); exp != got {
+		t.Fatalf("Expected OnReload not to be called for a failed reload, got %d calls", got)
+	}
+}
+
+func TestReloaderInFlightRequests(t *testing.T) {
+	t.Parallel()
+
+	started := make(chan struct{})
+	finish := make(chan struct{})
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		close(started)
+		<-finish
+
+		_, err := w.Write([]byte("slow"))
+		if err != nil {
+			t.Errorf("Failed to write response: %s", err)
+		}
+	}))
+	defer slow.Close()
+
+	fast := newTextServer(t, "fast")
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, path, fmt.Sprintf("upstreams:\n  - endpoint: %q\n", slow.URL))
+
+	reloader, err := NewReloader(context.Background(), ReloaderOptions{
+		Path:           path,
+		StartDNSServer: func(*dns.Server) {},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create reloader: %v", err)
+	}
+	defer reloader.Close()
+
+	old := reloader.Handler()
+
+	proxyServer := httptest.NewServer(reloader)
+	defer proxyServer.Close()
+
+	done := make(chan string)
+
+	go func() {
+		resp, err := proxyServer.Client().Get(proxyServer.URL)
+		if err != nil {
+			t.Errorf("Failed to make request: %v", err)
+			done <- ""
+
+			return
+		}
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Errorf("Failed to read body: %v", err)
+		}
+
+		done <- string(body)
+	}()
+
+	<-started
+
+	writeConfig(t, path, fmt.Sprintf("upstreams:\n  - endpoint: %q\n", fast.URL))
+
+	err = reloader.Reload(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+
+	if exp, got := "fast", get(t, reloader); exp != got {
+		t.Fatalf("Expected %q, got %q", exp, got)
+	}
+
+	if exp, got := int64(1), old.active.Load(); exp != got {
+		t.Fatalf("Expected %d request in flight on the old handler, got %d", exp, got)
+	}
+
+	close(finish)
+
+	if exp, got := "slow", <-done; exp != got {
+		t.Fatalf("Expected %q, got %q", exp, got)
+	}
+}
+
+func TestReloaderWatch(t *testing.T) {
+	t.Parallel()
+
+	upstream1 := newTextServer(t, "1")
+	upstream2 := newTextServer(t, "2")
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, path, fmt.Sprintf("upstreams:\n  - endpoint: %q\n", upstream1.URL))
+
+	reloader, err := NewReloader(context.Background(), ReloaderOptions{
+		Path:           path,
+		StartDNSServer: func(*dns.Server) {},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create reloader: %v", err)
+	}
+	defer reloader.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	watching := make(chan error)
+
+	go func() {
+		watching <- reloader.Watch(ctx)
+	}()
+
+	// give the watcher time to start
+	time.Sleep(100 * time.Millisecond)
+
+	writeConfig(t, path, fmt.Sprintf("upstreams:\n  - endpoint: %q\n", upstream2.URL))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for get(t, reloader) != "2" {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for config to be reloaded")
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	cancel()
+
+	if err := <-watching; err != nil {
+		t.Fatalf("Failed to watch config: %v", err)
+	}
+}
+
+func TestHandlerRebuildReusesResources(t *testing.T) {
+	t.Parallel()
+
+	config := func(tailnetID string) *Config {
+		cfg, err := LoadConfig(strings.NewReader(fmt.Sprintf(`
+dns-servers:
+  - addr: https://dns.example.com/dns-query
+    doh: true
+tailnets:
+  a:
+    id: a
+  b:
+    id: %s
+upstreams:
+  - endpoint: http://example.com
+    tailnet: a
+`, tailnetID)))
+		if err != nil {
+			t.Fatalf("Failed to load config: %v", err)
+		}
+
+		return cfg
+	}
+
+	h1, dnsServers, err := NewHandlerFromConfig(context.Background(), config("b"), nil)
+	if err != nil {
+		t.Fatalf("Failed to create proxy handler: %v", err)
+	}
+	defer h1.Close()
+
+	if exp, got := 1, len(dnsServers); exp != got {
+		t.Fatalf("Expected %d DNS servers, got %d", exp, got)
+	}
+
+	h2, dnsServers, err := h1.Rebuild(context.Background(), config("b2"))
+	if err != nil {
+		t.Fatalf("Failed to rebuild proxy handler: %v", err)
+	}
+	defer h2.Close()
+
+	if exp, got := 0, len(dnsServers); exp != got {
+		t.Fatalf("Expected the DoH server to be reused, got %d new DNS servers", got)
+	}
+
+	if h1.tailnets["a"] != h2.tailnets["a"] {
+		t.Error("Expected unchanged tailnet to be reused")
+	}
+
+	if h1.tailnets["b"] == h2.tailnets["b"] {
+		t.Error("Expected changed tailnet to be replaced")
+	}
+
+	if h2.TailnetReplaced(h1, "a") || !h2.TailnetReplaced(h1, "b") {
+		t.Error("Expected only the changed tailnet to be reported as replaced")
+	}
+
+	if !h1.resources.handedOver[h1.tailnets["a"]] {
+		t.Error("Expected reused tailnet to be left open when the old handler is closed")
+	}
+
+	if h1.resources.handedOver[h1.tailnets["b"]] {
+		t.Error("Expected replaced tailnet to be closed with the old handler")
+	}
+
+	// a failed rebuild leaves the resources with the old handler
+	_, _, err = h2.Rebuild(context.Background(), &Config{
+		Tailnets:  config("b2").Tailnets,
+		Upstreams: []ConfigUpstream{{Endpoint: "http://example.com", Tailnet: "missing"}},
+	})
+	if err == nil {
+		t.Fatal("Expected rebuild to fail")
+	}
+
+	if len(h2.resources.handedOver) != 0 {
+		t.Errorf("Expected no resources to be handed over, got %d", len(h2.resources.handedOver))
+	}
+}
+
+func TestReloaderConcurrentReloads(t *testing.T) {
+	t.Parallel()
+
+	upstream := newTextServer(t, "ok")
+
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "decisions.log")
+
+	// each reload builds a new policy and decision logger, which are closed
+	// with the replaced handler. Decisions logged after that are lost.
+	config := func(i int) string {
+		return fmt.Sprintf(`
+middlewares:
+  - kind: opa
+    properties:
+      bundle:
+        rego: |
+          package authz
+
+          # %d
+          allow = true
+      decision-logs:
+        output: file
+        path: %q
+upstreams:
+  - endpoint: %q
+`, i, logPath, upstream.URL)
+	}
+
+	path := filepath.Join(dir, "config.yaml")
+	writeConfig(t, path, config(0))
+
+	reloader, err := NewReloader(context.Background(), ReloaderOptions{
+		Path:           path,
+		StartDNSServer: func(*dns.Server) {},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create reloader: %v", err)
+	}
+
+	done := make(chan struct{})
+
+	var (
+		wg       sync.WaitGroup
+		requests atomic.Int64
+	)
+
+	for range 8 {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				rec := httptest.NewRecorder()
+				reloader.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+				requests.Add(1)
+
+				if exp, got := http.StatusOK, rec.Code; exp != got {
+					t.Errorf("Expected status %d during reloads, got %d: %s", exp, got, rec.Body.String())
+
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 1; i <= 10; i++ {
+		writeConfig(t, path, config(i))
+
+		err = reloader.Reload(context.Background())
+		if err != nil {
+			t.Fatalf("Failed to reload: %v", err)
+		}
+	}
+
+	close(done)
+	wg.Wait()
+
+	err = reloader.Close()
+	if err != nil {
+		t.Fatalf("Failed to close reloader: %v", err)
+	}
+
+	b, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatalf("Failed to read decision log: %v", err)
+	}
+
+	if exp, got := requests.Load(), int64(strings.Count(string(b), "\n")); exp != got {
+		t.Fatalf("Expected %d decisions to be logged, got %d", exp, got)
+	}
+}
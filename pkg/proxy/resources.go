@@ -0,0 +1,412 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/open-policy-agent/opa/sdk"
+	"tailscale.com/tsnet"
+
+	"github.com/charlieegan3/tool-tsnet-proxy/pkg/doh"
+	"github.com/charlieegan3/tool-tsnet-proxy/pkg/metrics"
+	"github.com/charlieegan3/tool-tsnet-proxy/pkg/opa"
+	"github.com/charlieegan3/tool-tsnet-proxy/pkg/utils"
+)
+
+// resources are opened while building a handler from config and released
+// when the handler is closed. When a handler is rebuilt, tailnets, DoH
+// servers and OPA instances with unchanged config are passed on to the new
+// handler rather than being opened again.
+type resources struct {
+	metrics *metrics.Metrics
+
+	// prev are the resources of the handler being replaced, if any
+	prev *resources
+
+	mu         sync.Mutex
+	tailnets   map[string]*tailnet
+	dohServers map[string]*dohServer
+	policies   []*policy
+	closers    []io.Closer
+
+	// reused are taken from prev, they are only handed over once the new
+	// handler has been built
+	reused map[any]bool
+	// handedOver have been passed on to a newer handler and are not closed
+	handedOver map[any]bool
+}
+
+func newResources(m *metrics.Metrics, prev *resources) *resources {
+	return &resources{
+		metrics:    m,
+		prev:       prev,
+		tailnets:   make(map[string]*tailnet),
+		dohServers: make(map[string]*dohServer),
+		reused:     make(map[any]bool),
+		handedOver: make(map[any]bool),
+	}
+}
+
+// dohServer is a DNS server which forwards queries to a DoH server.
+type dohServer struct {
+	upstream string
+	addr     string
+	server   *dns.Server
+	started  atomic.Bool
+}
+
+// policy is an OPA instance and the bundle it loads, middlewares using the
+// same bundle share an instance.
+type policy struct {
+	bundle ConfigMiddlewarePropsOPABundle
+	inst   *sdk.OPA
+
+	// ready is closed once the bundle has been activated
+	ready chan struct{}
+
+	// stopWatch stops reloading a local bundle, if it's watched
+	stopWatch context.CancelFunc
+	// dir holds inline Rego, it's removed when the policy is closed
+	dir string
+}
+
+// isReady returns true once the bundle has been activated, decisions made
+// before then would be made without any policy.
+func (p *policy) isReady() bool {
+	select {
+	case <-p.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// wait blocks until the bundle has been activated or ctx is done.
+func (p *policy) wait(ctx context.Context) error {
+	select {
+	case <-p.ready:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("bundle was not activated: %w", ctx.Err())
+	}
+}
+
+func (p *policy) close(ctx context.Context) error {
+	if p.stopWatch != nil {
+		p.stopWatch()
+	}
+
+	p.inst.Stop(ctx)
+
+	if p.dir != "" {
+		err := os.RemoveAll(p.dir)
+		if err != nil {
+			return fmt.Errorf("failed to remove policy dir: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// tailnet returns the tsnet server for the tailnet, reusing the previous
+// server if its config is unchanged.
+func (res *resources) tailnet(name string, config ConfigTailnet) *tailnet {
+	res.mu.Lock()
+	defer res.mu.Unlock()
+
+	if t, ok := res.tailnets[name]; ok {
+		return t
+	}
+
+	t := res.prev.findTailnet(name, config)
+	if t != nil {
+		res.reused[t] = true
+	} else {
+		t = &tailnet{
+			config: config,
+			server: &tsnet.Server{
+				Hostname: config.ID,
+				AuthKey:  config.AuthKey,
+			},
+		}
+	}
+
+	res.tailnets[name] = t
+
+	return t
+}
+
+// dohServer returns a DNS server wrapping the DoH server at upstream,
+// isNew is set when the server has not been started yet.
+func (res *resources) dohServer(upstream string) (s *dohServer, isNew bool, err error) {
+	res.mu.Lock()
+	defer res.mu.Unlock()
+
+	if s, ok := res.dohServers[upstream]; ok {
+		return s, false, nil
+	}
+
+	if s := res.prev.findDoHServer(upstream); s != nil {
+		res.reused[s] = true
+		res.dohServers[upstream] = s
+
+		return s, false, nil
+	}
+
+	port, err := utils.FreePort(0)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to find free port for wrapped DNS server: %w", err)
+	}
+
+	s = &dohServer{
+		upstream: upstream,
+		addr:     net.JoinHostPort("localhost", strconv.Itoa(port)),
+	}
+
+	//nolint:contextcheck
+	s.server = doh.NewWrappingDNSServer(
+		&doh.WrappingDNSServerOptions{
+			Addr:       s.addr,
+			DoHServers: []string{upstream},
+			Timeout:    1 * time.Second,
+			Metrics:    res.metrics,
+		},
+	)
+
+	// servers are started by the caller, only started servers are shut down
+	s.server.NotifyStartedFunc = func() { s.started.Store(true) }
+
+	res.dohServers[upstream] = s
+
+	return s, true, nil
+}
+
+// opaPolicy returns the policy for the bundle, sharing one already created
+// for the handler or reusing the previous policy for the bundle. New
+// policies are returned before their bundle has been activated.
+func (res *resources) opaPolicy(ctx context.Context, bundle ConfigMiddlewarePropsOPABundle) (*policy, error) {
+	res.mu.Lock()
+	defer res.mu.Unlock()
+
+	for _, p := range res.policies {
+		if p.bundle == bundle {
+			return p, nil
+		}
+	}
+
+	if p := res.prev.findPolicy(bundle, res.reused); p != nil {
+		res.reused[p] = true
+		res.policies = append(res.policies, p)
+
+		return p, nil
+	}
+
+	p, err := newPolicy(ctx, bundle)
+	if err != nil {
+		return nil, err
+	}
+
+	res.policies = append(res.policies, p)
+
+	return p, nil
+}
+
+func newPolicy(ctx context.Context, bundle ConfigMiddlewarePropsOPABundle) (*policy, error) {
+	p := &policy{bundle: bundle, ready: make(chan struct{})}
+
+	opts := opa.InstanceOptions{
+		BundleServerAddr: bundle.ServerEndpoint,
+		BundlePath:       bundle.Path,
+		BundleFile:       bundle.File,
+		Ready:            p.ready,
+	}
+
+	// inline Rego is loaded as a directory bundle
+	if bundle.Rego != "" {
+		dir, err := os.MkdirTemp("", "tsnet-proxy-policy-")
+		if err != nil {
+			return nil, fmt.Errorf("failed to create policy dir: %w", err)
+		}
+
+		p.dir = dir
+		opts.BundleFile = dir
+
+		err = os.WriteFile(filepath.Join(dir, "policy.rego"), []byte(bundle.Rego), 0o600)
+		if err != nil {
+			//nolint:errcheck
+			os.RemoveAll(dir)
+
+			return nil, fmt.Errorf("failed to write policy: %w", err)
+		}
+	}
+
+	inst, err := opa.NewInstance(ctx, opts)
+	if err != nil {
+		if p.dir != "" {
+			//nolint:errcheck
+			os.RemoveAll(p.dir)
+		}
+
+		return nil, fmt.Errorf("failed to create OPA instance: %w", err)
+	}
+
+	p.inst = inst
+
+	if bundle.File != "" && bundle.Watch {
+		watcher, err := opa.NewBundleWatcher(inst, bundle.File)
+		if err != nil {
+			inst.Stop(ctx)
+
+			return nil, fmt.Errorf("failed to watch bundle: %w", err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		p.stopWatch = cancel
+
+		go watcher.Run(ctx)
+	}
+
+	return p, nil
+}
+
+func (res *resources) findTailnet(name string, config ConfigTailnet) *tailnet {
+	if res == nil {
+		return nil
+	}
+
+	res.mu.Lock()
+	defer res.mu.Unlock()
+
+	t, ok := res.tailnets[name]
+	if !ok || res.handedOver[t] || t.config != config {
+		return nil
+	}
+
+	return t
+}
+
+func (res *resources) findDoHServer(upstream string) *dohServer {
+	if res == nil {
+		return nil
+	}
+
+	res.mu.Lock()
+	defer res.mu.Unlock()
+
+	s, ok := res.dohServers[upstream]
+	if !ok || res.handedOver[s] {
+		return nil
+	}
+
+	return s
+}
+
+// findPolicy returns a policy for the bundle which isn't in use.
+func (res *resources) findPolicy(bundle ConfigMiddlewarePropsOPABundle, inUse map[any]bool) *policy {
+	if res == nil {
+		return nil
+	}
+
+	res.mu.Lock()
+	defer res.mu.Unlock()
+
+	for _, p := range res.policies {
+		if res.handedOver[p] || inUse[p] {
+			continue
+		}
+
+		if p.bundle == bundle {
+			return p
+		}
+	}
+
+	return nil
+}
+
+// commit hands the reused resources over from prev once the handler has
+// been built.
+func (res *resources) commit() {
+	res.mu.Lock()
+	defer res.mu.Unlock()
+
+	if res.prev != nil {
+		res.prev.mu.Lock()
+
+		for r := range res.reused {
+			res.prev.handedOver[r] = true
+		}
+
+		res.prev.mu.Unlock()
+	}
+
+	res.prev = nil
+	res.reused = make(map[any]bool)
+}
+
+// discard closes the resources opened for a handler which failed to build,
+// those reused from prev are left for prev to close.
+func (res *resources) discard() error {
+	res.mu.Lock()
+
+	for r := range res.reused {
+		res.handedOver[r] = true
+	}
+
+	res.prev = nil
+	res.mu.Unlock()
+
+	return res.Close()
+}
+
+func (res *resources) Close() error {
+	res.mu.Lock()
+	defer res.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var errs []error
+
+	for _, p := range res.policies {
+		if !res.handedOver[p] {
+			errs = append(errs, p.close(ctx))
+		}
+	}
+
+	for _, s := range res.dohServers {
+		if !res.handedOver[s] && s.started.Load() {
+			errs = append(errs, s.server.ShutdownContext(ctx))
+		}
+	}
+
+	for _, t := range res.tailnets {
+		if !res.handedOver[t] && t.started.Load() {
+			err := t.server.Close()
+			if err != nil && !errors.Is(err, net.ErrClosed) {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	for _, c := range res.closers {
+		errs = append(errs, c.Close())
+	}
+
+	res.handedOver = make(map[any]bool)
+	res.policies = nil
+	res.dohServers = make(map[string]*dohServer)
+	res.tailnets = make(map[string]*tailnet)
+	res.closers = nil
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,240 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/open-policy-agent/opa/plugins/bundle"
+)
+
+var (
+	ErrUpstreamNotFound = errors.New("upstream not found")
+	ErrTailnetNotFound  = errors.New("tailnet not found")
+)
+
+// UpstreamState controls whether requests are sent to an upstream, it can
+// be changed while the proxy is running.
+type UpstreamState int32
+
+const (
+	// UpstreamActive is the default state.
+	UpstreamActive UpstreamState = iota
+	// UpstreamDraining upstreams still match requests but respond with 503
+	// so that requests in flight can finish before the upstream is stopped.
+	UpstreamDraining
+	// UpstreamDisabled upstreams no longer match requests, they fall
+	// through to later upstreams.
+	UpstreamDisabled
+)
+
+func (s UpstreamState) String() string {
+	switch s {
+	case UpstreamActive:
+		return "active"
+	case UpstreamDraining:
+		return "draining"
+	case UpstreamDisabled:
+		return "disabled"
+	}
+
+	return "unknown"
+}
+
+// ParseUpstreamState parses the names returned by UpstreamState.String.
+func ParseUpstreamState(s string) (UpstreamState, error) {
+	for _, state := range []UpstreamState{UpstreamActive, UpstreamDraining, UpstreamDisabled} {
+		if state.String() == s {
+			return state, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown upstream state %q", s)
+}
+
+// SetUpstreamState changes the state of the named upstream.
+func (h *Handler) SetUpstreamState(name string, state UpstreamState) error {
+	found := false
+
+	for _, rt := range h.routes {
+		if rt.name == name {
+			rt.state.Store(int32(state))
+
+			found = true
+		}
+	}
+
+	if !found {
+		return fmt.Errorf("%w: %s", ErrUpstreamNotFound, name)
+	}
+
+	return nil
+}
+
+// FlushCaches purges the caches for the named upstream, or all upstreams
+// if name is empty.
+func (h *Handler) FlushCaches(name string) error {
+	found := name == ""
+
+	var errs []error
+
+	for _, rt := range h.routes {
+		if name != "" && rt.name != name {
+			continue
+		}
+
+		found = true
+
+		for _, store := range rt.caches {
+			errs = append(errs, store.Purge())
+		}
+	}
+
+	if !found {
+		return fmt.Errorf("%w: %s", ErrUpstreamNotFound, name)
+	}
+
+	return errors.Join(errs...)
+}
+
+// ReloadPolicies downloads the OPA bundles for all middlewares now rather
+// than waiting for the next poll.
+func (h *Handler) ReloadPolicies(ctx context.Context) error {
+	if h.resources == nil {
+		return nil
+	}
+
+	var errs []error
+
+	for _, p := range h.resources.policies {
+		plugin, ok := p.inst.Plugin(bundle.Name).(*bundle.Plugin)
+		if !ok {
+			continue
+		}
+
+		errs = append(errs, plugin.Trigger(ctx))
+	}
+
+	return errors.Join(errs...)
+}
+
+// PolicyStatus is the state of an OPA policy used by middlewares.
+type PolicyStatus struct {
+	// Bundle is where the policy is loaded from
+	Bundle string
+	// Ready is true once the bundle has been activated
+	Ready bool
+}
+
+// Policies returns the state of the handler's OPA policies.
+func (h *Handler) Policies() []PolicyStatus {
+	if h.resources == nil {
+		return nil
+	}
+
+	policies := make([]PolicyStatus, 0, len(h.resources.policies))
+
+	for _, p := range h.resources.policies {
+		policies = append(policies, PolicyStatus{
+			Bundle: p.bundle.String(),
+			Ready:  p.isReady(),
+		})
+	}
+
+	return policies
+}
+
+// Config returns the config the handler was built from, it's nil for
+// handlers created with NewHandler.
+func (h *Handler) Config() *Config {
+	return h.config
+}
+
+// Middlewares returns the names of the middlewares run for all requests,
+// in the order they're run.
+func (h *Handler) Middlewares() []string {
+	return h.middlewares
+}
+
+// Tailnets returns the backend state of each tailnet.
+func (h *Handler) Tailnets() map[string]string {
+	return tailnetStates(h.tailnets)
+}
+
+// TailnetReplaced returns true if the named tailnet isn't the one used by
+// prev, which is the case when a rebuild changed its config. Listeners
+// opened on prev's tailnet are closed with prev.
+func (h *Handler) TailnetReplaced(prev *Handler, name string) bool {
+	return h.tailnets[name] != prev.tailnets[name]
+}
+
+// ListenTailnet listens on addr in the named tailnet, starting the tsnet
+// server if needed.
+func (h *Handler) ListenTailnet(name, network, addr string) (net.Listener, error) {
+	t, ok := h.tailnets[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrTailnetNotFound, name)
+	}
+
+	t.started.Store(true)
+
+	l, err := t.server.Listen(network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on tailnet %s: %w", name, err)
+	}
+
+	return l, nil
+}
+
+// Close releases the resources opened for the handler by
+// NewHandlerFromConfig.
+func (h *Handler) Close() error {
+	if h.resources == nil {
+		return nil
+	}
+
+	return h.resources.Close()
+}
+
+// Health is the outcome of recent requests sent to an upstream.
+type Health struct {
+	Healthy             bool
+	ConsecutiveFailures int
+	LastSuccess         time.Time
+	LastFailure         time.Time
+	LastError           string
+}
+
+type health struct {
+	mu sync.Mutex
+	h  Health
+}
+
+func (h *health) record(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if err != nil {
+		h.h.ConsecutiveFailures++
+		h.h.LastFailure = time.Now()
+		h.h.LastError = err.Error()
+
+		return
+	}
+
+	h.h.ConsecutiveFailures = 0
+	h.h.LastSuccess = time.Now()
+}
+
+func (h *health) get() Health {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	res := h.h
+	res.Healthy = res.ConsecutiveFailures == 0
+
+	return res
+}
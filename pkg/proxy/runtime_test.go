@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDisabledUpstreamFallsThrough(t *testing.T) {
+	t.Parallel()
+
+	newUpstream := func(body string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			_, err := w.Write([]byte(body))
+			if err != nil {
+				t.Errorf("Failed to write response: %s", err)
+			}
+		}))
+	}
+
+	primary := newUpstream("primary")
+	defer primary.Close()
+
+	fallback := newUpstream("fallback")
+	defer fallback.Close()
+
+	matchAll := func(s *httptest.Server) Matcher {
+		return func(_ *http.Request) (*http.Client, string, bool) {
+			return s.Client(), s.URL, true
+		}
+	}
+
+	h, err := NewHandler(&Options{
+		Routes: []Route{
+			{Name: "primary", Matcher: matchAll(primary)},
+			{Name: "fallback", Matcher: matchAll(fallback)},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create proxy handler: %v", err)
+	}
+
+	get := func() string {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+		return rec.Body.String()
+	}
+
+	if exp, got := "primary", get(); exp != got {
+		t.Fatalf("Expected %q, got %q", exp, got)
+	}
+
+	err = h.SetUpstreamState("primary", UpstreamDisabled)
+	if err != nil {
+		t.Fatalf("Failed to disable upstream: %v", err)
+	}
+
+	if exp, got := "fallback", get(); exp != got {
+		t.Fatalf("Expected %q, got %q", exp, got)
+	}
+
+	err = h.SetUpstreamState("missing", UpstreamDisabled)
+	if !errors.Is(err, ErrUpstreamNotFound) {
+		t.Fatalf("Expected ErrUpstreamNotFound, got %v", err)
+	}
+}
+
+func TestParseUpstreamState(t *testing.T) {
+	t.Parallel()
+
+	for _, state := range []UpstreamState{UpstreamActive, UpstreamDraining, UpstreamDisabled} {
+		got, err := ParseUpstreamState(state.String())
+		if err != nil || got != state {
+			t.Fatalf("Expected %s, got %s (%v)", state, got, err)
+		}
+	}
+
+	_, err := ParseUpstreamState("paused")
+	if err == nil {
+		t.Fatal("Expected error for unknown state")
+	}
+}
@@ -0,0 +1,194 @@
+package proxy
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Redacted replaces secret values in the config dump.
+const Redacted = "REDACTED"
+
+// envPattern matches ${VAR}, $${VAR} escapes it.
+var envPattern = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// resolveReferences replaces the references in strings in the config with
+// the value they refer to:
+//
+//   - file:/path is replaced with the contents of the file, without
+//     trailing newlines, such as a systemd credential or a mounted secret
+//   - env:VAR is replaced with the value of the environment variable
+//   - ${VAR} anywhere in a string is replaced with the value of the
+//     environment variable, $${VAR} is left as ${VAR}
+//
+// Only values in the main config file are resolved, values from included
+// files are used as they're written so that they can't read the proxy's
+// environment or files. Fields tagged literal:"true", such as inline Rego,
+// are never resolved.
+func resolveReferences(cfg *Config) error {
+	v := &validator{sources: cfg.sources}
+
+	walkStrings(reflect.ValueOf(cfg).Elem(), "", false, func(path string, _ bool, s string) string {
+		if v.source(path) != "" {
+			return s
+		}
+
+		res, err := resolveReference(s)
+		if err != nil {
+			v.addf(path, "%s", err)
+
+			return s
+		}
+
+		return res
+	})
+
+	return v.err()
+}
+
+func resolveReference(s string) (string, error) {
+	switch {
+	case strings.HasPrefix(s, "file:"):
+		path := strings.TrimPrefix(s, "file:")
+
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to read %s: %w", path, err)
+		}
+
+		return strings.TrimRight(string(b), "\r\n"), nil
+	case strings.HasPrefix(s, "env:"):
+		name := strings.TrimPrefix(s, "env:")
+
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+
+		return v, nil
+	}
+
+	var err error
+
+	res := envPattern.ReplaceAllStringFunc(s, func(match string) string {
+		if strings.HasPrefix(match, "$$") {
+			return match[1:]
+		}
+
+		name := match[2 : len(match)-1]
+
+		v, ok := os.LookupEnv(name)
+		if !ok && err == nil {
+			err = fmt.Errorf("environment variable %s is not set", name)
+		}
+
+		return v
+	})
+
+	return res, err
+}
+
+// Redacted returns a copy of the config with values of fields tagged as
+// secrets replaced, so that it can be shown.
+func (c *Config) Redacted() (*Config, error) {
+	b, err := yaml.Marshal(c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode config: %w", err)
+	}
+
+	// the values are already resolved, so they're decoded as they are
+	var cfg Config
+
+	err = yaml.Unmarshal(b, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode config: %w", err)
+	}
+
+	// included files have already been merged in
+	cfg.Include = nil
+
+	walkStrings(reflect.ValueOf(&cfg).Elem(), "", false, func(_ string, secret bool, s string) string {
+		if secret && s != "" {
+			return Redacted
+		}
+
+		return s
+	})
+
+	return &cfg, nil
+}
+
+// walkStrings calls fn with the YAML path of each string in v and replaces
+// the string with the result. Strings in fields tagged secret:"true", or
+// within them, are marked as secret. Fields tagged literal:"true" are
+// skipped.
+func walkStrings(v reflect.Value, path string, secret bool, fn func(path string, secret bool, s string) string) {
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if !v.IsNil() {
+			walkStrings(v.Elem(), path, secret, fn)
+		}
+	case reflect.Struct:
+		t := v.Type()
+
+		for i := range t.NumField() {
+			field := t.Field(i)
+			if !field.IsExported() || field.Tag.Get("literal") == "true" {
+				continue
+			}
+
+			walkStrings(v.Field(i), joinPath(path, fieldName(field)), secret || field.Tag.Get("secret") == "true", fn)
+		}
+	case reflect.Slice:
+		for i := range v.Len() {
+			walkStrings(v.Index(i), path+"["+strconv.Itoa(i)+"]", secret, fn)
+		}
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return
+		}
+
+		for _, k := range v.MapKeys() {
+			// map values can't be set in place
+			elem := reflect.New(v.Type().Elem()).Elem()
+			elem.Set(v.MapIndex(k))
+
+			walkStrings(elem, joinPath(path, k.String()), secret, fn)
+
+			v.SetMapIndex(k, elem)
+		}
+	case reflect.String:
+		if v.CanSet() {
+			v.SetString(fn(path, secret, v.String()))
+		}
+	default:
+	}
+}
+
+// fieldName is the name of the field in YAML, fields decoded by a custom
+// unmarshaler set it with a path tag.
+func fieldName(field reflect.StructField) string {
+	if name := field.Tag.Get("path"); name != "" {
+		return name
+	}
+
+	name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+	if name == "" || name == "-" {
+		return strings.ToLower(field.Name)
+	}
+
+	return name
+}
+
+func joinPath(parent, name string) string {
+	if parent == "" {
+		return name
+	}
+
+	return parent + "." + name
+}
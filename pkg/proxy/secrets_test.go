@@ -0,0 +1,182 @@
+package proxy
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+//nolint:paralleltest // t.Setenv can't be used in parallel tests
+func TestLoadConfigReferences(t *testing.T) {
+	t.Setenv("PROXY_TEST_HOST", "box")
+	t.Setenv("PROXY_TEST_AUTH_KEY", "tskey-auth")
+
+	secretPath := filepath.Join(t.TempDir(), "client-secret")
+
+	err := os.WriteFile(secretPath, []byte("secretsecret\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := LoadConfig(strings.NewReader(`
+tailnets:
+  tsnet:
+    id: "${PROXY_TEST_HOST}-proxy"
+    auth-key: "env:PROXY_TEST_AUTH_KEY"
+upstreams:
+  - endpoint: "http://example.com"
+    tailnet: tsnet
+    hosts: ["$${PROXY_TEST_HOST}"]
+oauth:
+  callback_url: "https://example.com/callback"
+  provider_url: "https://example.com"
+  client_id: proxy
+  client_secret: "file:` + secretPath + `"
+`))
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	if exp, got := (ConfigTailnet{ID: "box-proxy", AuthKey: "tskey-auth"}), cfg.Tailnets["tsnet"]; exp != got {
+		t.Errorf("Tailnet did not match expected: %+v != %+v", exp, got)
+	}
+
+	if exp, got := []string{"${PROXY_TEST_HOST}"}, cfg.Upstreams[0].Hosts; !reflect.DeepEqual(exp, got) {
+		t.Errorf("Hosts did not match expected: %v != %v", exp, got)
+	}
+
+	if exp, got := "secretsecret", cfg.OAuth.ClientSecret; exp != got {
+		t.Errorf("ClientSecret did not match expected: %q != %q", exp, got)
+	}
+}
+
+func TestLoadConfigMissingReferences(t *testing.T) {
+	t.Parallel()
+
+	_, err := LoadConfig(strings.NewReader(`
+tailnets:
+  tsnet:
+    id: "${PROXY_TEST_UNSET}"
+    auth-key: "file:/does/not/exist"
+`))
+
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("Expected a validation error, got %v", err)
+	}
+
+	if exp, got := 2, len(validationErr.Problems); exp != got {
+		t.Fatalf("Expected %d problems, got %v", exp, validationErr.Problems)
+	}
+
+	if exp, got := "tailnets.tsnet.id: environment variable PROXY_TEST_UNSET is not set", validationErr.Problems[0]; exp != got {
+		t.Errorf("Problem did not match expected: %q != %q", exp, got)
+	}
+
+	if exp, got := "tailnets.tsnet.auth-key: failed to read /does/not/exist", validationErr.Problems[1]; !strings.HasPrefix(got, exp) {
+		t.Errorf("Problem did not match expected: %q != %q", exp, got)
+	}
+}
+
+func TestLoadConfigReferencesNotResolved(t *testing.T) {
+	t.Parallel()
+
+	rego := `package authz
+
+message := "${PROXY_TEST_UNSET}"
+`
+
+	dir := writeConfigFiles(t, map[string]string{
+		"config.yaml": `
+include: ["included.yaml"]
+middlewares:
+  - kind: opa
+    properties:
+      bundle:
+        rego: |
+          package authz
+
+          message := "${PROXY_TEST_UNSET}"
+`,
+		"included.yaml": `
+tailnets:
+  included:
+    id: "${PROXY_TEST_UNSET}"
+    auth-key: "file:/etc/passwd"
+`,
+	})
+
+	cfg, err := LoadConfigFile(filepath.Join(dir, "config.yaml"))
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	props, ok := cfg.Middlewares[0].Properties.(*ConfigMiddlewarePropsOPA)
+	if !ok {
+		t.Fatalf("Unexpected properties %T", cfg.Middlewares[0].Properties)
+	}
+
+	if exp, got := rego, props.Bundle.Rego; exp != got {
+		t.Errorf("Rego did not match expected: %q != %q", exp, got)
+	}
+
+	if exp, got := (ConfigTailnet{ID: "${PROXY_TEST_UNSET}", AuthKey: "file:/etc/passwd"}), cfg.Tailnets["included"]; exp != got {
+		t.Errorf("Included tailnet did not match expected: %+v != %+v", exp, got)
+	}
+}
+
+func TestConfigRedacted(t *testing.T) {
+	t.Parallel()
+
+	cfg := &Config{
+		Tracing: &ConfigTracing{
+			Endpoint: "http://localhost:4318/v1/traces",
+			Headers:  map[string]string{"Authorization": "Bearer token"},
+		},
+		Middlewares: []ConfigMiddleware{
+			{Kind: "ratelimit", Properties: &ConfigMiddlewarePropsRateLimit{Requests: 1, Header: "X-User"}},
+			{Kind: "identity", Properties: &ConfigMiddlewarePropsIdentity{Mode: "jwt", Key: "identity-key"}},
+		},
+		Tailnets: map[string]ConfigTailnet{
+			"tsnet": {ID: "proxy", AuthKey: "tskey-auth"},
+		},
+		OAuth: OAuthConfig{ClientID: "proxy", ClientSecret: "secret"},
+	}
+
+	redacted, err := cfg.Redacted()
+	if err != nil {
+		t.Fatalf("Failed to redact config: %v", err)
+	}
+
+	if exp, got := (ConfigTailnet{ID: "proxy", AuthKey: Redacted}), redacted.Tailnets["tsnet"]; exp != got {
+		t.Errorf("Tailnet did not match expected: %+v != %+v", exp, got)
+	}
+
+	if exp, got := Redacted, redacted.OAuth.ClientSecret; exp != got {
+		t.Errorf("ClientSecret did not match expected: %q != %q", exp, got)
+	}
+
+	if exp, got := "proxy", redacted.OAuth.ClientID; exp != got {
+		t.Errorf("ClientID did not match expected: %q != %q", exp, got)
+	}
+
+	if exp, got := Redacted, redacted.Tracing.Headers["Authorization"]; exp != got {
+		t.Errorf("Tracing header did not match expected: %q != %q", exp, got)
+	}
+
+	if exp, got := "X-User", redacted.Middlewares[0].Properties.(*ConfigMiddlewarePropsRateLimit).Header; exp != got {
+		t.Errorf("Middleware header did not match expected: %q != %q", exp, got)
+	}
+
+	if exp, got := Redacted, redacted.Middlewares[1].Properties.(*ConfigMiddlewarePropsIdentity).Key; exp != got {
+		t.Errorf("Identity key did not match expected: %q != %q", exp, got)
+	}
+
+	// the original is left as it was
+	if exp, got := "tskey-auth", cfg.Tailnets["tsnet"].AuthKey; exp != got {
+		t.Errorf("AuthKey did not match expected: %q != %q", exp, got)
+	}
+}
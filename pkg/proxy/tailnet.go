@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tsnet"
+)
+
+// tailnet is a tsnet server which is started the first time an upstream
+// dials through it.
+type tailnet struct {
+	config  ConfigTailnet
+	server  *tsnet.Server
+	started atomic.Bool
+}
+
+func (t *tailnet) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	t.started.Store(true)
+
+	//nolint:wrapcheck
+	return t.server.Dial(ctx, network, addr)
+}
+
+// WhoIs looks up the user and node using an address in the tailnet.
+func (t *tailnet) WhoIs(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+	t.started.Store(true)
+
+	lc, err := t.server.LocalClient()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get local client: %w", err)
+	}
+
+	res, err := lc.WhoIs(ctx, remoteAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up %s: %w", remoteAddr, err)
+	}
+
+	return res, nil
+}
+
+// state returns the backend state of the tailnet, such as Running or
+// NeedsLogin, without starting the server.
+func (t *tailnet) state(ctx context.Context) string {
+	if !t.started.Load() {
+		return "NotStarted"
+	}
+
+	lc, err := t.server.LocalClient()
+	if err != nil {
+		return "Unknown"
+	}
+
+	status, err := lc.StatusWithoutPeers(ctx)
+	if err != nil {
+		return "Unknown"
+	}
+
+	return status.BackendState
+}
+
+func tailnetStates(tailnets map[string]*tailnet) map[string]string {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	states := make(map[string]string, len(tailnets))
+
+	for name, t := range tailnets {
+		states[name] = t.state(ctx)
+	}
+
+	return states
+}
@@ -0,0 +1,551 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/open-policy-agent/opa/ast"
+
+	"github.com/charlieegan3/tool-tsnet-proxy/pkg/accesslog"
+	"github.com/charlieegan3/tool-tsnet-proxy/pkg/identity"
+	"github.com/charlieegan3/tool-tsnet-proxy/pkg/opa"
+)
+
+// ValidationError lists every problem found in a config, each prefixed
+// with the YAML path of the value at fault.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid config:\n  " + strings.Join(e.Problems, "\n  ")
+}
+
+var (
+	dnsNetworks      = []string{"", "tcp", "tcp4", "tcp6", "udp", "udp4", "udp6"}
+	rateLimitKeys    = []string{"", "ip", "header", "email", "upstream"}
+	cacheStores      = []string{"", "memory", "disk"}
+	accessLogOutputs = []string{"", "stdout", "stderr", "file", "syslog"}
+	httpSchemes      = []string{"http", "https"}
+	identityModes    = []string{"headers", "jwt"}
+	decisionLogs     = []string{"", "stdout", "file", "http"}
+	opaModes         = []string{"", opaModeEnforce, opaModeShadow}
+	opaOnErrors      = []string{"", opaOnErrorDeny, opaOnErrorAllow, opaOnErrorUnavailable}
+)
+
+const minIdentityKeyBytes = 32
+
+// Validate checks the config for values which can't be used, it returns a
+// *ValidationError listing all problems rather than stopping at the first.
+func (c *Config) Validate() error {
+	v := &validator{sources: c.sources}
+
+	if c.Port < 0 || c.Port > 65535 {
+		v.addf("port", "%d is not a valid port", c.Port)
+	}
+
+	if c.Admin.Tailnet != "" {
+		v.tailnet("admin.tailnet", c.Admin.Tailnet, c.Tailnets)
+	}
+
+	v.accessLog(c.AccessLog)
+
+	if c.Tracing != nil {
+		v.url("tracing.endpoint", c.Tracing.Endpoint, httpSchemes)
+	}
+
+	for i, s := range c.DNSServers {
+		v.dnsServer(fmt.Sprintf("dns-servers[%d]", i), s)
+	}
+
+	middlewares := make(map[string]ConfigMiddleware)
+
+	for i, m := range c.Middlewares {
+		path := fmt.Sprintf("middlewares[%d]", i)
+
+		v.middleware(path, m)
+
+		switch _, ok := middlewares[m.Name]; {
+		case m.Name == "" && !m.IsGlobal():
+			v.addf(path+".name", "required for middlewares which aren't global")
+		case ok:
+			v.addf(path+".name", "%q is used by more than one middleware", m.Name)
+		case m.Name != "":
+			middlewares[m.Name] = m
+		}
+	}
+
+	v.upstreams(c.Upstreams, c.Tailnets, middlewares)
+
+	// properties which refer to other parts of the config
+	for i, m := range c.Middlewares {
+		path := fmt.Sprintf("middlewares[%d].properties", i)
+
+		switch props := m.Properties.(type) {
+		case *ConfigMiddlewarePropsOPA:
+			v.upstreamDecisionPaths(path+".upstream-decision-paths", props.UpstreamDecisionPaths, c.Upstreams)
+
+			if props.Shadow != nil {
+				v.upstreamDecisionPaths(path+".shadow.upstream-decision-paths", props.Shadow.UpstreamDecisionPaths, c.Upstreams)
+			}
+		case *ConfigMiddlewarePropsTailscale:
+			if props.Tailnet != "" {
+				v.tailnet(path+".tailnet", props.Tailnet, c.Tailnets)
+			}
+		}
+	}
+
+	for _, name := range sortedKeys(c.Tailnets) {
+		if c.Tailnets[name].ID == "" {
+			v.addf(fmt.Sprintf("tailnets.%s.id", name), "required")
+		}
+	}
+
+	v.oauth(c.OAuth)
+
+	return v.err()
+}
+
+type validator struct {
+	problems []string
+
+	// sources are the files values were included from
+	sources map[string]string
+}
+
+func (v *validator) addf(path, format string, args ...any) {
+	v.add(path, fmt.Sprintf(format, args...))
+}
+
+func (v *validator) add(path, msg string) {
+	problem := path + ": " + msg
+
+	if source := v.source(path); source != "" {
+		problem += " (in " + source + ")"
+	}
+
+	v.problems = append(v.problems, problem)
+}
+
+// err returns the problems found as a *ValidationError, or nil.
+func (v *validator) err() error {
+	if len(v.problems) == 0 {
+		return nil
+	}
+
+	return &ValidationError{Problems: v.problems}
+}
+
+// source returns the file the value at path was included from, if any.
+func (v *validator) source(path string) string {
+	for prefix, source := range v.sources {
+		rest, ok := strings.CutPrefix(path, prefix)
+		if ok && (rest == "" || rest[0] == '.' || rest[0] == '[') {
+			return source
+		}
+	}
+
+	return ""
+}
+
+func (v *validator) oneOf(path, value string, allowed []string) {
+	if slices.Contains(allowed, value) {
+		return
+	}
+
+	v.addf(path, "%q must be one of %s", value, strings.Join(slices.DeleteFunc(slices.Clone(allowed), func(s string) bool {
+		return s == ""
+	}), ", "))
+}
+
+func (v *validator) url(path, value string, schemes []string) {
+	if value == "" {
+		v.addf(path, "required")
+
+		return
+	}
+
+	u, err := url.Parse(value)
+	if err != nil {
+		v.addf(path, "%q is not a valid URL", value)
+
+		return
+	}
+
+	if !slices.Contains(schemes, u.Scheme) || u.Host == "" {
+		v.addf(path, "%q must be an absolute %s URL", value, strings.Join(schemes, " or "))
+	}
+}
+
+func (v *validator) tailnet(path, name string, tailnets map[string]ConfigTailnet) {
+	if _, ok := tailnets[name]; !ok {
+		v.addf(path, "%q not defined in tailnets", name)
+	}
+}
+
+func (v *validator) accessLog(c *ConfigAccessLog) {
+	if c == nil {
+		return
+	}
+
+	if _, err := accesslog.NewFormat(c.Format, c.Template); err != nil {
+		v.addf("access-log.format", "%s", err)
+	}
+
+	v.oneOf("access-log.output", c.Output, accessLogOutputs)
+
+	if c.Output == "file" && c.File.Path == "" {
+		v.addf("access-log.file.path", "required for file output")
+	}
+
+	if c.SampleRate < 0 || c.SampleRate > 1 {
+		v.addf("access-log.sample-rate", "%v must be between 0 and 1", c.SampleRate)
+	}
+}
+
+func (v *validator) dnsServer(path string, s ConfigDNSServer) {
+	if s.DoH {
+		v.url(path+".addr", s.Addr, httpSchemes)
+
+		if s.Net != "" {
+			v.addf(path+".net", "not used for DoH servers")
+		}
+
+		return
+	}
+
+	v.oneOf(path+".net", s.Net, dnsNetworks)
+
+	if s.Addr == "" {
+		return
+	}
+
+	if _, _, err := net.SplitHostPort(s.Addr); err != nil {
+		v.addf(path+".addr", "%q must be a host and port", s.Addr)
+	}
+}
+
+func (v *validator) middleware(path string, m ConfigMiddleware) {
+	kinds := MiddlewareKinds()
+
+	if !slices.Contains(kinds, m.Kind) {
+		v.addf(path+".kind", "unknown kind %q, must be one of %s", m.Kind, strings.Join(kinds, ", "))
+
+		return
+	}
+
+	props, ok := m.Properties.(PropertiesValidator)
+	if !ok {
+		return
+	}
+
+	path += ".properties"
+
+	err := props.Validate()
+
+	var validationErr *ValidationError
+
+	switch {
+	case err == nil:
+	case errors.As(err, &validationErr):
+		for _, problem := range validationErr.Problems {
+			rel, msg, _ := strings.Cut(problem, ": ")
+
+			v.add(joinPath(path, rel), msg)
+		}
+	default:
+		v.addf(path, "%s", err)
+	}
+}
+
+// Validate checks the bundle is set.
+func (p *ConfigMiddlewarePropsOPA) Validate() error {
+	v := &validator{}
+
+	v.bundle("bundle", p.Bundle)
+	v.oneOf("mode", p.Mode, opaModes)
+	v.oneOf("on-error", p.OnError, opaOnErrors)
+
+	switch {
+	case p.WaitTimeout < 0:
+		v.addf("wait-timeout", "must not be negative")
+	case p.WaitTimeout > 0 && !p.waitForBundle():
+		v.addf("wait-timeout", "only used when wait is true")
+	}
+
+	if p.MaxBodyBytes < 0 {
+		v.addf("max-body-bytes", "must not be negative")
+	}
+
+	for _, upstream := range sortedKeys(p.UpstreamDecisionPaths) {
+		if p.UpstreamDecisionPaths[upstream] == "" {
+			v.addf(joinPath("upstream-decision-paths", upstream), "required")
+		}
+	}
+
+	if p.DecisionLogs != nil {
+		v.decisionLogs(p.DecisionLogs)
+	}
+
+	if p.Shadow != nil {
+		v.bundle("shadow.bundle", p.Shadow.Bundle)
+
+		for _, upstream := range sortedKeys(p.Shadow.UpstreamDecisionPaths) {
+			if p.Shadow.UpstreamDecisionPaths[upstream] == "" {
+				v.addf(joinPath("shadow.upstream-decision-paths", upstream), "required")
+			}
+		}
+	}
+
+	return v.err()
+}
+
+func (v *validator) decisionLogs(l *ConfigMiddlewarePropsOPADecisionLogs) {
+	v.oneOf("decision-logs.output", l.Output, decisionLogs)
+
+	switch l.Output {
+	case "file":
+		if l.Path == "" {
+			v.addf("decision-logs.path", "required")
+		}
+	case "http":
+		v.url("decision-logs.url", l.URL, httpSchemes)
+	}
+
+	if l.FlushInterval < 0 {
+		v.addf("decision-logs.flush-interval", "must not be negative")
+	}
+
+	for i, path := range l.Mask {
+		if _, err := opa.ParseMaskPath(path); err != nil {
+			v.add(fmt.Sprintf("decision-logs.mask[%d]", i), err.Error())
+		}
+	}
+}
+
+// bundle checks that policies are loaded from one place.
+func (v *validator) bundle(path string, b ConfigMiddlewarePropsOPABundle) {
+	sources := 0
+
+	for _, s := range []string{b.ServerEndpoint, b.File, b.Rego} {
+		if s != "" {
+			sources++
+		}
+	}
+
+	switch {
+	case sources == 0:
+		v.addf(path, "one of server-endpoint, file or rego is required")
+	case sources > 1:
+		v.addf(path, "only one of server-endpoint, file or rego can be set")
+	}
+
+	if b.ServerEndpoint != "" {
+		v.url(path+".server-endpoint", b.ServerEndpoint, httpSchemes)
+
+		if b.Path == "" {
+			v.addf(path+".path", "required")
+		}
+	}
+
+	if b.File != "" {
+		if _, err := os.Stat(b.File); err != nil {
+			v.addf(path+".file", "failed to read %s", b.File)
+		}
+	}
+
+	if b.Watch && b.File == "" {
+		v.addf(path+".watch", "only supported for file bundles")
+	}
+
+	if b.Rego != "" {
+		if _, err := ast.ParseModule("policy.rego", b.Rego); err != nil {
+			// parse errors end with the source of the line at fault
+			msg, _, _ := strings.Cut(err.Error(), "\n")
+
+			v.addf(path+".rego", "invalid policy: %s", msg)
+		}
+	}
+}
+
+// upstreamDecisionPaths checks the upstreams with decision paths exist,
+// unnamed upstreams are referenced by their endpoint.
+func (v *validator) upstreamDecisionPaths(path string, paths map[string]string, upstreams []ConfigUpstream) {
+	for _, name := range sortedKeys(paths) {
+		if !slices.ContainsFunc(upstreams, func(u ConfigUpstream) bool {
+			return u.Name == name || (u.Name == "" && u.Endpoint == name)
+		}) {
+			v.addf(joinPath(path, name), "%q not defined in upstreams", name)
+		}
+	}
+}
+
+// Validate checks the mode and key.
+func (p *ConfigMiddlewarePropsIdentity) Validate() error {
+	v := &validator{}
+
+	v.oneOf("mode", p.Mode, identityModes)
+
+	// HMAC keys shorter than the hash are weaker than they need to be
+	if len(p.Key) < minIdentityKeyBytes {
+		v.addf("key", "must be at least %d bytes", minIdentityKeyBytes)
+	}
+
+	if p.TTL < 0 {
+		v.addf("ttl", "must not be negative")
+	}
+
+	return v.err()
+}
+
+// Validate checks the tailnet is set.
+func (p *ConfigMiddlewarePropsTailscale) Validate() error {
+	v := &validator{}
+
+	if p.Tailnet == "" {
+		v.addf("tailnet", "required")
+	}
+
+	return v.err()
+}
+
+// Validate checks the key and limits.
+func (p *ConfigMiddlewarePropsRateLimit) Validate() error {
+	v := &validator{}
+
+	v.oneOf("key", p.Key, rateLimitKeys)
+
+	if p.Key == "header" && p.Header == "" {
+		v.addf("header", "required for header key")
+	}
+
+	if p.Requests <= 0 {
+		v.addf("requests", "must be greater than zero")
+	}
+
+	if p.Period <= 0 {
+		v.addf("period", "must be greater than zero")
+	}
+
+	return v.err()
+}
+
+func (v *validator) upstreams(
+	upstreams []ConfigUpstream,
+	tailnets map[string]ConfigTailnet,
+	middlewares map[string]ConfigMiddleware,
+) {
+	names := make(map[string]int)
+
+	for i, u := range upstreams {
+		path := fmt.Sprintf("upstreams[%d]", i)
+
+		if u.Name != "" {
+			if j, ok := names[u.Name]; ok {
+				v.addf(path+".name", "%q is also used by upstreams[%d]", u.Name, j)
+			} else {
+				names[u.Name] = i
+			}
+		}
+
+		v.url(path+".endpoint", u.Endpoint, httpSchemes)
+
+		if u.Tailnet != "" {
+			v.tailnet(path+".tailnet", u.Tailnet, tailnets)
+		}
+
+		if u.Cache != nil {
+			v.oneOf(path+".cache.store", u.Cache.Store, cacheStores)
+
+			if u.Cache.Store == "disk" && u.Cache.Dir == "" {
+				v.addf(path+".cache.dir", "required for disk store")
+			}
+		}
+
+		if u.Concurrency != nil && u.Concurrency.MaxInFlight <= 0 {
+			v.addf(path+".concurrency.max-in-flight", "must be greater than zero")
+		}
+
+		for j, name := range u.Middlewares {
+			m, ok := middlewares[name]
+
+			switch {
+			case !ok:
+				v.addf(fmt.Sprintf("%s.middlewares[%d]", path, j), "%q not defined in middlewares", name)
+			case m.IsGlobal():
+				v.addf(fmt.Sprintf("%s.middlewares[%d]", path, j), "%q is global and already used", name)
+			}
+		}
+
+		for j, name := range u.SkipMiddlewares {
+			m, ok := middlewares[name]
+
+			switch {
+			case !ok:
+				v.addf(fmt.Sprintf("%s.skip-middlewares[%d]", path, j), "%q not defined in middlewares", name)
+			case !m.IsGlobal():
+				v.addf(fmt.Sprintf("%s.skip-middlewares[%d]", path, j), "%q is not global", name)
+			}
+		}
+
+		// routes are matched in order, so a route is unreachable when an
+		// earlier one matches every request it would
+		for j, earlier := range upstreams[:i] {
+			if covers(earlier.Hosts, u.Hosts) && covers(earlier.PathPrefixes, u.PathPrefixes) {
+				v.addf(path, "unreachable, all requests it matches are matched by upstreams[%d] first", j)
+
+				break
+			}
+		}
+	}
+}
+
+// covers returns true when every value matched by the prefixes in b is
+// also matched by a prefix in a, empty lists match everything.
+func covers(a, b []string) bool {
+	if len(a) == 0 {
+		return true
+	}
+
+	if len(b) == 0 {
+		return false
+	}
+
+	for _, s := range b {
+		if !slices.ContainsFunc(a, func(prefix string) bool { return strings.HasPrefix(s, prefix) }) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (v *validator) oauth(c OAuthConfig) {
+	// oauth is optional, but once configured all of these are needed
+	if reflect.DeepEqual(c, OAuthConfig{}) {
+		return
+	}
+
+	v.url("oauth.provider_url", c.ProviderURL, httpSchemes)
+	v.url("oauth.callback_url", c.CallbackURL, httpSchemes)
+
+	if c.ClientID == "" {
+		v.addf("oauth.client_id", "required")
+	}
+
+	if c.ClientSecret == "" {
+		v.addf("oauth.client_secret", "required")
+	}
+
+	for i, claim := range c.Claims {
+		if err := identity.CheckClaimName(claim); err != nil {
+			v.add(fmt.Sprintf("oauth.claims[%d]", i), err.Error())
+		}
+	}
+}
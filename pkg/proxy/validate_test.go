@@ -0,0 +1,384 @@
+package proxy
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestConfigValidate(t *testing.T) {
+	t.Parallel()
+
+	testCases := map[string]struct {
+		config string
+		exp    []string
+	}{
+		"valid": {
+			config: `
+tailnets:
+  tsnet:
+    id: proxy
+dns-servers:
+  - addr: "1.1.1.1:53"
+    net: udp
+  - addr: "https://dns.example.com/dns-query"
+    doh: true
+middlewares:
+  - kind: ratelimit
+    properties:
+      requests: 10
+      period: 1s
+upstreams:
+  - endpoint: "http://a.example.com"
+    tailnet: tsnet
+    path-prefixes: ["/a"]
+  - endpoint: "http://b.example.com"
+`,
+		},
+		"all problems are reported": {
+			config: `
+port: 70000
+tailnets:
+  tsnet:
+    auth-key: key
+dns-servers:
+  - addr: "1.1.1.1"
+    net: quic
+  - addr: "dns.example.com"
+    doh: true
+middlewares:
+  - kind: auth
+  - kind: opa
+  - kind: ratelimit
+    properties:
+      key: header
+upstreams:
+  - name: app
+    endpoint: "internal.example.com"
+  - name: app
+    endpoint: "http://a.example.com"
+    tailnet: other
+    cache:
+      store: disk
+    concurrency:
+      max-in-flight: 0
+oauth:
+  client_id: proxy
+`,
+			exp: []string{
+				`port: 70000 is not a valid port`,
+				`dns-servers[0].net: "quic" must be one of tcp, tcp4, tcp6, udp, udp4, udp6`,
+				`dns-servers[0].addr: "1.1.1.1" must be a host and port`,
+				`dns-servers[1].addr: "dns.example.com" must be an absolute http or https URL`,
+				`middlewares[0].kind: unknown kind "auth", must be one of identity, opa, ratelimit, tailscale, test-header`,
+				`middlewares[1].properties.bundle: one of server-endpoint, file or rego is required`,
+				`middlewares[2].properties.header: required for header key`,
+				`middlewares[2].properties.requests: must be greater than zero`,
+				`middlewares[2].properties.period: must be greater than zero`,
+				`upstreams[0].endpoint: "internal.example.com" must be an absolute http or https URL`,
+				`upstreams[1].name: "app" is also used by upstreams[0]`,
+				`upstreams[1].tailnet: "other" not defined in tailnets`,
+				`upstreams[1].cache.dir: required for disk store`,
+				`upstreams[1].concurrency.max-in-flight: must be greater than zero`,
+				`upstreams[1]: unreachable, all requests it matches are matched by upstreams[0] first`,
+				`tailnets.tsnet.id: required`,
+				`oauth.provider_url: required`,
+				`oauth.callback_url: required`,
+				`oauth.client_secret: required`,
+			},
+		},
+		"middleware references": {
+			config: `
+middlewares:
+  - name: auth
+    kind: ratelimit
+    properties:
+      requests: 10
+      period: 1s
+  - name: auth
+    kind: ratelimit
+    global: false
+    properties:
+      requests: 10
+      period: 1s
+  - kind: ratelimit
+    global: false
+    properties:
+      requests: 10
+      period: 1s
+  - name: admin
+    kind: ratelimit
+    global: false
+    properties:
+      requests: 1
+      period: 1s
+upstreams:
+  - endpoint: "http://a.example.com"
+    path-prefixes: ["/a"]
+    middlewares: ["auth", "missing", "admin"]
+    skip-middlewares: ["admin", "other"]
+`,
+			exp: []string{
+				`middlewares[1].name: "auth" is used by more than one middleware`,
+				`middlewares[2].name: required for middlewares which aren't global`,
+				`upstreams[0].middlewares[0]: "auth" is global and already used`,
+				`upstreams[0].middlewares[1]: "missing" not defined in middlewares`,
+				`upstreams[0].skip-middlewares[0]: "admin" is not global`,
+				`upstreams[0].skip-middlewares[1]: "other" not defined in middlewares`,
+			},
+		},
+		"opa decision paths": {
+			config: `
+middlewares:
+  - kind: opa
+    properties:
+      bundle:
+        server-endpoint: "http://opa.example.com"
+        path: bundle.tar.gz
+      upstream-decision-paths:
+        app: services/app/allow
+        "http://b.example.com": services/b/allow
+        other: ""
+upstreams:
+  - name: app
+    endpoint: "http://a.example.com"
+    path-prefixes: ["/a"]
+  - endpoint: "http://b.example.com"
+`,
+			exp: []string{
+				`middlewares[0].properties.upstream-decision-paths.other: required`,
+				`middlewares[0].properties.upstream-decision-paths.other: "other" not defined in upstreams`,
+			},
+		},
+		"opa bundles": {
+			config: `
+middlewares:
+  - kind: opa
+    properties:
+      bundle:
+        server-endpoint: "http://opa.example.com"
+        file: fixtures
+  - kind: opa
+    properties:
+      bundle:
+        file: fixtures/missing
+  - kind: opa
+    properties:
+      bundle:
+        rego: "package authz\n\nallow :="
+        watch: true
+`,
+			exp: []string{
+				`middlewares[0].properties.bundle: only one of server-endpoint, file or rego can be set`,
+				`middlewares[0].properties.bundle.path: required`,
+				`middlewares[1].properties.bundle.file: failed to read fixtures/missing`,
+				`middlewares[2].properties.bundle.watch: only supported for file bundles`,
+				`middlewares[2].properties.bundle.rego: invalid policy: 1 error occurred: policy.rego:3: rego_parse_error: unexpected assign token: expected rule value term (e.g., allow := <VALUE> { ... })`,
+			},
+		},
+		"opa decision logs": {
+			config: `
+middlewares:
+  - kind: opa
+    properties:
+      bundle:
+        rego: "package authz"
+      decision-logs:
+        output: file
+  - kind: opa
+    properties:
+      bundle:
+        rego: "package authz"
+      decision-logs:
+        output: http
+        url: "ftp://logs.example.com"
+        mask: ["headers..Authorization", "header.Authorization", "headers.Cookie.session"]
+  - kind: opa
+    properties:
+      bundle:
+        rego: "package authz"
+      decision-logs:
+        output: kafka
+`,
+			exp: []string{
+				`middlewares[0].properties.decision-logs.path: required`,
+				`middlewares[1].properties.decision-logs.url: "ftp://logs.example.com" must be an absolute http or https URL`,
+				`middlewares[1].properties.decision-logs.mask[0]: invalid path "headers..Authorization"`,
+				`middlewares[1].properties.decision-logs.mask[1]: "header" is not an input key`,
+				`middlewares[1].properties.decision-logs.mask[2]: "headers.Cookie.session" can't be masked below "headers.Cookie"`,
+				`middlewares[2].properties.decision-logs.output: "kafka" must be one of stdout, file, http`,
+			},
+		},
+		"opa shadow": {
+			config: `
+middlewares:
+  - kind: opa
+    properties:
+      mode: dry-run
+      bundle:
+        rego: "package authz"
+      shadow:
+        bundle:
+          server-endpoint: "http://opa.example.com"
+        upstream-decision-paths:
+          other: authz/allow
+upstreams:
+  - endpoint: "http://a.example.com"
+`,
+			exp: []string{
+				`middlewares[0].properties.mode: "dry-run" must be one of enforce, shadow`,
+				`middlewares[0].properties.shadow.bundle.path: required`,
+				`middlewares[0].properties.shadow.upstream-decision-paths.other: "other" not defined in upstreams`,
+			},
+		},
+		"opa readiness": {
+			config: `
+middlewares:
+  - kind: opa
+    properties:
+      bundle:
+        server-endpoint: https://bundles.example.com
+        path: /bundle.tar.gz
+      wait-timeout: 10s
+      on-error: fail-open
+  - kind: opa
+    properties:
+      bundle:
+        rego: "package authz"
+      wait-timeout: -1s
+`,
+			exp: []string{
+				`middlewares[0].properties.on-error: "fail-open" must be one of deny, allow, 503`,
+				`middlewares[0].properties.wait-timeout: only used when wait is true`,
+				`middlewares[1].properties.wait-timeout: must not be negative`,
+			},
+		},
+		"tailscale identity": {
+			config: `
+tailnets:
+  tsnet:
+    id: proxy
+middlewares:
+  - kind: tailscale
+    properties:
+      tailnet: tsnet
+      headers: true
+  - kind: tailscale
+    properties:
+      tailnet: other
+  - kind: tailscale
+`,
+			exp: []string{
+				`middlewares[2].properties.tailnet: required`,
+				`middlewares[1].properties.tailnet: "other" not defined in tailnets`,
+			},
+		},
+		"identity forwarding": {
+			config: `
+middlewares:
+  - kind: identity
+    properties:
+      mode: jwt
+      key: "0123456789abcdef0123456789abcdef"
+  - kind: identity
+    properties:
+      mode: cookie
+      key: short
+      ttl: -1s
+oauth:
+  provider_url: https://accounts.example.com
+  callback_url: https://proxy.example.com/callback
+  client_id: proxy
+  client_secret: secret
+  claims: [sub, signature, Token]
+`,
+			exp: []string{
+				`middlewares[1].properties.mode: "cookie" must be one of headers, jwt`,
+				`middlewares[1].properties.key: must be at least 32 bytes`,
+				`middlewares[1].properties.ttl: must not be negative`,
+				`oauth.claims[1]: claim "signature" can't be sent as X-Identity-Signature, it's used to verify the identity headers`,
+				`oauth.claims[2]: claim "Token" can't be sent as X-Identity-Token, it's used to verify the identity headers`,
+			},
+		},
+		"overlapping routes": {
+			config: `
+upstreams:
+  - endpoint: "http://a.example.com"
+    hosts: ["a.example.com"]
+    path-prefixes: ["/api"]
+  - endpoint: "http://b.example.com"
+    hosts: ["a.example.com"]
+    path-prefixes: ["/api/v2"]
+  - endpoint: "http://c.example.com"
+    hosts: ["a.example.com", "c.example.com"]
+    path-prefixes: ["/api/v2"]
+  - endpoint: "http://d.example.com"
+    hosts: ["a.example.com"]
+`,
+			exp: []string{
+				`upstreams[1]: unreachable, all requests it matches are matched by upstreams[0] first`,
+			},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := LoadConfig(strings.NewReader(tc.config))
+			if tc.exp == nil {
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+
+				return
+			}
+
+			var validationErr *ValidationError
+			if !errors.As(err, &validationErr) {
+				t.Fatalf("Expected a validation error, got %v", err)
+			}
+
+			if exp, got := tc.exp, validationErr.Problems; !reflect.DeepEqual(exp, got) {
+				t.Fatalf("Problems did not match expected:\n%s\n!=\n%s",
+					strings.Join(exp, "\n"), strings.Join(got, "\n"))
+			}
+		})
+	}
+}
+
+func TestLoadConfigStrict(t *testing.T) {
+	t.Parallel()
+
+	testCases := map[string]string{
+		"unknown field": `
+upstreams:
+  - endpoint: "http://a.example.com"
+    path-prefix: ["/a"]
+`,
+		"unknown middleware property": `
+middlewares:
+  - kind: ratelimit
+    properties:
+      requests: 1
+      period: 1s
+      rate: 5
+`,
+	}
+
+	for name, config := range testCases {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := LoadConfig(strings.NewReader(config))
+			if err == nil {
+				t.Fatal("Expected unknown field to be rejected")
+			}
+
+			if !strings.Contains(err.Error(), "not found in type") {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package ratelimit
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/charlieegan3/tool-tsnet-proxy/pkg/requestid"
+)
+
+type Options struct {
+	Limit Limit
+	Store Store
+
+	// Key returns the bucket a request is counted against.
+	Key func(*http.Request) string
+
+	// Now returns the current time, it defaults to time.Now.
+	Now func() time.Time
+}
+
+// NewMiddleware returns a middleware which responds with 429 Too Many
+// Requests once a key's bucket is empty. The state of the bucket is
+// reported in RateLimit-* headers on every response.
+func NewMiddleware(opts Options) func(http.Handler) http.Handler {
+	if opts.Store == nil {
+		opts.Store = NewMemoryStore(0)
+	}
+
+	if opts.Now == nil {
+		opts.Now = time.Now
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			res := opts.Store.Take(opts.Key(r), opts.Limit, opts.Now())
+
+			w.Header().Set("RateLimit-Limit", strconv.Itoa(opts.Limit.Burst))
+			w.Header().Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+			w.Header().Set("RateLimit-Reset", seconds(res.Reset))
+
+			if !res.Allowed {
+				w.Header().Set("Retry-After", seconds(res.RetryAfter))
+				requestid.Error(w, r, "too many requests", http.StatusTooManyRequests)
+
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func seconds(d time.Duration) string {
+	return strconv.FormatInt(int64(math.Ceil(d.Seconds())), 10)
+}
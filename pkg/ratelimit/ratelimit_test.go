@@ -0,0 +1,114 @@
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreTake(t *testing.T) {
+	t.Parallel()
+
+	s := NewMemoryStore(time.Hour)
+	limit := Limit{Rate: 1, Burst: 2}
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for i, exp := range []bool{true, true, false} {
+		if got := s.Take("a", limit, now).Allowed; got != exp {
+			t.Fatalf("take %d: expected allowed %v, got %v", i, exp, got)
+		}
+	}
+
+	res := s.Take("a", limit, now.Add(500*time.Millisecond))
+	if res.Allowed {
+		t.Fatal("expected bucket to still be empty")
+	}
+
+	if exp, got := 500*time.Millisecond, res.RetryAfter; exp != got {
+		t.Fatalf("expected retry after %s, got %s", exp, got)
+	}
+
+	if !s.Take("b", limit, now).Allowed {
+		t.Fatal("expected other key to have its own bucket")
+	}
+
+	if !s.Take("a", limit, now.Add(time.Second)).Allowed {
+		t.Fatal("expected bucket to have refilled")
+	}
+}
+
+func TestMemoryStoreEviction(t *testing.T) {
+	t.Parallel()
+
+	s := NewMemoryStore(time.Minute)
+	limit := Limit{Rate: 0.1, Burst: 1}
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	s.Take("a", limit, now)
+	s.Take("b", limit, now.Add(59*time.Second))
+
+	if exp, got := 2, s.Len(); exp != got {
+		t.Fatalf("expected %d buckets, got %d", exp, got)
+	}
+
+	// a is full again, b has only just been used
+	s.Take("c", limit, now.Add(time.Minute))
+
+	if exp, got := 2, s.Len(); exp != got {
+		t.Fatalf("expected %d buckets after eviction, got %d", exp, got)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	h := NewMiddleware(Options{
+		Limit: Limit{Rate: 0.1, Burst: 1},
+		Key:   func(r *http.Request) string { return r.RemoteAddr },
+		Now:   func() time.Time { return now },
+	})(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	tests := []struct {
+		remoteAddr string
+		status     int
+		remaining  string
+		retryAfter string
+	}{
+		{"1.1.1.1:1", http.StatusNoContent, "0", ""},
+		{"1.1.1.1:1", http.StatusTooManyRequests, "0", "10"},
+		{"2.2.2.2:1", http.StatusNoContent, "0", ""},
+	}
+
+	for i, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = test.remoteAddr
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		if exp, got := test.status, rec.Code; exp != got {
+			t.Fatalf("request %d: expected status %d, got %d", i, exp, got)
+		}
+
+		if exp, got := "1", rec.Header().Get("RateLimit-Limit"); exp != got {
+			t.Fatalf("request %d: expected limit %s, got %s", i, exp, got)
+		}
+
+		if exp, got := test.remaining, rec.Header().Get("RateLimit-Remaining"); exp != got {
+			t.Fatalf("request %d: expected remaining %s, got %s", i, exp, got)
+		}
+
+		if exp, got := "10", rec.Header().Get("RateLimit-Reset"); exp != got {
+			t.Fatalf("request %d: expected reset %s, got %s", i, exp, got)
+		}
+
+		if exp, got := test.retryAfter, rec.Header().Get("Retry-After"); exp != got {
+			t.Fatalf("request %d: expected retry after %q, got %q", i, exp, got)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Limit describes a token bucket which is refilled at Rate tokens per
+// second and holds at most Burst tokens.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// Result is the state of a bucket after trying to take a token from it.
+type Result struct {
+	Allowed   bool
+	Remaining int
+
+	// RetryAfter is how long until a token will be available, it's zero
+	// when the request was allowed.
+	RetryAfter time.Duration
+
+	// Reset is how long until the bucket is full again.
+	Reset time.Duration
+}
+
+// Store holds the token buckets for each key.
+type Store interface {
+	Take(key string, limit Limit, now time.Time) Result
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	limit   Limit
+}
+
+func (b *bucket) refill(now time.Time) {
+	elapsed := now.Sub(b.updated).Seconds()
+	if elapsed > 0 {
+		b.tokens = math.Min(float64(b.limit.Burst), b.tokens+elapsed*b.limit.Rate)
+		b.updated = now
+	}
+}
+
+func (b *bucket) full(now time.Time) bool {
+	b.refill(now)
+
+	return b.tokens >= float64(b.limit.Burst)
+}
+
+func (b *bucket) durationFor(tokens float64) time.Duration {
+	if tokens <= 0 {
+		return 0
+	}
+
+	if b.limit.Rate <= 0 {
+		return time.Duration(math.MaxInt64)
+	}
+
+	return time.Duration(tokens / b.limit.Rate * float64(time.Second))
+}
+
+// MemoryStore keeps buckets in memory. Buckets which have refilled
+// completely are no different to new ones, so they are removed every
+// EvictionInterval as the store is used.
+type MemoryStore struct {
+	evictionInterval time.Duration
+
+	mu          sync.Mutex
+	buckets     map[string]*bucket
+	lastEvicted time.Time
+}
+
+func NewMemoryStore(evictionInterval time.Duration) *MemoryStore {
+	if evictionInterval == 0 {
+		evictionInterval = time.Minute
+	}
+
+	return &MemoryStore{
+		evictionInterval: evictionInterval,
+		buckets:          make(map[string]*bucket),
+	}
+}
+
+func (s *MemoryStore) Take(key string, limit Limit, now time.Time) Result {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.lastEvicted) >= s.evictionInterval {
+		s.evict(now)
+	}
+
+	b, ok := s.buckets[key]
+	if !ok || b.limit != limit {
+		b = &bucket{tokens: float64(limit.Burst), updated: now, limit: limit}
+		s.buckets[key] = b
+	}
+
+	b.refill(now)
+
+	res := Result{}
+
+	if b.tokens >= 1 {
+		b.tokens--
+		res.Allowed = true
+	} else {
+		res.RetryAfter = b.durationFor(1 - b.tokens)
+	}
+
+	res.Remaining = int(b.tokens)
+	res.Reset = b.durationFor(float64(limit.Burst) - b.tokens)
+
+	return res
+}
+
+// Len returns the number of buckets currently held.
+func (s *MemoryStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.buckets)
+}
+
+func (s *MemoryStore) evict(now time.Time) {
+	for key, b := range s.buckets {
+		if b.full(now) {
+			delete(s.buckets, key)
+		}
+	}
+
+	s.lastEvicted = now
+}
@@ -0,0 +1,132 @@
+package requestid
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+)
+
+// DefaultHeader is the header request IDs are read from and written to
+// when no other header is configured.
+const DefaultHeader = "X-Request-ID"
+
+// maxLength is the longest incoming request ID which will be accepted.
+const maxLength = 128
+
+type Options struct {
+	// Header is where the request ID is sent, it defaults to X-Request-ID.
+	Header string
+
+	// TrustIncoming uses valid request IDs sent by the client rather than
+	// generating a new one.
+	TrustIncoming bool
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx holding the request ID.
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the request ID for the request, if any.
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(contextKey{}).(string)
+
+	return id
+}
+
+// NewMiddleware returns a middleware which assigns each request an ID. The
+// ID is stored in the request context, set on the request so that it's
+// forwarded to upstreams and returned to the client in the response.
+func NewMiddleware(opts Options) func(http.Handler) http.Handler {
+	header := opts.Header
+	if header == "" {
+		header = DefaultHeader
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := r.Header.Get(header)
+			if !opts.TrustIncoming || !valid(id) {
+				id = New()
+			}
+
+			r.Header.Set(header, id)
+			w.Header().Set(header, id)
+
+			next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), id)))
+		})
+	}
+}
+
+// New generates a random request ID.
+func New() string {
+	b := make([]byte, 16)
+
+	//nolint:errcheck
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
+
+// valid only accepts IDs made of printable ASCII so that they can be
+// safely included in logs and error pages.
+func valid(id string) bool {
+	if id == "" || len(id) > maxLength {
+		return false
+	}
+
+	for _, c := range id {
+		if c <= ' ' || c > '~' || c == '"' || c == '<' || c == '>' || c == '\\' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Error replies to the request with an error message which includes the
+// request ID, so that users can report it.
+func Error(w http.ResponseWriter, r *http.Request, msg string, code int) {
+	http.Error(w, Annotate(r.Context(), msg), code)
+}
+
+// Annotate adds the request ID, if any, to a message.
+func Annotate(ctx context.Context, msg string) string {
+	if id := FromContext(ctx); id != "" {
+		return fmt.Sprintf("%s (request id: %s)", msg, id)
+	}
+
+	return msg
+}
+
+// NewLogHandler wraps a slog.Handler to add the request ID to records
+// logged with a request's context.
+func NewLogHandler(h slog.Handler) slog.Handler {
+	return &logHandler{Handler: h}
+}
+
+type logHandler struct {
+	slog.Handler
+}
+
+func (h *logHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id := FromContext(ctx); id != "" {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+
+	//nolint:wrapcheck
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h *logHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &logHandler{Handler: h.Handler.WithAttrs(attrs)}
+}
+
+func (h *logHandler) WithGroup(name string) slog.Handler {
+	return &logHandler{Handler: h.Handler.WithGroup(name)}
+}
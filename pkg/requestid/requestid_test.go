@@ -0,0 +1,88 @@
+package requestid
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMiddleware(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		trust    bool
+		incoming string
+		keep     bool
+	}{
+		"generated":             {},
+		"untrusted incoming":    {incoming: "abc"},
+		"trusted incoming":      {trust: true, incoming: "abc", keep: true},
+		"invalid incoming":      {trust: true, incoming: "<script>"},
+		"too long incoming":     {trust: true, incoming: strings.Repeat("a", maxLength+1)},
+		"trusted but not given": {trust: true},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			var upstreamID, contextID string
+
+			h := NewMiddleware(Options{TrustIncoming: test.trust})(
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					upstreamID = r.Header.Get(DefaultHeader)
+					contextID = FromContext(r.Context())
+
+					Error(w, r, "failed", http.StatusBadGateway)
+				}),
+			)
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if test.incoming != "" {
+				req.Header.Set(DefaultHeader, test.incoming)
+			}
+
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			id := rec.Header().Get(DefaultHeader)
+			if id == "" {
+				t.Fatal("expected request ID in response")
+			}
+
+			if test.keep && id != test.incoming {
+				t.Fatalf("expected incoming ID %q to be kept, got %q", test.incoming, id)
+			}
+
+			if !test.keep && id == test.incoming {
+				t.Fatalf("expected incoming ID %q to be replaced", test.incoming)
+			}
+
+			if upstreamID != id || contextID != id {
+				t.Fatalf("expected %q to be forwarded and in context, got %q and %q", id, upstreamID, contextID)
+			}
+
+			if !strings.Contains(rec.Body.String(), "request id: "+id) {
+				t.Fatalf("expected error page to contain request ID, got %q", rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestLogHandler(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+
+	logger := slog.New(NewLogHandler(slog.NewTextHandler(&buf, nil))).With("component", "test")
+
+	logger.InfoContext(NewContext(context.Background(), "abc123"), "hello")
+
+	if !strings.Contains(buf.String(), "request_id=abc123") {
+		t.Fatalf("expected log line to contain request ID, got %q", buf.String())
+	}
+}
@@ -1,16 +1,42 @@
 package opatest
 
 import (
+	"compress/gzip"
+	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"sync"
 	"time"
 
 	"github.com/open-policy-agent/opa/ast"
 	"github.com/open-policy-agent/opa/bundle"
 )
 
+// DecisionLogs are the decision log entries posted to a bundle server.
+type DecisionLogs struct {
+	mu      sync.Mutex
+	entries []map[string]interface{}
+}
+
+// Entries returns the entries received so far.
+func (l *DecisionLogs) Entries() []map[string]interface{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return append([]map[string]interface{}(nil), l.entries...)
+}
+
 func NewBundleServer(mods map[string][]byte) (*httptest.Server, error) {
+	s, _, err := NewBundleServerWithLogs(mods)
+
+	return s, err
+}
+
+// NewBundleServerWithLogs returns a bundle server which also accepts
+// decision logs, as a JSON array optionally gzipped, POSTed to /logs.
+func NewBundleServerWithLogs(mods map[string][]byte) (*httptest.Server, *DecisionLogs, error) {
 	b := bundle.Bundle{
 		Manifest: bundle.Manifest{
 			Revision: time.Now().UTC().Format(time.RFC3339),
@@ -29,7 +55,18 @@ func NewBundleServer(mods map[string][]byte) (*httptest.Server, error) {
 		)
 	}
 
-	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+	logs := &DecisionLogs{}
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && r.URL.Path == "/logs" {
+			err := logs.receive(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			}
+
+			return
+		}
+
 		w.Header().Set("content-type", "application/vnd.openpolicyagent.bundles")
 
 		err := bundle.NewWriter(w).Write(b)
@@ -41,5 +78,33 @@ func NewBundleServer(mods map[string][]byte) (*httptest.Server, error) {
 
 			return
 		}
-	})), nil
+	})), logs, nil
+}
+
+func (l *DecisionLogs) receive(r *http.Request) error {
+	var body io.Reader = r.Body
+
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return fmt.Errorf("failed to read gzip body: %w", err)
+		}
+		defer gz.Close()
+
+		body = gz
+	}
+
+	var entries []map[string]interface{}
+
+	err := json.NewDecoder(body).Decode(&entries)
+	if err != nil {
+		return fmt.Errorf("failed to decode entries: %w", err)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.entries = append(l.entries, entries...)
+
+	return nil
 }
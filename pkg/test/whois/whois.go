@@ -0,0 +1,47 @@
+package whoistest
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+// Client is a fake whois.Client which answers from a fixed set of
+// identities by IP address.
+type Client struct {
+	Identities map[string]*apitype.WhoIsResponse
+}
+
+func (c *Client) WhoIs(_ context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+
+	res, ok := c.Identities[host]
+	if !ok {
+		return nil, fmt.Errorf("no match for IP %s", host)
+	}
+
+	return res, nil
+}
+
+// NewIdentity returns a response for a user's node with tags, such as
+// tag:admin.
+func NewIdentity(login, node string, tags ...string) *apitype.WhoIsResponse {
+	return &apitype.WhoIsResponse{
+		Node: &tailcfg.Node{
+			Name:         node + ".example.ts.net.",
+			ComputedName: node,
+			Tags:         tags,
+		},
+		UserProfile: &tailcfg.UserProfile{
+			LoginName:   login,
+			DisplayName: login,
+		},
+		CapMap: tailcfg.PeerCapMap{},
+	}
+}
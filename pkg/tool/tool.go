@@ -20,6 +20,7 @@ import (
 	"gopkg.in/yaml.v2"
 
 	"github.com/charlieegan3/oauth-middleware/pkg/oauthmiddleware"
+	"github.com/charlieegan3/tool-tsnet-proxy/pkg/identity"
 	"github.com/charlieegan3/tool-tsnet-proxy/pkg/proxy"
 	"github.com/charlieegan3/toolbelt/pkg/apis"
 )
@@ -105,16 +106,20 @@ func (p *Proxy) HTTPAttach(router *mux.Router) error {
 		IDTokenVerifier: idTokenVerifier,
 		Validators: []oauthmiddleware.IDTokenValidator{
 			func(token *oidc.IDToken) (map[any]any, bool) {
-				c := struct {
-					Email string `json:"email"`
-				}{}
+				var all map[string]any
 
-				err := token.Claims(&c)
+				err := token.Claims(&all)
 				if err != nil {
 					return nil, false
 				}
 
-				return map[any]any{"email": c.Email}, true
+				claims := identity.Select(all, p.cfg.OAuth.Claims)
+				email, _ := all["email"].(string)
+
+				return map[any]any{
+					proxy.EmailContextKey: email,
+					identity.ContextKey:   claims,
+				}, true
 			},
 		},
 		AuthBasePath: "/",
@@ -124,7 +129,7 @@ func (p *Proxy) HTTPAttach(router *mux.Router) error {
 		return fmt.Errorf("failed to init oauth middleware: %w", err)
 	}
 
-	proxyHandler, dnsServers, err := proxy.NewHandlerFromConfig(ctx, p.cfg)
+	proxyHandler, dnsServers, err := proxy.NewHandlerFromConfig(ctx, p.cfg, nil)
 	if err != nil {
 		return fmt.Errorf("failed to create proxy: %w", err)
 	}
@@ -0,0 +1,107 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// instrumentationName is the name of the tracer used for all spans.
+const instrumentationName = "github.com/charlieegan3/tool-tsnet-proxy"
+
+const defaultServiceName = "tsnet-proxy"
+
+// Propagator reads and writes W3C traceparent and tracestate headers.
+var Propagator = propagation.TraceContext{}
+
+type Options struct {
+	// Endpoint is the URL of the OTLP HTTP traces endpoint, such as
+	// http://localhost:4318/v1/traces
+	Endpoint string
+	Headers  map[string]string
+
+	ServiceName string
+
+	// SampleRatio is the fraction of new traces which are sampled, traces
+	// started by clients follow the client's sampling decision. Values
+	// outside (0, 1) sample every trace.
+	SampleRatio float64
+}
+
+// NewProvider returns a TracerProvider which exports spans over OTLP. It
+// must be shut down to flush spans which have not yet been exported.
+func NewProvider(ctx context.Context, opts Options) (*sdktrace.TracerProvider, error) {
+	exporterOpts := []otlptracehttp.Option{otlptracehttp.WithEndpointURL(opts.Endpoint)}
+	if len(opts.Headers) > 0 {
+		exporterOpts = append(exporterOpts, otlptracehttp.WithHeaders(opts.Headers))
+	}
+
+	exporter, err := otlptracehttp.New(ctx, exporterOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+	}
+
+	serviceName := opts.ServiceName
+	if serviceName == "" {
+		serviceName = defaultServiceName
+	}
+
+	sampler := sdktrace.AlwaysSample()
+	if opts.SampleRatio > 0 && opts.SampleRatio < 1 {
+		sampler = sdktrace.TraceIDRatioBased(opts.SampleRatio)
+	}
+
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sampler)),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", serviceName),
+		)),
+	), nil
+}
+
+// Tracer returns the tracer for the provider, a nil provider returns a
+// tracer which records nothing.
+func Tracer(tp trace.TracerProvider) trace.Tracer {
+	if tp == nil {
+		tp = noop.NewTracerProvider()
+	}
+
+	return tp.Tracer(instrumentationName)
+}
+
+// Start starts a child of the span in ctx using the same provider, so that
+// packages which are handed a context don't need a provider of their own.
+func Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	//nolint:spancheck
+	return Tracer(trace.SpanFromContext(ctx).TracerProvider()).Start(ctx, name, opts...)
+}
+
+// End records the error, if any, on the span and ends it.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
+
+// Extract returns a context holding the span context sent by the client.
+func Extract(ctx context.Context, h http.Header) context.Context {
+	return Propagator.Extract(ctx, propagation.HeaderCarrier(h))
+}
+
+// Inject sets the traceparent header for the span in ctx.
+func Inject(ctx context.Context, h http.Header) {
+	Propagator.Inject(ctx, propagation.HeaderCarrier(h))
+}
@@ -0,0 +1,72 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestStartUsesParentProvider(t *testing.T) {
+	t.Parallel()
+
+	sr := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+
+	ctx, parent := Tracer(tp).Start(context.Background(), "parent")
+
+	_, child := Start(ctx, "child")
+	End(child, errors.New("failed"))
+	parent.End()
+
+	spans := sr.Ended()
+	if exp, got := 2, len(spans); exp != got {
+		t.Fatalf("expected %d spans, got %d", exp, got)
+	}
+
+	if exp, got := parent.SpanContext().SpanID(), spans[0].Parent().SpanID(); exp != got {
+		t.Fatalf("expected child of %s, got %s", exp, got)
+	}
+
+	if exp, got := codes.Error, spans[0].Status().Code; exp != got {
+		t.Fatalf("expected status %s, got %s", exp, got)
+	}
+}
+
+func TestStartWithoutProvider(t *testing.T) {
+	t.Parallel()
+
+	_, span := Start(context.Background(), "span")
+	defer span.End()
+
+	if span.IsRecording() {
+		t.Fatal("expected span without a provider not to record")
+	}
+}
+
+func TestPropagation(t *testing.T) {
+	t.Parallel()
+
+	traceparent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	in := http.Header{}
+	in.Set("traceparent", traceparent)
+
+	ctx := Extract(context.Background(), in)
+
+	if exp, got := "4bf92f3577b34da6a3ce929d0e0e4736", trace.SpanContextFromContext(ctx).TraceID().String(); exp != got {
+		t.Fatalf("expected trace ID %s, got %s", exp, got)
+	}
+
+	out := http.Header{}
+	Inject(ctx, out)
+
+	if exp, got := traceparent, out.Get("traceparent"); exp != got {
+		t.Fatalf("expected traceparent %s, got %s", exp, got)
+	}
+}
@@ -0,0 +1,166 @@
+package whois
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strings"
+
+	"tailscale.com/client/tailscale/apitype"
+)
+
+// Headers set for upstreams when enabled, copies sent by clients are
+// always removed so that upstreams can trust them.
+const (
+	HeaderUserLogin = "Tailscale-User-Login"
+	HeaderUserName  = "Tailscale-User-Name"
+	HeaderNodeName  = "Tailscale-Node-Name"
+	HeaderNodeTags  = "Tailscale-Node-Tags"
+)
+
+var headers = []string{HeaderUserLogin, HeaderUserName, HeaderNodeName, HeaderNodeTags}
+
+// Client looks up who is using a tailnet address, it's implemented by
+// the tsnet LocalClient.
+type Client interface {
+	WhoIs(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error)
+}
+
+// Identity is the Tailscale user and node a request was sent from.
+type Identity struct {
+	LoginName   string
+	DisplayName string
+	NodeName    string
+	Tags        []string
+	// Capabilities are the peer capabilities granted to the node, by name
+	Capabilities map[string][]interface{}
+}
+
+// Input returns the identity as OPA input.
+func (i *Identity) Input() map[string]interface{} {
+	return map[string]interface{}{
+		"login_name":   i.LoginName,
+		"display_name": i.DisplayName,
+		"node_name":    i.NodeName,
+		"tags":         i.Tags,
+		"capabilities": i.Capabilities,
+	}
+}
+
+// Key returns a string identifying the user and node, for keeping
+// responses for different identities apart. It's empty for a nil identity.
+func (i *Identity) Key() string {
+	if i == nil {
+		return ""
+	}
+
+	return i.LoginName + "\x00" + i.NodeName
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying the identity.
+func NewContext(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the identity found for the request, if any.
+func FromContext(ctx context.Context) *Identity {
+	id, _ := ctx.Value(contextKey{}).(*Identity)
+
+	return id
+}
+
+type Options struct {
+	Client Client
+	// Headers enables setting the Tailscale-* headers for upstreams
+	Headers bool
+}
+
+// NewMiddleware returns a middleware which looks up the identity of the
+// request's remote address. Requests from addresses outside the tailnet
+// are passed on without an identity.
+func NewMiddleware(opts Options) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, h := range headers {
+				r.Header.Del(h)
+			}
+
+			id, err := lookup(r.Context(), opts.Client, r.RemoteAddr)
+			if err != nil {
+				slog.DebugContext(r.Context(), "no tailscale identity for request", "remote_addr", r.RemoteAddr, "error", err)
+				next.ServeHTTP(w, r)
+
+				return
+			}
+
+			if opts.Headers {
+				r.Header.Set(HeaderUserLogin, id.LoginName)
+				r.Header.Set(HeaderUserName, mime.QEncoding.Encode("utf-8", id.DisplayName))
+				r.Header.Set(HeaderNodeName, id.NodeName)
+
+				if len(id.Tags) > 0 {
+					r.Header.Set(HeaderNodeTags, strings.Join(id.Tags, ","))
+				}
+			}
+
+			next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), id)))
+		})
+	}
+}
+
+func lookup(ctx context.Context, client Client, remoteAddr string) (*Identity, error) {
+	res, err := client.WhoIs(ctx, remoteAddr)
+	if err != nil {
+		//nolint:wrapcheck
+		return nil, err
+	}
+
+	id := &Identity{
+		Tags:         []string{},
+		Capabilities: make(map[string][]interface{}),
+	}
+
+	if res.UserProfile != nil {
+		id.LoginName = res.UserProfile.LoginName
+		id.DisplayName = res.UserProfile.DisplayName
+	}
+
+	if res.Node != nil {
+		id.NodeName = res.Node.ComputedName
+		if id.NodeName == "" {
+			id.NodeName = strings.TrimSuffix(res.Node.Name, ".")
+		}
+
+		if len(res.Node.Tags) > 0 {
+			id.Tags = res.Node.Tags
+		}
+	}
+
+	for capability, values := range res.CapMap {
+		decoded := make([]interface{}, 0, len(values))
+
+		for _, raw := range values {
+			var v interface{}
+
+			dec := json.NewDecoder(bytes.NewReader([]byte(raw)))
+			dec.UseNumber()
+
+			if err := dec.Decode(&v); err != nil {
+				slog.WarnContext(ctx, "invalid tailscale capability", "capability", capability, "error", err)
+
+				continue
+			}
+
+			decoded = append(decoded, v)
+		}
+
+		id.Capabilities[string(capability)] = decoded
+	}
+
+	return id, nil
+}
@@ -0,0 +1,133 @@
+package whois
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+
+	whoistest "github.com/charlieegan3/tool-tsnet-proxy/pkg/test/whois"
+)
+
+func TestMiddleware(t *testing.T) {
+	t.Parallel()
+
+	admin := whoistest.NewIdentity("alice@example.com", "laptop", "tag:admin")
+	admin.UserProfile.DisplayName = "Alice Ä"
+	admin.CapMap = tailcfg.PeerCapMap{
+		"example.com/cap/grafana": {`{"role":"editor"}`},
+	}
+
+	client := &whoistest.Client{
+		Identities: map[string]*apitype.WhoIsResponse{
+			"100.64.0.1": admin,
+		},
+	}
+
+	testCases := map[string]struct {
+		remoteAddr string
+		headers    bool
+		expID      *Identity
+		expHeaders http.Header
+	}{
+		"tailnet with headers": {
+			remoteAddr: "100.64.0.1:1234",
+			headers:    true,
+			expID: &Identity{
+				LoginName:   "alice@example.com",
+				DisplayName: "Alice Ä",
+				NodeName:    "laptop",
+				Tags:        []string{"tag:admin"},
+				Capabilities: map[string][]interface{}{
+					"example.com/cap/grafana": {map[string]interface{}{"role": "editor"}},
+				},
+			},
+			expHeaders: http.Header{
+				HeaderUserLogin: {"alice@example.com"},
+				HeaderUserName:  {"=?utf-8?q?Alice_=C3=84?="},
+				HeaderNodeName:  {"laptop"},
+				HeaderNodeTags:  {"tag:admin"},
+			},
+		},
+		"tailnet without headers": {
+			remoteAddr: "100.64.0.1:1234",
+			expID: &Identity{
+				LoginName:   "alice@example.com",
+				DisplayName: "Alice Ä",
+				NodeName:    "laptop",
+				Tags:        []string{"tag:admin"},
+				Capabilities: map[string][]interface{}{
+					"example.com/cap/grafana": {map[string]interface{}{"role": "editor"}},
+				},
+			},
+			expHeaders: http.Header{},
+		},
+		"outside tailnet": {
+			remoteAddr: "192.0.2.1:1234",
+			headers:    true,
+			expHeaders: http.Header{},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			var (
+				gotID      *Identity
+				gotHeaders http.Header
+			)
+
+			handler := NewMiddleware(Options{Client: client, Headers: tc.headers})(
+				http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+					gotID = FromContext(r.Context())
+					gotHeaders = r.Header
+				}),
+			)
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tc.remoteAddr
+
+			// headers sent by the client are never passed on
+			req.Header.Set(HeaderUserLogin, "mallory@example.com")
+			req.Header.Set(HeaderNodeTags, "tag:admin")
+
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			if exp, got := tc.expID, gotID; !reflect.DeepEqual(exp, got) {
+				t.Errorf("Identity did not match expected: %+v != %+v", exp, got)
+			}
+
+			if exp, got := tc.expHeaders, gotHeaders; !reflect.DeepEqual(exp, got) {
+				t.Errorf("Headers did not match expected: %v != %v", exp, got)
+			}
+		})
+	}
+}
+
+func TestIdentityInput(t *testing.T) {
+	t.Parallel()
+
+	id := &Identity{
+		LoginName:    "alice@example.com",
+		NodeName:     "laptop",
+		Tags:         []string{"tag:admin"},
+		Capabilities: map[string][]interface{}{"example.com/cap": {json.Number("1")}},
+	}
+
+	exp := map[string]interface{}{
+		"login_name":   "alice@example.com",
+		"display_name": "",
+		"node_name":    "laptop",
+		"tags":         []string{"tag:admin"},
+		"capabilities": map[string][]interface{}{"example.com/cap": {json.Number("1")}},
+	}
+
+	if got := id.Input(); !reflect.DeepEqual(exp, got) {
+		t.Errorf("Input did not match expected: %v != %v", exp, got)
+	}
+}